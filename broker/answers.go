@@ -8,36 +8,134 @@
 package broker
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 )
 
 var ErrAnswerNotFound = errors.New("answer not found")
 
-// answers contain messages answers data and methods to process it.
+// AnswerTimeout sets time during which broker waits consumer answer to
+// message which is not held in-flight: message sent to legacy consumer,
+// command sent in command mode or answer restored from storage. When the
+// timeout expires the answer is removed and producer gets no answer control
+// message. The default value is 60 seconds.
+type AnswerTimeout time.Duration
+
+const defaultAnswerTimeout = 60 * time.Second
+
+// answers contain messages answers data and methods to process it. Answers
+// map contains messages sent to consumers and not answered yet, so number of
+// outstanding messages of each consumer is counted in it too.
 type answers struct {
-	answersMap    // map of messages IDs
-	*sync.RWMutex // mutext
+	answersMap                   // map of messages IDs
+	*sync.RWMutex                // mutext
+	storage       Storage        // persistent storage, may be nil
+	outstanding   map[string]int // number of answers by consumer address
+	deadlines     answersTimes   // answers deadlines by consumers answerData
+	queues        answersQueues  // queues names by consumers answerData
+	timeout       time.Duration  // answer timeout of restored answers
 }
 type answersMap map[answersData]answersData
+type answersTimes map[answersData]time.Time
+type answersQueues map[answersData]string
 type answersData struct {
 	addr string // message channel
 	id   int    // message id
 }
 
-// newAnswers creates a new answers object.
-func newAnswers() (a *answers) {
+// newAnswers creates a new answers object. The timeout is answer timeout of
+// answers restored from storage.
+func newAnswers(storage Storage, timeout time.Duration) (a *answers) {
 	a = new(answers)
 	a.RWMutex = new(sync.RWMutex)
 	a.answersMap = make(answersMap)
+	a.outstanding = make(map[string]int)
+	a.deadlines = make(answersTimes)
+	a.queues = make(answersQueues)
+	a.storage = storage
+	a.timeout = timeout
 	return
 }
 
-// add adds message to the messages answers
-func (a *answers) add(producer, consumer answersData) {
+// load restores messages answers of queues selected by filter from
+// persistent storage. Answers saved without queue name belong to default
+// queue, they are saved again with key which contains queue name.
+func (a *answers) load(f queueFilter) (err error) {
+	if a.storage == nil {
+		return
+	}
 	a.Lock()
 	defer a.Unlock()
-	a.answersMap[consumer] = producer
+
+	moved := make(map[string]answersData)
+	err = rangePrefix(a.storage, storageAnswersPrefix,
+		func(key string, data []byte) (err error) {
+			consumer, producer, queue, err := readAnswer(data)
+			if err != nil || !f.match(queue) {
+				return
+			}
+			a.set(consumer, producer, queue, a.timeout)
+			if key != consumer.key(queue) {
+				moved[key] = consumer
+			}
+			return
+		},
+	)
+	for key, consumer := range moved {
+		a.storage.Del(key)
+		a.save(consumer, a.answersMap[consumer], a.queues[consumer])
+	}
+	return
+}
+
+// add adds message of queue to the messages answers. The answer is removed
+// by expired when timeout expires, zero timeout means the answer has no
+// deadline.
+func (a *answers) add(producer, consumer answersData, queue string,
+	timeout time.Duration) {
+
+	a.Lock()
+	defer a.Unlock()
+	a.set(consumer, producer, queue, timeout)
+	a.save(consumer, producer, queue)
+}
+
+// save writes answer to persistent storage. It should be called under lock.
+func (a *answers) save(consumer, producer answersData, queue string) {
+	if a.storage == nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	consumer.write(buf)
+	producer.write(buf)
+	writeBytes(buf, []byte(queue))
+	if err := a.storage.Set(consumer.key(queue), buf.Bytes()); err != nil {
+		log.Printf(logprefix+"save answer error: %s\n", err)
+	}
+}
+
+// readAnswer reads answer record saved to persistent storage.
+func readAnswer(data []byte) (consumer, producer answersData, queue string,
+	err error) {
+
+	buf := bytes.NewBuffer(data)
+	if err = consumer.read(buf); err != nil {
+		return
+	}
+	if err = producer.read(buf); err != nil {
+		return
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	q, err := readBytes(buf)
+	queue = string(q)
+	return
 }
 
 // get returns producers answerData by consumers answerData and delete it if
@@ -50,9 +148,130 @@ func (a *answers) get(consumer answersData) (*answersData, error) {
 	if !ok {
 		return nil, ErrAnswerNotFound
 	}
+	a.remove(consumer)
+	return &p, nil
+}
+
+// expired removes and returns answers with expired deadline. The returned map
+// contains producers answerData by consumers answerData.
+func (a *answers) expired(now time.Time) (l answersMap) {
+	a.Lock()
+	defer a.Unlock()
+
+	for consumer, deadline := range a.deadlines {
+		if now.Before(deadline) {
+			continue
+		}
+		if l == nil {
+			l = make(answersMap)
+		}
+		l[consumer] = a.answersMap[consumer]
+		a.remove(consumer)
+	}
+	return
+}
+
+// delConsumer removes and returns all answers of consumer address. The
+// returned map contains producers answerData by consumers answerData.
+func (a *answers) delConsumer(addr string) (l answersMap) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.outstanding[addr] == 0 {
+		return
+	}
+	for consumer, producer := range a.answersMap {
+		if consumer.addr != addr {
+			continue
+		}
+		if l == nil {
+			l = make(answersMap)
+		}
+		l[consumer] = producer
+		a.remove(consumer)
+	}
+	return
+}
+
+// set sets answer to answers map and counts consumers outstanding messages.
+// It should be called under lock.
+func (a *answers) set(consumer, producer answersData, queue string,
+	timeout time.Duration) {
+
+	if _, ok := a.answersMap[consumer]; !ok {
+		a.outstanding[consumer.addr]++
+	}
+	a.answersMap[consumer] = producer
+	a.queues[consumer] = queue
+	if timeout > 0 {
+		a.deadlines[consumer] = time.Now().Add(timeout)
+	} else {
+		delete(a.deadlines, consumer)
+	}
+}
+
+// remove removes answer from answers map and storage. It should be called
+// under lock.
+func (a *answers) remove(consumer answersData) {
+	a.forget(consumer)
+	if a.storage != nil {
+		if err := a.storage.Del(consumer.key(a.queues[consumer])); err != nil {
+			log.Printf(logprefix+"remove answer error: %s\n", err)
+		}
+	}
+	delete(a.queues, consumer)
+}
 
+// forget removes answer from answers map, it remains in storage. It should
+// be called under lock.
+func (a *answers) forget(consumer answersData) {
 	delete(a.answersMap, consumer)
-	return &p, nil
+	delete(a.deadlines, consumer)
+	if a.outstanding[consumer.addr]--; a.outstanding[consumer.addr] <= 0 {
+		delete(a.outstanding, consumer.addr)
+	}
+}
+
+// delProducers removes answers of producers messages and returns number of
+// removed answers.
+func (a *answers) delProducers(producers map[answersData]bool) (n int) {
+	a.Lock()
+	defer a.Unlock()
+
+	for consumer, producer := range a.answersMap {
+		if producers[producer] {
+			a.remove(consumer)
+			n++
+		}
+	}
+	return
+}
+
+// release removes answers of queues selected by filter from memory, they
+// remain in persistent storage.
+func (a *answers) release(f queueFilter) {
+	a.Lock()
+	defer a.Unlock()
+	for consumer, queue := range a.queues {
+		if f.match(queue) {
+			a.forget(consumer)
+			delete(a.queues, consumer)
+		}
+	}
+}
+
+// queueOf returns queue name of message by consumers answerData.
+func (a *answers) queueOf(consumer answersData) string {
+	a.RLock()
+	defer a.RUnlock()
+	return a.queues[consumer]
+}
+
+// count returns number of messages sent to consumer and not answered yet.
+func (a *answers) count(addr string) int {
+	a.RLock()
+	defer a.RUnlock()
+	return a.outstanding[addr]
 }
 
 // len return length of the answers map
@@ -62,3 +281,42 @@ func (a *answers) len() int {
 
 	return len(a.answersMap)
 }
+
+// producers returns producers messages of all answers.
+func (a *answers) producers() (l []answersData) {
+	a.RLock()
+	defer a.RUnlock()
+	for _, p := range a.answersMap {
+		l = append(l, p)
+	}
+	return
+}
+
+// key returns key in persistent storage of answer to message of queue.
+// Consumer connected to leaders of different cluster queues may get
+// messages with the same id from them, so the key contains queue name.
+func (d answersData) key(queue string) string {
+	return fmt.Sprintf("%s%d/%s/%s/%d", storageAnswersPrefix, len(queue),
+		queue, d.addr, d.id)
+}
+
+// write writes answersData to buffer.
+func (d answersData) write(buf *bytes.Buffer) {
+	writeBytes(buf, []byte(d.addr))
+	writeUvarint(buf, uint64(d.id))
+}
+
+// read reads answersData from buffer.
+func (d *answersData) read(buf *bytes.Buffer) (err error) {
+	addr, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	id, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	d.addr = string(addr)
+	d.id = int(id)
+	return
+}
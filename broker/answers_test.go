@@ -2,6 +2,7 @@ package broker
 
 import (
 	"testing"
+	"time"
 )
 
 func TestAnswers(t *testing.T) {
@@ -15,11 +16,18 @@ func TestAnswers(t *testing.T) {
 	c2 := "c-addr-2"
 
 	// create answers map
-	answers := newAnswers()
+	answers := newAnswers(nil, 0)
 
 	// Add to answers
-	answers.add(answersData{p1, 11}, answersData{c1, 21})
-	answers.add(answersData{p2, 11}, answersData{c2, 21})
+	answers.add(answersData{p1, 11}, answersData{c1, 21}, DefaultQueue, 0)
+	answers.add(answersData{p2, 11}, answersData{c2, 21}, DefaultQueue, 0)
+	answers.add(answersData{p2, 12}, answersData{c2, 22}, DefaultQueue, 0)
+
+	// Check number of outstanding messages of consumers
+	if answers.count(c1) != 1 || answers.count(c2) != 2 {
+		t.Error("wrong number of outstanding messages")
+		return
+	}
 
 	// Get from answers and check
 	p, err := answers.get(answersData{c1, 21})
@@ -42,8 +50,46 @@ func TestAnswers(t *testing.T) {
 		return
 	}
 
+	answers.get(answersData{c2, 22})
+
 	// Check length
-	if answers.len() != 0 {
+	if answers.len() != 0 || answers.count(c2) != 0 {
+		t.Error("wrong maps length")
+		return
+	}
+}
+
+func TestAnswersExpired(t *testing.T) {
+
+	// Create answers map with answers with and without deadline
+	answers := newAnswers(nil, 0)
+	answers.add(answersData{"p-addr-1", 11}, answersData{"c-addr-1", 21},
+		DefaultQueue, time.Millisecond)
+	answers.add(answersData{"p-addr-1", 12}, answersData{"c-addr-1", 22},
+		DefaultQueue, 0)
+	answers.add(answersData{"p-addr-2", 11}, answersData{"c-addr-2", 21},
+		DefaultQueue, 0)
+
+	// Only answer with deadline should expire
+	l := answers.expired(time.Now().Add(time.Second))
+	if len(l) != 1 || l[answersData{"c-addr-1", 21}] !=
+		(answersData{"p-addr-1", 11}) {
+		t.Errorf("wrong expired answers %v", l)
+		return
+	}
+	if answers.count("c-addr-1") != 1 {
+		t.Error("wrong number of outstanding messages")
+		return
+	}
+
+	// Consumer answers should be removed when consumer deleted
+	l = answers.delConsumer("c-addr-2")
+	if len(l) != 1 || l[answersData{"c-addr-2", 21}] !=
+		(answersData{"p-addr-2", 11}) {
+		t.Errorf("wrong consumer answers %v", l)
+		return
+	}
+	if answers.len() != 1 || answers.count("c-addr-2") != 0 {
 		t.Error("wrong maps length")
 		return
 	}
@@ -6,9 +6,14 @@
 package broker
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"maps"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"slices"
 
@@ -23,16 +28,40 @@ const logprefix = "broker: "
 // Broker is Teonet messages queue broker type.
 type Broker struct {
 	*teonet.Teonet
-	*consumers
+	transport teomq.Transport
+	*queues
 	*answers
-	*queue
 	wait
 	*command.Commands
 	*subscribers.Subscribers
+	*inflight
+	deadLetters       *deadLetters
+	dedup             *dedup
+	schedules         *schedules
+	selector          Selector
+	storage           Storage
+	visibilityTimeout time.Duration
+	answerTimeout     time.Duration
+	maxDeliveries     int
+	queueTTL          []QueueTTL
+	dropExpired       bool
+	priorityAging     time.Duration
+	dedupWindow       time.Duration
+	ctx               context.Context    // broker context, done when closed
+	cancel            context.CancelFunc // cancels broker context
+	wg                sync.WaitGroup     // broker goroutines
+	stopping          atomic.Bool        // stop sending messages to consumers
+	draining          atomic.Bool        // drain mode is on
+	peers             *peers             // connected consumers and producers
+	cluster           *cluster           // cluster state, nil if cluster mode is off
+	electionTimeout   time.Duration
+	closeOnce         sync.Once
+	closeErr          error
 }
 type wait struct {
 	*sync.Mutex
 	*sync.Cond
+	pending bool // wakeup was called while messages were processing
 }
 
 // init initialize wait structure
@@ -42,18 +71,125 @@ func (w *wait) init() {
 }
 
 // New creates a new Teonet MQueue Broker object.
+//
+// Optional broker parameters can be passed in the attr parameter together
+// with teonet application attributes:
+//   - func(*command.Commands): commands schema, starts broker in command mode
+//   - Storage: persistent storage for queued messages and answers routes,
+//     e.g. FileStorage created by NewFileStorage. Messages stored in the
+//     storage are replayed when broker created.
+//   - VisibilityTimeout: time during which message sent to consumer waits for
+//     consumer answer or acknowledge before redelivery, 30 seconds by default
+//   - AnswerTimeout: time during which broker waits answer to message which
+//     is not acknowledged by consumer, e.g. command sent in command mode,
+//     60 seconds by default
+//   - MaxDeliveries: number of failed deliveries after which message moves to
+//     dead-letter queue, 5 by default
+//   - QueueTTL: default time-to-live of messages in named queue
+//   - DropExpired: drop expired messages instead of moving them to
+//     dead-letter queue
+//   - PriorityAging: time after which waiting message priority is increased
+//     by one level, 10 seconds by default, zero disables aging
+//   - Selector: consumer selection strategy, RoundRobin by default; the
+//     LeastOutstanding, WeightedCapacity and LowestTriptime strategies are
+//     available too
+//   - Cluster: addresses of cluster brokers, starts broker in cluster mode
+//     where it is leader or follower of each queue; follower replicates
+//     leader storage, forwards producers messages to the leader and sends
+//     consumers the leader address
+//   - ElectionTimeout: time during which started cluster broker waits
+//     announcements of queues leaders, 3 seconds by default
+//   - DedupWindow: time during which idempotency keys of answered messages
+//     are kept to drop duplicate messages, 10 minutes by default, zero
+//     disables deduplication
+//   - teomq.Transport: transport used instead of teonet, e.g. loopback
+//     transport created by teomq.NewLoopback; teonet application
+//     attributes are not used and embedded Teonet is nil in this case
 func New(appShort string, attr ...any) (br *Broker, err error) {
+	return NewContext(context.Background(), appShort, attr...)
+}
+
+// NewContext creates a new Teonet MQueue Broker object which is closed when
+// context done. See New for attributes description.
+func NewContext(ctx context.Context, appShort string, attr ...any) (
+	br *Broker, err error) {
+
 	br = new(Broker)
+	br.ctx, br.cancel = context.WithCancel(ctx)
 	br.wait.init()
-	br.queue = newQueue()
-	br.answers = newAnswers()
-	br.consumers = newConsumers()
+	br.visibilityTimeout = defaultVisibilityTimeout
+	br.answerTimeout = defaultAnswerTimeout
+	br.maxDeliveries = defaultMaxDeliveries
+	br.priorityAging = defaultPriorityAging
+	br.selector = RoundRobin{}
+	br.electionTimeout = defaultElectionTimeout
+	br.dedupWindow = defaultDedupWindow
+	attr = br.addOptions(attr...)
+	br.storage = br.cluster.wrap(br.storage)
+	br.queues = newQueues(br.storage)
+	br.queues.setAging(br.priorityAging)
+	for _, v := range br.queueTTL {
+		br.SetQueueTTL(v.Queue, v.TTL)
+	}
+	br.answers = newAnswers(br.storage, br.answerTimeout)
+	br.inflight = newInflight()
+	br.deadLetters = newDeadLetters(br.storage)
+	br.dedup = newDedup(br.storage, br.dedupWindow)
+	br.schedules = newSchedules(br.storage)
+	br.peers = newPeers()
+
+	// Cluster broker restores queues from storage when it becomes leader
+	if br.cluster == nil {
+		if err = br.load(nil); err != nil {
+			br.cancel()
+			return
+		}
+	}
 	attr = br.addCommands(attr...)
-	br.Teonet, err = teomq.NewTeonet(appShort, append(attr, br.reader)...)
+	br.transport, br.Teonet, err = teomq.NewTransport(br.ctx, appShort,
+		br.reader, attr...)
+	if err != nil {
+		br.cancel()
+		return
+	}
+	br.wg.Add(3)
 	go br.process()
+	go br.housekeeping()
+	go br.scheduler()
+	br.startCluster()
+	context.AfterFunc(br.ctx, func() { br.Close() })
 	return
 }
 
+// Close stops broker messages processing, closes broker transport and
+// storage. Messages which are not answered yet remain in storage and are
+// redelivered when broker starts next time.
+func (br *Broker) Close() error {
+	br.closeOnce.Do(func() {
+		br.stopping.Store(true)
+		br.cancel()
+		br.wakeup()
+		br.wg.Wait()
+		br.closeErr = br.transport.Close()
+		if br.storage != nil {
+			br.closeErr = errors.Join(br.closeErr, br.storage.Close())
+		}
+	})
+	return br.closeErr
+}
+
+// Shutdown gracefully shuts down broker. It drains broker, see Drain, and
+// closes it. The attr may contain handoff Storage to save not answered
+// messages. If context done before all messages answered, broker is closed
+// and context error is returned.
+func (br *Broker) Shutdown(ctx context.Context, attr ...any) error {
+	if err := br.Drain(ctx, attr...); err != nil {
+		br.Close()
+		return err
+	}
+	return br.Close()
+}
+
 // addCommands adds command schema to broker.
 func (br *Broker) addCommands(attr ...any) (outattr []any) {
 
@@ -76,30 +212,135 @@ func (br *Broker) addCommands(attr ...any) (outattr []any) {
 	return
 }
 
+// addOptions gets broker options from attributes and returns attributes
+// without broker options.
+func (br *Broker) addOptions(attr ...any) (outattr []any) {
+	for _, v := range attr {
+		switch v := v.(type) {
+		case Storage:
+			br.storage = v
+		case VisibilityTimeout:
+			if v > 0 {
+				br.visibilityTimeout = time.Duration(v)
+			}
+		case AnswerTimeout:
+			if v > 0 {
+				br.answerTimeout = time.Duration(v)
+			}
+		case MaxDeliveries:
+			if v > 0 {
+				br.maxDeliveries = int(v)
+			}
+		case QueueTTL:
+			br.queueTTL = append(br.queueTTL, v)
+		case DropExpired:
+			br.dropExpired = bool(v)
+		case PriorityAging:
+			br.priorityAging = time.Duration(v)
+		case Selector:
+			br.selector = v
+		case Cluster:
+			br.cluster = newCluster(v)
+		case ElectionTimeout:
+			if v > 0 {
+				br.electionTimeout = time.Duration(v)
+			}
+		case DedupWindow:
+			br.dedupWindow = time.Duration(v)
+		default:
+			outattr = append(outattr, v)
+		}
+	}
+	return
+}
+
+// load restores queues selected by filter and their answers from persistent
+// storage.
+func (br *Broker) load(f queueFilter) (err error) {
+	if br.storage == nil {
+		return
+	}
+	if err = br.queues.load(f); err != nil {
+		return
+	}
+	if err = br.answers.load(f); err != nil {
+		return
+	}
+
+	// Messages which were in-flight are restored to queues and will be
+	// redelivered with new answers, so answers of their previous deliveries
+	// are removed and their producers are not told that they are not
+	// answered
+	restored := make(map[answersData]bool)
+	for _, m := range br.queued() {
+		if m.from != "" {
+			restored[answersData{m.from, m.id}] = true
+		}
+	}
+	br.answers.delProducers(restored)
+
+	if err = br.deadLetters.load(f); err != nil {
+		return
+	}
+	if err = br.dedup.load(f); err != nil {
+		return
+	}
+	if err = br.schedules.load(f); err != nil {
+		return
+	}
+	br.queues.setSeq(br.deadLetters.lastID())
+	log.Printf(logprefix+"restored %d queue messages, %d delayed messages, "+
+		"%d answers, %d dead letters, %d idempotency keys and %d "+
+		"schedules\n", br.queues.len(), br.queues.delayed.len(),
+		br.answers.len(), br.deadLetters.len(), br.dedup.len(),
+		br.schedules.len())
+	return
+}
+
 // commandMode returns true if broker is in command mode.
 func (br *Broker) commandMode() bool {
 	return br.Commands != nil
 }
 
-// PacketInterface is interface for teonet Packet.
-type PacketInterface interface {
-	ID() int
-	Data() []byte
+// Address returns broker address.
+func (br *Broker) Address() string {
+	return br.transport.Address()
 }
 
-// reader is main teonet application reader for Broker object, it receive
-// and process incoming teonet messages.
-func (br *Broker) reader(c *teonet.Channel, p *teonet.Packet,
-	e *teonet.Event) bool {
-	return br.readerI(c, p, e)
-}
-func (br *Broker) readerI(c *teonet.Channel, p PacketInterface,
-	e *teonet.Event) bool {
+// PacketInterface is interface for teonet Packet.
+type PacketInterface = teomq.Payload
+
+// reader is main transport reader for Broker object, it receive and process
+// incoming messages.
+func (br *Broker) reader(c teomq.Channel, p PacketInterface,
+	e teomq.Event) bool {
+
+	// Skip events of closed broker
+	if br.ctx.Err() != nil {
+		return false
+	}
+
+	// Process cluster brokers events and messages
+	if br.cluster.member(c.Address()) {
+		return br.clusterReader(c, p, e)
+	}
+
+	// Add connected channel to peers and notify it in drain mode
+	if e == teomq.EventConnected {
+		br.peers.add(c)
+		if br.draining.Load() {
+			br.goingAway(c)
+		}
+		return false
+	}
 
 	// Check channel disconnected
-	if e.Event == teonet.EventDisconnected {
-		if err := br.consumers.del(c); err == nil {
+	if e == teomq.EventDisconnected {
+		br.peers.del(c)
+		if br.queues.delConsumer(c) {
 			log.Printf(logprefix+"consumer removed %s\n", c)
+			br.requeueChannel(c)
+			br.purgeAnswers(c)
 		}
 		if br.commandMode() {
 			br.Subscribers.Del(c)
@@ -108,7 +349,7 @@ func (br *Broker) readerI(c *teonet.Channel, p PacketInterface,
 	}
 
 	// Skip not Data events
-	if e.Event != teonet.EventData {
+	if e != teomq.EventData {
 		return false
 	}
 
@@ -122,15 +363,28 @@ func (br *Broker) readerI(c *teonet.Channel, p PacketInterface,
 		// )
 
 		// Check consumerHello message from new consumer
-		if len(p.Data()) == len(teomq.ConsumerHello) &&
-			string(p.Data()) == string(teomq.ConsumerHello) {
+		if teomq.IsHello(p.Data()) {
+
+			// Get consumer options
+			var hello teomq.Hello
+			if err := hello.UnmarshalBinary(p.Data()); err != nil {
+				log.Printf(logprefix+"wrong hello from %s: %s\n", c, err)
+				return true
+			}
 
-			// Add to consumers list
-			log.Printf(logprefix+"consumer added %s\n", c)
-			br.consumers.add(c)
+			// Add to consumers lists of queues served by consumer
+			log.Printf(logprefix+"consumer added %s, version %d, queues %q, "+
+				"prefetch %d\n", c, hello.Version, hello.QueuesOrDefault(),
+				hello.Prefetch)
+			if !hello.Acks() {
+				log.Printf(logprefix+"legacy consumer %s does not get "+
+					"messages with routing key\n", c)
+			}
+			br.queues.addConsumer(c, hello)
 
-			// Send answer
+			// Send answer and leaders of consumer queues in cluster mode
 			c.Send(teomq.ConsumerAnswer)
+			br.sendLeaders(c, hello.QueuesOrDefault()...)
 
 			// Wake up messages processing
 			br.wakeup()
@@ -139,7 +393,13 @@ func (br *Broker) readerI(c *teonet.Channel, p PacketInterface,
 		}
 
 		// Got answer from consumer
-		if br.consumers.exists(c) {
+		if _, ok := br.queues.consumer(c); ok {
+
+			// Check acknowledge from consumer
+			if cmd, id, ok := teomq.ParseAck(p.Data()); ok {
+				br.ack(c, cmd, id)
+				return true
+			}
 
 			// Unmarshal packet data to answer
 			ans := &teomq.Packet{}
@@ -154,6 +414,7 @@ func (br *Broker) readerI(c *teonet.Channel, p PacketInterface,
 
 			// Check answer from consumer in wait answer list
 			log.Printf(logprefix+"got  id %d, len %d, from consumer %s\n", ans.ID(), len(ans.Data()), c)
+			queue := br.answers.queueOf(answersData{c.Address(), ans.ID()})
 			ansd, err := br.answers.get(answersData{c.Address(), ans.ID()})
 			if err != nil {
 
@@ -179,37 +440,106 @@ func (br *Broker) readerI(c *teonet.Channel, p PacketInterface,
 				return true
 			}
 
-			// Create and marshal producer answer packet
-			ans = teomq.NewPacket(uint32(ansd.id), ans.Data())
+			// Message answered, remove it from in-flight and wake up
+			// messages processing because consumer may get next message
+			if d, ok := br.inflight.del(answersData{c.Address(), ans.ID()}); ok {
+				br.queues.get(d.msg.queue).done(d.msg)
+			}
+			br.wakeup()
+
+			// Drop answer to schedule message which has no producer
+			if ansd.addr == "" {
+				log.Printf(logprefix+"drop answer id %d to schedule message "+
+					"from consumer %s\n", ans.ID(), c)
+				return true
+			}
+
+			// Create and marshal producer answer packet, answers to commands
+			// contain consumer address in source header
+			h := ans.Header()
+			if br.commandMode() {
+				h = h.Clone()
+				if h == nil {
+					h = make(teomq.Header)
+				}
+				h.Set(teomq.HeaderSource, c.Address())
+			}
+			ans = teomq.NewPacket(uint32(ansd.id), ans.Data()).
+				SetHeader(h).SetFlags(ans.Flags())
 			data, err := ans.MarshalBinary()
 			if err != nil {
 				log.Printf(logprefix+"MarshalBinary error: %s\n", err)
 				return true
 			}
+			br.dedupAnswer(queue, *ansd, ans)
+
+			// Send answer to producer when answered message is removed
+			// from replicas of cluster brokers
+			br.commit(queue, func() {
+				if err := br.sendTo(ansd.addr, data); err != nil {
+					log.Printf(logprefix+"send answer err: %s\n", err)
+					return
+				}
+				log.Printf(logprefix+"send id %d, len %d, to producer %s\n", ans.ID(), len(ans.Data()), ansd.addr)
+			})
 
-			// Send answer to producer
-			if _, err := br.SendTo(ansd.addr, data); err != nil {
-				log.Printf(logprefix+"send answer err: %s\n", err)
-				return true
-			}
-			log.Printf(logprefix+"send id %d, len %d, to producer %s\n", ans.ID(), len(ans.Data()), ansd.addr)
+			return true
+		}
 
+		// Reject message from producer in drain mode
+		if br.draining.Load() {
+			log.Printf(logprefix+"reject message id %d from producer %s, "+
+				"drain mode is on\n", p.ID(), c)
+			br.goingAway(c, p.ID())
+			return true
+		}
+
+		// Get message from producer
+		msg, err := newMessage(c.Address(), p.ID(), p.Data())
+		if err != nil {
+			log.Printf(logprefix+"unmarshal message id %d from %s error: %s\n",
+				p.ID(), c, err)
+			return false
+		}
+
+		// Forward message to cluster broker which leads message queue
+		if !br.leads(msg.queue) {
+			br.forward(c, p.ID(), p.Data(), msg.queue)
 			return true
 		}
 
 		// Check command mode
 		if br.commandMode() {
-			_, _, _, _, err := br.ParseCommand(p.Data())
+			_, _, _, _, err := br.ParseCommand(msg.data)
 			if err != nil {
 				log.Printf(logprefix+"check data in command mode error: %s\n", err)
 				return false
 			}
 		}
 
+		// Drop duplicate message with the same idempotency key and send it
+		// answer of the first message if it was answered
+		if dup, answer, done := br.dedup.check(msg); dup {
+			log.Printf(logprefix+"drop duplicate queue %q message id %d from "+
+				"producer %s, idempotency key %q\n", msg.queue, p.ID(), c,
+				msg.header.IdempotencyKey())
+			if done {
+				br.commit(msg.queue, func() {
+					br.sendDedupAnswer(answersData{msg.from, msg.id}, answer)
+				})
+			}
+			return true
+		}
+
 		// Add messages from producers to queue
-		br.set(&message{c.Address(), p.ID(), p.Data()})
-		log.Printf(logprefix+"add queue message id %d, len %d, from producer %s, queue length: %d\n",
-			p.ID(), len(p.Data()), c, br.queue.Len())
+		q := br.queues.get(msg.queue)
+		if !br.enqueue(q, msg) {
+			log.Printf(logprefix+"delay queue %q message id %d, len %d, from producer %s, until %s\n",
+				q.name, p.ID(), len(msg.data), c, msg.notBefore.Format(time.RFC3339))
+			return true
+		}
+		log.Printf(logprefix+"add queue %q message id %d, len %d, from producer %s, queue length: %d\n",
+			q.name, p.ID(), len(msg.data), c, q.queue.len())
 
 		br.wakeup()
 		return true
@@ -233,101 +563,402 @@ func (p apiPacket) Data() []byte {
 func (br *Broker) SendToReader(c *teonet.Channel, p *teonet.Packet,
 	data []byte) error {
 
-	e := &teonet.Event{Event: teonet.EventData}
-	pac := &apiPacket{p, data}
-	br.readerI(c, pac, e)
+	br.reader(teomq.TeonetChannel(c), &apiPacket{p, data}, teomq.EventData)
 
 	return nil
 }
 
-// wakeup wakes up message processing when messages or(and) consumers added
+// wakeup wakes up message processing when messages or(and) consumers added,
+// or when consumers answered messages and may get next ones
 func (br *Broker) wakeup() {
+	br.L.Lock()
+	defer br.L.Unlock()
+	br.pending = true
 	br.Signal()
 }
 
-// process processing mesagages
+// process processing mesagages until broker closed
 func (br *Broker) process() {
-	br.L.Lock()
-	defer br.L.Unlock()
+	defer br.wg.Done()
+	for br.ctx.Err() == nil {
+		// Process one message from each queue which has messages and
+		// ready consumers, and sleep if there is nothing to process until
+		// wakeup func called
+		var processed bool
+		for _, q := range br.queues.list() {
+			if br.stopping.Load() {
+				break
+			}
+			if !br.leads(q.name) ||
+				!(q.queue.len() > 0 && q.consumers.len() > 0) {
+				continue
+			}
 
-	for {
-		// Check message queue and customers length and sleep if empty until
-		// unlock (until wakeup func called)
-		if !(br.queue.len() > 0 && br.consumers.len() > 0) {
+			switch br.commandMode() {
+			case true:
+				br.processCommand(q)
+				processed = true
+			case false:
+				if br.processMessage(q) {
+					processed = true
+				}
+			}
+		}
+		if processed {
+			continue
+		}
+
+		br.L.Lock()
+		for !br.pending {
 			br.Wait()
+		}
+		br.pending = false
+		br.L.Unlock()
+	}
+}
+
+// processCommand sends message to all consumers subscribed to this command in
+// command mode.
+func (br *Broker) processCommand(q *namedQueue) {
+
+	// Get producers message (no delete)
+	msg, e, err := q.queue.get(false)
+	if err != nil {
+		return
+	}
+
+	// Unmarshal command
+	cmd, _, _, _, err := br.ParseCommand(msg.data)
+	if err != nil {
+		log.Printf(logprefix+"command unmarshal error: %s\n", err)
+		q.queue.del(e)
+		br.deadLetter(msg, DeadRejected)
+		return
+	}
+
+	// Check message expired
+	if msg.expired(time.Now()) {
+		q.queue.del(e)
+		br.expire(msg)
+		return
+	}
+	log.Printf(logprefix+"process queue %q message command %s, id %d, len %d, from %s\n",
+		q.name, cmd.Cmd, msg.id, len(msg.data), msg.from)
+
+	// Send message to all consumers of this queue which was subscribed to
+	// this command
+	var sent int
+	for _, ch := range br.Subscribers.Channels(cmd.Cmd) {
+
+		if !q.consumers.exists(ch) {
 			continue
 		}
 
-		switch br.commandMode() {
+		// Send message to consumer and save it to answers map
+		id, err := ch.Send(msg.data)
+		if err != nil {
+			log.Printf(logprefix+"can't send message to consumer, error: %s\n", err)
+			continue
+		}
+		br.answers.add(answersData{msg.from, msg.id},
+			answersData{ch.Address(), id}, msg.queue, br.answerTimeout)
+		log.Printf(logprefix+"send id %d, len %d to consumer %s\n",
+			msg.id, len(msg.data), ch)
 
-		// Send message to all consumers subscribed to this command in command 
-		// mode
-		case true:
-			// Get producers message (no delete)
-			msg, e, err := br.queue.get(false)
-			if err != nil {
-				continue
-			}
+		sent++
+	}
 
-			// Unmarshal command
-			cmd, _, _, _, err := br.ParseCommand(msg.data)
-			if err != nil {
-				log.Printf(logprefix+"command unmarshal error: %s\n", err)
-				continue
-			}
-			log.Printf(logprefix+"process queue message command %s, id %d, len %d, from %s\n",
-				cmd.Cmd, msg.id, len(msg.data), msg.from)
+	// Tell producer number of consumers which got the command
+	br.fanOut(msg, sent)
 
-			// Send message to all consumers which was subscribed to this command
-			var sent bool
-			for _, ch := range br.consumers.list(cmd.Cmd) {
+	// Move message to dead-letter queue if there is no subscribed consumers
+	q.queue.del(e)
+	if sent == 0 {
+		br.deadLetter(msg, DeadUnroutable)
+	}
+}
 
-				if !br.Subscribers.CheckCommand(ch, cmd.Cmd) {
-					continue
-				}
+// fanOut sends fan-out control message with number of consumers which got
+// command to the command producer if the producer waits it.
+func (br *Broker) fanOut(msg *message, n int) {
+	if msg.from == "" || !msg.fanOut {
+		return
+	}
+	data, _ := teomq.Control{Cmd: teomq.CtrlFanOut, IDs: []int{msg.id},
+		Count: n}.MarshalBinary()
+	if err := br.sendTo(msg.from, data); err != nil {
+		log.Printf(logprefix+"send fan-out to %s error: %s\n", msg.from, err)
+	}
+}
 
-				// Send message to consumer and save it to answers map
-				id, err := ch.Send(msg.data)
-				if err != nil {
-					log.Printf(logprefix+"can't send message to consumer, error: %s\n", err)
-					continue
-				}
-				br.answers.add(answersData{msg.from, msg.id}, answersData{ch.Address(), id})
-				log.Printf(logprefix+"send id %d, len %d to consumer %s\n",
-					msg.id, len(msg.data), ch)
+// processMessage sends message to one consumer in basic mode. The consumer is
+// chosen by broker selection strategy, consumers which have prefetch number
+// of not answered messages are skipped. Messages with routing key are sent
+// to the consumer of the key when previous message with this key answered.
+// It returns false if there is no ready consumers or messages in queue.
+func (br *Broker) processMessage(q *namedQueue) bool {
+
+	// Get first producers message which may be sent and its consumer channel
+	var ch teomq.Channel
+	var busy bool
+	msg, err := q.queue.take(func(m *message) bool {
+		var err error
+		switch {
+		case m.routingKey != "":
+			ch, err = br.stickyConsumer(q, m.routingKey)
+		case busy:
+			return false
+		default:
+			ch, err = q.consumers.get(br.selector, br.consumerInfo)
+			busy = err != nil
+		}
+		return err == nil
+	})
+	if err != nil {
+		return false
+	}
+	if msg.expired(time.Now()) {
+		br.expire(msg)
+		return true
+	}
+	msg.deliveries++
 
-				sent = true
-			}
-			if sent {
-				br.queue.del(e)
-			}
+	log.Printf(logprefix+"process queue %q message id %d, len %d, from %s, "+
+		"deliveries %d\n", q.name, msg.id, len(msg.data), ch, msg.deliveries)
 
-		// Send message to one consumer in basic mode
-		case false:
-			// Get consumers channel
-			ch, err := br.consumers.get()
-			if err != nil {
-				continue
-			}
+	// Send message to consumer and save it to answers map
+	hello, _ := q.consumers.hello(ch)
+	id, err := br.send(ch, hello, msg)
+	if err != nil {
+		log.Printf(logprefix+"can't send message to consumer, error: %s\n", err)
+		q.queue.requeue(msg)
+		return true
+	}
+	// Hold message in-flight until consumer acknowledges it, legacy consumers
+	// don't acknowledge messages and their answers are waited during answer
+	// timeout
+	if !hello.Acks() {
+		br.answers.add(answersData{msg.from, msg.id},
+			answersData{ch.Address(), id}, msg.queue, br.answerTimeout)
+		log.Printf(logprefix+"send id %d, len %d to consumer %s\n",
+			msg.id, len(msg.data), ch)
+		q.queue.done(msg)
+		return true
+	}
+	br.answers.add(answersData{msg.from, msg.id},
+		answersData{ch.Address(), id}, msg.queue, 0)
+	log.Printf(logprefix+"send id %d, len %d to consumer %s\n",
+		msg.id, len(msg.data), ch)
+	br.inflight.add(answersData{ch.Address(), id}, ch, msg,
+		br.visibilityTimeout)
+	return true
+}
 
-			// Get producers message
-			msg, _, err := br.queue.get()
-			if err != nil {
-				continue
-			}
+// stickyConsumer returns consumer channel of routing key if the consumer is
+// ready and there is no in-flight messages with the same routing key. Only
+// messages sent to consumers which acknowledge messages are held in-flight,
+// so messages with routing key are sent to these consumers only.
+func (br *Broker) stickyConsumer(q *namedQueue, key string) (
+	teomq.Channel, error) {
 
-			log.Printf(logprefix+"process queue message id %d, len %d, from %s\n",
-				msg.id, len(msg.data), ch)
+	if br.inflight.hasKey(q.name, key) {
+		return nil, ErrConsumersBusy
+	}
+	return q.consumers.sticky(key, br.consumerInfo)
+}
 
-			// Send message to consumer and save it to answers map
-			id, err := ch.Send(msg.data)
-			if err != nil {
-				log.Printf(logprefix+"can't send message to consumer, error: %s\n", err)
-				continue
+// send sends message to consumer. Message is sent in envelope to consumers
+// which support it.
+func (br *Broker) send(ch teomq.Channel, hello teomq.Hello, msg *message) (
+	id int, err error) {
+
+	if !hello.Acks() {
+		return ch.Send(msg.data)
+	}
+	data, err := teomq.Message{
+		Deliveries: msg.deliveries,
+		Queue:      msg.queue,
+		Header:     msg.header,
+		Data:       msg.data,
+	}.MarshalBinary()
+	if err != nil {
+		return
+	}
+	return ch.Send(data)
+}
+
+// ack processes acknowledge command from consumer.
+func (br *Broker) ack(c teomq.Channel, cmd string, id int) {
+	key := answersData{c.Address(), id}
+	queue := br.answers.queueOf(key)
+	p, err := br.answers.get(key)
+	if err == nil {
+		br.wakeup()
+	}
+	d, ok := br.inflight.del(key)
+
+	// Message which is not held in-flight, e.g. command sent in command
+	// mode, is not redelivered, so its producer is told that the consumer
+	// will not answer it
+	if !ok {
+		if err != nil {
+			return
+		}
+		switch cmd {
+		case teomq.CmdAck:
+			br.acked(queue, *p)
+		case teomq.CmdNack, teomq.CmdReject:
+			log.Printf(logprefix+"%s id %d from consumer %s, no answer\n",
+				cmd, id, c)
+			br.notifyProducers(teomq.CtrlNoAnswer, []answersData{*p})
+		}
+		return
+	}
+
+	switch cmd {
+	case teomq.CmdAck:
+		log.Printf(logprefix+"ack id %d from consumer %s\n", id, c)
+		br.queues.get(d.msg.queue).done(d.msg)
+		if err == nil {
+			br.acked(queue, *p)
+		}
+	case teomq.CmdNack:
+		log.Printf(logprefix+"nack id %d from consumer %s\n", id, c)
+		br.requeue(d.msg)
+	case teomq.CmdReject:
+		log.Printf(logprefix+"reject id %d from consumer %s\n", id, c)
+		br.deadLetter(d.msg, DeadRejected)
+	}
+}
+
+// acked tells producer that its message of queue was acknowledged without
+// answer. Cluster leader tells it when acknowledged message is removed from
+// replicas of cluster brokers.
+func (br *Broker) acked(queue string, producer answersData) {
+	br.dedupAnswer(queue, producer, nil)
+	br.commit(queue, func() {
+		br.notifyProducers(teomq.CtrlAcked, []answersData{producer})
+	})
+}
+
+// enqueue adds new message to named queue. Cluster leader adds message to
+// queue when its record is replicated to majority of cluster brokers, so
+// message which is sent to consumer is not lost on failover. It returns
+// false if message was delayed.
+func (br *Broker) enqueue(q *namedQueue, msg *message) bool {
+	if br.cluster == nil {
+		return q.set(msg)
+	}
+	q.hold(msg)
+	br.commit(q.name, func() {
+		q.push(msg)
+		br.wakeup()
+	})
+	return !msg.delayed(time.Now())
+}
+
+// requeue returns message to the front of queue to redeliver it, or moves it
+// to dead-letter queue if it reaches maximum number of deliveries or expired.
+func (br *Broker) requeue(msg *message) {
+	if msg.expired(time.Now()) {
+		br.expire(msg)
+		return
+	}
+	if msg.deliveries >= br.maxDeliveries {
+		br.deadLetter(msg, DeadMaxDeliveries)
+		return
+	}
+	br.queues.get(msg.queue).requeue(msg)
+	br.wakeup()
+}
+
+// requeueChannel returns all in-flight messages of disconnected consumer to
+// the queue.
+func (br *Broker) requeueChannel(ch teomq.Channel) {
+	for k, d := range br.inflight.delChannel(ch) {
+		br.answers.get(k)
+		log.Printf(logprefix+"requeue id %d from disconnected consumer %s\n",
+			d.msg.id, ch)
+		br.requeue(d.msg)
+	}
+}
+
+// purgeAnswers removes answers of disconnected consumer which are not held
+// in-flight and notifies their producers that messages will not be answered.
+func (br *Broker) purgeAnswers(ch teomq.Channel) {
+	l := br.answers.delConsumer(ch.Address())
+	if len(l) == 0 {
+		return
+	}
+	log.Printf(logprefix+"remove %d answers of disconnected consumer %s\n",
+		len(l), ch)
+	producers := slices.Collect(maps.Values(l))
+	br.notifyProducers(teomq.CtrlNoAnswer, producers)
+	br.dedupForget(producers...)
+}
+
+// expire drops expired message or moves it to dead-letter queue.
+func (br *Broker) expire(msg *message) {
+	if !br.dropExpired {
+		br.deadLetter(msg, DeadExpired)
+		return
+	}
+	br.queues.get(msg.queue).done(msg)
+	producer := answersData{msg.from, msg.id}
+	br.notifyProducers(teomq.CtrlNoAnswer, []answersData{producer})
+	br.dedupForget(producer)
+	log.Printf(logprefix+"drop expired message id %d from %s\n",
+		msg.id, msg.from)
+}
+
+// housekeeping periodically returns to the queue messages which were not
+// acknowledged by consumers during visibility timeout, removes answers which
+// were not received during answer timeout, idempotency keys with expired
+// dedup window and expired messages from queues.
+func (br *Broker) housekeeping() {
+	defer br.wg.Done()
+	tick := time.NewTicker(max(min(time.Second, br.visibilityTimeout/2,
+		br.answerTimeout/2), time.Millisecond))
+	defer tick.Stop()
+	for {
+		select {
+		case <-br.ctx.Done():
+			return
+		case <-tick.C:
+		}
+		now := time.Now()
+
+		// Redeliver not acknowledged messages
+		expired := br.inflight.expired(now)
+		for k, d := range expired {
+			br.answers.get(k)
+			log.Printf(logprefix+"visibility timeout of id %d, consumer %s, "+
+				"redeliver\n", d.msg.id, d.ch)
+			br.requeue(d.msg)
+		}
+		if len(expired) > 0 {
+			br.wakeup()
+		}
+
+		// Remove not received answers and notify producers
+		if l := br.answers.expired(now); len(l) > 0 {
+			log.Printf(logprefix+"answer timeout of %d messages\n", len(l))
+			producers := slices.Collect(maps.Values(l))
+			br.notifyProducers(teomq.CtrlNoAnswer, producers)
+			br.dedupForget(producers...)
+			br.wakeup()
+		}
+
+		// Remove idempotency keys with expired dedup window
+		if n := br.dedup.expired(now); n > 0 {
+			log.Printf(logprefix+"dedup window expired of %d messages\n", n)
+		}
+
+		// Remove expired messages
+		for _, q := range br.queues.list() {
+			for _, msg := range q.queue.expired(now) {
+				br.expire(msg)
 			}
-			br.answers.add(answersData{msg.from, msg.id}, answersData{ch.Address(), id})
-			log.Printf(logprefix+"send id %d, len %d to consumer %s\n",
-				msg.id, len(msg.data), ch)
 		}
 	}
 }
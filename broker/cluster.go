@@ -0,0 +1,1192 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Cluster module provides broker cluster mode with
+// leader per queue: each queue is served by its cluster leader which
+// replicates queue storage records to other cluster brokers and waits their
+// acknowledgements before accepting and answering messages. Other brokers
+// forward producers messages to the queue leader and redirect consumers to
+// it.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// Cluster is broker attribute with addresses of cluster brokers, all cluster
+// brokers should have the same list. Cluster brokers connect to each other
+// and elect leader of each queue. Queue leader serves the queue: it saves
+// queue records to its storage, replicates them to other brokers and waits
+// until majority of cluster brokers including leader saved record before it
+// adds producer message to queue or answers producer. Other brokers keep
+// replica of queue storage, forward producers messages of the queue to its
+// leader and send consumers of the queue leader control message, so the
+// consumer connects to the leader.
+//
+// Queue leader is elected by fixed priority order of the queue: the list
+// rotated by hash of the queue name, so queues leaders are spread over
+// cluster brokers. The first broker of the order which is connected becomes
+// leader with new election term. Leader and election need connected
+// majority of cluster brokers, so cluster partition without majority has no
+// leaders. Broker which gets message with higher term of the queue follows
+// its sender, broker with stale term gets announcement of current leader and
+// steps down. New leader merges queue records of majority of brokers before
+// it serves the queue, so message accepted by former leader is not lost.
+// Messages may be redelivered after failover.
+type Cluster []string
+
+// ElectionTimeout sets time during which started cluster broker waits
+// announcements of current queues leaders before it elects leaders. The
+// default value is 3 seconds.
+type ElectionTimeout time.Duration
+
+const defaultElectionTimeout = 3 * time.Second
+
+// Cluster messages operations
+const (
+	clusterOpLeader   byte = iota + 1 // queue leader announcement or query
+	clusterOpSync                     // queue storage snapshot starts
+	clusterOpSet                      // storage record added or replaced
+	clusterOpDel                      // storage record removed
+	clusterOpAck                      // replicated records saved by follower
+	clusterOpCatchUp                  // follower record sent to new leader
+	clusterOpCaughtUp                 // follower records sent to new leader
+	clusterOpProduce                  // producer message forwarded to leader
+	clusterOpRelay                    // message relayed to producer
+)
+
+// clusterMagic starts message sent between cluster brokers.
+var clusterMagic = []byte{0xFF, 'T', 'M', 'R'}
+
+var ErrWrongClusterMessage = errors.New("wrong cluster message")
+
+// clusterMessage is message sent between cluster brokers.
+//
+// Binary format: magic(4) | op | term | seq | queue length | queue |
+// key length | key | data length | data, where term, seq and lengths are
+// uvarints.
+type clusterMessage struct {
+	op    byte   // operation
+	term  uint64 // queue election term
+	seq   uint64 // replicated record number or producer message id
+	queue string // queue name
+	key   string // leader, storage record or producer address
+	data  []byte // storage record or message data
+}
+
+// cluster contains cluster brokers addresses and state of this broker in
+// cluster.
+type cluster struct {
+	addrs         []string                     // brokers addresses
+	self          string                       // this broker address
+	members       map[string]teomq.Channel     // connected cluster brokers
+	queues        map[string]*clusterQueue     // queues state by name
+	index         map[string]string            // queue names by storage keys
+	acks          map[string]map[string]uint64 // acknowledged records by members
+	commits       []clusterCommit              // functions waiting records acks
+	routes        map[string]string            // members by producers addresses
+	electAt       time.Time                    // election time of unled queues
+	timeout       time.Duration                // election timeout
+	storage       Storage                      // local storage of replica
+	*sync.RWMutex                              // protects cluster state
+	role          sync.Mutex                   // serializes role changes
+	repl          sync.Mutex                   // orders replicated records
+}
+
+// clusterQueue is cluster state of queue.
+type clusterQueue struct {
+	leader string          // leader address, empty if not known
+	term   uint64          // election term
+	ready  bool            // leader serves queue, follower got snapshot
+	synced map[string]bool // followers which sent their records to leader
+	seq    uint64          // last replicated record number
+}
+
+// clusterCommit is function which is called when queue records up to seq are
+// saved by majority of cluster brokers.
+type clusterCommit struct {
+	queue string
+	seq   uint64
+	f     func()
+}
+
+// replica is storage of cluster broker. Queue leader writes records to local
+// storage and replicates them to other brokers, followers write records
+// replicated by leader directly to local storage.
+type replica struct {
+	Storage
+	c *cluster
+}
+
+// newCluster creates a new cluster object.
+func newCluster(addrs []string) *cluster {
+	return &cluster{
+		addrs:   slices.Clone(addrs),
+		members: make(map[string]teomq.Channel),
+		queues:  make(map[string]*clusterQueue),
+		index:   make(map[string]string),
+		acks:    make(map[string]map[string]uint64),
+		routes:  make(map[string]string),
+		timeout: defaultElectionTimeout,
+		RWMutex: new(sync.RWMutex),
+	}
+}
+
+// wrap returns replica of storage, in-memory storage is used if storage is
+// nil. It returns storage if cluster mode is off.
+func (c *cluster) wrap(storage Storage) Storage {
+	if c == nil {
+		return storage
+	}
+	if storage == nil {
+		storage = newMemStorage()
+	}
+	c.storage = storage
+	storage.Range(func(key string, data []byte) bool {
+		c.setIndex(key, recordQueue(key, data))
+		return true
+	})
+	return &replica{storage, c}
+}
+
+// Set adds or replaces record in local storage and replicates it.
+func (r *replica) Set(key string, data []byte) error {
+	r.c.repl.Lock()
+	defer r.c.repl.Unlock()
+	if err := r.Storage.Set(key, data); err != nil {
+		return err
+	}
+	r.c.replicate(clusterMessage{op: clusterOpSet,
+		queue: recordQueue(key, data), key: key, data: data})
+	return nil
+}
+
+// Del removes record from local storage and replicates it.
+func (r *replica) Del(key string) error {
+	r.c.repl.Lock()
+	defer r.c.repl.Unlock()
+	if err := r.Storage.Del(key); err != nil {
+		return err
+	}
+	r.c.replicate(clusterMessage{op: clusterOpDel, key: key})
+	return nil
+}
+
+// recordQueue returns queue name of storage record.
+func recordQueue(key string, data []byte) (queue string) {
+	switch {
+	case strings.HasPrefix(key, storageQueuePrefix):
+		m := new(message)
+		if m.UnmarshalBinary(data) == nil {
+			queue = m.queue
+		}
+	case strings.HasPrefix(key, storageAnswersPrefix):
+		_, _, queue, _ = readAnswer(data)
+	case strings.HasPrefix(key, storageDeadPrefix):
+		dl := new(DeadLetter)
+		if dl.UnmarshalBinary(data) == nil {
+			queue = dl.Queue
+		}
+	case strings.HasPrefix(key, storageDedupPrefix):
+		e := new(dedupEntry)
+		if e.UnmarshalBinary(data) == nil {
+			queue = e.k.queue
+		}
+	case strings.HasPrefix(key, storageSchedPrefix):
+		sch := new(Schedule)
+		if sch.UnmarshalBinary(data) == nil {
+			queue = sch.Queue
+		}
+	}
+	return
+}
+
+// start sets this broker address, messages sequence and election time.
+func (c *cluster) start(self string, seq *sequence) {
+	c.Lock()
+	defer c.Unlock()
+	c.self = self
+	if !slices.Contains(c.addrs, self) {
+		c.addrs = append(c.addrs, self)
+	}
+	seq.step = uint64(len(c.addrs))
+	seq.offset = uint64(slices.Index(c.addrs, self))
+	c.electAt = time.Now().Add(c.timeout)
+}
+
+// member returns true if address is address of other cluster broker.
+func (c *cluster) member(addr string) bool {
+	if c == nil {
+		return false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return addr != c.self && slices.Contains(c.addrs, addr)
+}
+
+// add adds connected cluster broker channel.
+func (c *cluster) add(ch teomq.Channel) {
+	c.Lock()
+	defer c.Unlock()
+	c.members[ch.Address()] = ch
+}
+
+// del removes disconnected cluster broker channel. Queues led by the broker
+// become unled and election starts now. It returns true if this broker leads
+// queues and lost connected majority.
+func (c *cluster) del(ch teomq.Channel) (lost bool) {
+	c.Lock()
+	defer c.Unlock()
+	addr := ch.Address()
+	if c.members[addr] != ch {
+		return
+	}
+	delete(c.members, addr)
+	delete(c.acks, addr)
+	for producer, via := range c.routes {
+		if via == addr {
+			delete(c.routes, producer)
+		}
+	}
+	var leading bool
+	for _, cq := range c.queues {
+		delete(cq.synced, addr)
+		switch cq.leader {
+		case addr:
+			cq.leader, cq.ready = "", false
+		case c.self:
+			leading = true
+		}
+	}
+	c.electAt = time.Now()
+	return leading && !c.quorum()
+}
+
+// channels returns connected cluster brokers channels.
+func (c *cluster) channels() (l []teomq.Channel) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, ch := range c.members {
+		l = append(l, ch)
+	}
+	return
+}
+
+// channel returns connected cluster broker channel by address.
+func (c *cluster) channel(addr string) (ch teomq.Channel, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	ch, ok = c.members[addr]
+	return
+}
+
+// queue returns cluster state of queue, it is added if it does not exist.
+// It should be called under lock.
+func (c *cluster) queue(name string) *clusterQueue {
+	cq, ok := c.queues[name]
+	if !ok {
+		cq = new(clusterQueue)
+		c.queues[name] = cq
+	}
+	return cq
+}
+
+// touch adds queue to cluster queues, so its leader is elected.
+func (c *cluster) touch(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.queue(name)
+}
+
+// state returns copy of cluster state of queue.
+func (c *cluster) state(name string) clusterQueue {
+	c.Lock()
+	defer c.Unlock()
+	return *c.queue(name)
+}
+
+// led returns names and terms of queues led by this broker.
+func (c *cluster) led() map[string]uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	l := make(map[string]uint64)
+	for name, cq := range c.queues {
+		if cq.leader == c.self {
+			l[name] = cq.term
+		}
+	}
+	return l
+}
+
+// leads returns true if this broker is leader of queue and serves it.
+func (c *cluster) leads(name string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	cq, ok := c.queues[name]
+	return ok && cq.leader == c.self && cq.ready
+}
+
+// majority returns number of cluster brokers which makes majority.
+func (c *cluster) majority() int {
+	return len(c.addrs)/2 + 1
+}
+
+// quorum returns true if majority of cluster brokers is connected. It should
+// be called under lock.
+func (c *cluster) quorum() bool {
+	return len(c.members)+1 >= c.majority()
+}
+
+// order returns cluster brokers addresses in priority order of queue: the
+// brokers list rotated by hash of queue name.
+func (c *cluster) order(name string) []string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	i := int(h.Sum32() % uint32(len(c.addrs)))
+	return append(slices.Clone(c.addrs[i:]), c.addrs[:i]...)
+}
+
+// rank returns broker priority in queue order, lower value is higher
+// priority.
+func (c *cluster) rank(name, addr string) int {
+	return slices.Index(c.order(name), addr)
+}
+
+// unled returns queues without leader and their election candidates: the
+// first brokers of queues orders which are this broker or connected cluster
+// brokers. It returns nothing if election time is not come or majority of
+// cluster brokers is not connected.
+func (c *cluster) unled(now time.Time) map[string]string {
+	c.RLock()
+	defer c.RUnlock()
+	if now.Before(c.electAt) || !c.quorum() {
+		return nil
+	}
+	l := make(map[string]string)
+	for name, cq := range c.queues {
+		if cq.leader != "" {
+			continue
+		}
+		for _, addr := range c.order(name) {
+			if _, ok := c.members[addr]; ok || addr == c.self {
+				l[name] = addr
+				break
+			}
+		}
+	}
+	return l
+}
+
+// unconnected returns addresses of cluster brokers which are before this
+// broker in the list and are not connected. Broker connects to these brokers
+// only, so each pair of brokers has one connection.
+func (c *cluster) unconnected() (l []string) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, addr := range c.addrs {
+		if addr == c.self {
+			break
+		}
+		if _, ok := c.members[addr]; !ok {
+			l = append(l, addr)
+		}
+	}
+	return
+}
+
+// setIndex sets queue name of storage record key. It should be called under
+// replication lock.
+func (c *cluster) setIndex(key, queue string) {
+	c.Lock()
+	defer c.Unlock()
+	c.index[key] = queue
+}
+
+// delIndex removes storage record key from index and returns its queue
+// name. It should be called under replication lock.
+func (c *cluster) delIndex(key string) (queue string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	queue, ok = c.index[key]
+	delete(c.index, key)
+	return
+}
+
+// queueOf returns queue name of storage record key.
+func (c *cluster) queueOf(key string) (queue string, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	queue, ok = c.index[key]
+	return
+}
+
+// replicate indexes record and sends it to connected cluster brokers if this
+// broker is leader of record queue and serves it. It should be called under
+// replication lock.
+func (c *cluster) replicate(m clusterMessage) {
+	if m.op == clusterOpDel {
+		m.queue, _ = c.delIndex(m.key)
+	} else {
+		c.setIndex(m.key, m.queue)
+	}
+
+	c.Lock()
+	cq, ok := c.queues[m.queue]
+	if !ok || cq.leader != c.self || !cq.ready {
+		c.Unlock()
+		return
+	}
+	cq.seq++
+	m.term, m.seq = cq.term, cq.seq
+	c.Unlock()
+
+	data, _ := m.MarshalBinary()
+	for _, ch := range c.channels() {
+		if _, err := ch.Send(data); err != nil {
+			log.Printf(logprefix+"replicate to %s error: %s\n", ch, err)
+		}
+	}
+}
+
+// replicated returns true if queue records up to seq are saved by majority
+// of cluster brokers. It should be called under lock.
+func (c *cluster) replicated(name string, seq uint64) bool {
+	n := 1
+	for _, acks := range c.acks {
+		if acks[name] >= seq {
+			n++
+		}
+	}
+	return n >= c.majority()
+}
+
+// commit returns true if queue records written by this broker are saved by
+// majority of cluster brokers, so function f may be called now. Otherwise
+// function f is called by ack when they are saved. Function f is dropped
+// if this broker does not serve the queue.
+func (c *cluster) commit(name string, f func()) bool {
+	c.Lock()
+	defer c.Unlock()
+	cq, ok := c.queues[name]
+	if !ok || cq.leader != c.self || !cq.ready {
+		return false
+	}
+	if c.replicated(name, cq.seq) {
+		return true
+	}
+	c.commits = append(c.commits, clusterCommit{name, cq.seq, f})
+	return false
+}
+
+// ack saves records acknowledgement of cluster broker and returns functions
+// which records are saved by majority of cluster brokers.
+func (c *cluster) ack(from string, m clusterMessage) (l []func()) {
+	c.Lock()
+	defer c.Unlock()
+	cq, ok := c.queues[m.queue]
+	if _, member := c.members[from]; !ok || !member || cq.leader != c.self ||
+		cq.term != m.term {
+		return
+	}
+	if c.acks[from] == nil {
+		c.acks[from] = make(map[string]uint64)
+	}
+	c.acks[from][m.queue] = max(c.acks[from][m.queue], m.seq)
+	c.commits = slices.DeleteFunc(c.commits, func(cm clusterCommit) bool {
+		if cm.queue != m.queue || !c.replicated(cm.queue, cm.seq) {
+			return false
+		}
+		l = append(l, cm.f)
+		return true
+	})
+	return
+}
+
+// drop removes functions waiting records acknowledgements of queue. It
+// should be called under lock.
+func (c *cluster) drop(name string) {
+	c.commits = slices.DeleteFunc(c.commits, func(cm clusterCommit) bool {
+		return cm.queue == name
+	})
+}
+
+// route saves cluster broker which forwarded producer message.
+func (c *cluster) route(producer, via string) {
+	c.Lock()
+	defer c.Unlock()
+	c.routes[producer] = via
+}
+
+// routeOf returns channel of cluster broker which forwarded producer
+// messages.
+func (c *cluster) routeOf(producer string) (ch teomq.Channel, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if via, ok := c.routes[producer]; ok {
+		ch, ok = c.members[via]
+		return ch, ok
+	}
+	return
+}
+
+// Leader returns address of cluster leader of queue. It returns empty string
+// if leader is not known yet, and broker address if cluster mode is off.
+func (br *Broker) Leader(queue string) string {
+	if br.cluster == nil {
+		return br.Address()
+	}
+	return br.cluster.state(queue).leader
+}
+
+// leads returns true if broker serves queue: cluster mode is off or broker
+// is cluster leader of the queue.
+func (br *Broker) leads(queue string) bool {
+	return br.cluster == nil || br.cluster.leads(queue)
+}
+
+// commit calls function f when queue records written before are saved by
+// majority of cluster brokers. It calls f now if cluster mode is off.
+func (br *Broker) commit(queue string, f func()) {
+	if br.cluster == nil || br.cluster.commit(queue, f) {
+		f()
+	}
+}
+
+// startCluster starts cluster brokers connection and leaders election.
+func (br *Broker) startCluster() {
+	if br.cluster == nil {
+		return
+	}
+	br.cluster.timeout = br.electionTimeout
+	br.cluster.start(br.transport.Address(), br.queues.seq)
+	br.cluster.touch(DefaultQueue)
+	br.wg.Add(1)
+	go br.clusterLoop()
+}
+
+// clusterLoop periodically connects to cluster brokers and elects leaders of
+// unled queues.
+func (br *Broker) clusterLoop() {
+	defer br.wg.Done()
+	tick := time.NewTicker(max(br.cluster.timeout/4, time.Millisecond))
+	defer tick.Stop()
+	for {
+		for _, addr := range br.cluster.unconnected() {
+			br.transport.ConnectTo(addr)
+		}
+		br.elect()
+
+		select {
+		case <-br.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// clusterReader processes events and messages of cluster brokers.
+func (br *Broker) clusterReader(c teomq.Channel, p PacketInterface,
+	e teomq.Event) bool {
+
+	switch e {
+
+	// Add cluster broker and send it queues led by this broker
+	case teomq.EventConnected:
+		log.Printf(logprefix+"cluster broker connected %s\n", c)
+		br.cluster.add(c)
+		for queue, term := range br.cluster.led() {
+			br.sendLeader(c, queue, term, br.cluster.self)
+		}
+
+	// Remove cluster broker and elect leaders of queues it led, resign
+	// leadership if majority of cluster brokers is lost
+	case teomq.EventDisconnected:
+		log.Printf(logprefix+"cluster broker disconnected %s\n", c)
+		if br.cluster.del(c) {
+			br.resign()
+		}
+		br.elect()
+
+	// Process cluster message
+	case teomq.EventData:
+		var m clusterMessage
+		if err := m.UnmarshalBinary(p.Data()); err != nil {
+			log.Printf(logprefix+"wrong cluster message from %s: %s\n", c,
+				err)
+			return true
+		}
+		br.processCluster(c, m)
+	}
+	return true
+}
+
+// processCluster processes message of cluster broker.
+func (br *Broker) processCluster(ch teomq.Channel, m clusterMessage) {
+	switch m.op {
+	case clusterOpLeader:
+		br.announced(ch, m)
+	case clusterOpSync, clusterOpSet, clusterOpDel:
+		br.apply(ch, m)
+	case clusterOpAck:
+		for _, f := range br.cluster.ack(ch.Address(), m) {
+			f()
+		}
+	case clusterOpCatchUp:
+		br.merge(m)
+	case clusterOpCaughtUp:
+		br.caughtUp(ch, m)
+	case clusterOpProduce:
+		br.cluster.route(m.key, ch.Address())
+		producer := relayed{br, m.key}
+		if !br.leads(m.queue) {
+			br.reject(producer, int(m.seq), m.queue)
+			return
+		}
+		br.reader(producer, clusterPacket{int(m.seq), m.data},
+			teomq.EventData)
+	case clusterOpRelay:
+		if _, err := br.transport.SendTo(m.key, m.data); err != nil {
+			log.Printf(logprefix+"relay to %s error: %s\n", m.key, err)
+		}
+	}
+}
+
+// elect makes this broker leader of unled queues which election candidate
+// is this broker, and asks other candidates to elect themselves.
+func (br *Broker) elect() {
+	c := br.cluster
+	c.role.Lock()
+	defer c.role.Unlock()
+
+	for queue, candidate := range c.unled(time.Now()) {
+		if candidate == c.self {
+			br.lead(queue)
+			continue
+		}
+		if ch, ok := c.channel(candidate); ok {
+			br.sendLeader(ch, queue, 0, "")
+		}
+	}
+}
+
+// lead makes this broker leader of queue with new term and announces it. The
+// leader serves the queue when majority of cluster brokers sent it their
+// records of the queue. It should be called under role lock.
+func (br *Broker) lead(queue string) {
+	c := br.cluster
+	c.Lock()
+	cq := c.queue(queue)
+	cq.leader, cq.ready, cq.synced = c.self, false, make(map[string]bool)
+	cq.term++
+	term := cq.term
+	for _, acks := range c.acks {
+		delete(acks, queue)
+	}
+	c.Unlock()
+
+	log.Printf(logprefix+"cluster leader of queue %q is %s, term %d\n",
+		queue, c.self, term)
+	for _, ch := range c.channels() {
+		br.sendLeader(ch, queue, term, c.self)
+	}
+	if c.majority() == 1 {
+		br.serve(queue)
+	}
+}
+
+// announced processes queue leader announcement of cluster broker. Broker
+// follows leader with higher term, and leader with the same term which has
+// higher priority if broker knows other leader. Broker which knows leader
+// with higher term or priority announces it to sender. Announcement without
+// leader is query of queue leader, broker which thinks the sender is leader
+// forgets it.
+func (br *Broker) announced(ch teomq.Channel, m clusterMessage) {
+	c := br.cluster
+	c.role.Lock()
+	defer c.role.Unlock()
+
+	cur := c.state(m.queue)
+	switch {
+	case m.key == "" && cur.leader == ch.Address():
+		c.Lock()
+		c.queue(m.queue).leader = ""
+		c.Unlock()
+	case m.key == "" || m.term < cur.term:
+		if cur.leader != "" {
+			br.sendLeader(ch, m.queue, cur.term, cur.leader)
+		}
+	case m.term > cur.term || cur.leader == "":
+		br.follow(m.queue, m.term, m.key)
+	case cur.leader == m.key:
+		if !cur.ready && m.key == ch.Address() {
+			br.catchUp(ch, m.queue, m.term)
+		}
+	case c.rank(m.queue, m.key) < c.rank(m.queue, cur.leader):
+		log.Printf(logprefix+"cluster leader %s of queue %q has higher "+
+			"priority\n", m.key, m.queue)
+		br.follow(m.queue, m.term, m.key)
+	default:
+		br.sendLeader(ch, m.queue, cur.term, cur.leader)
+	}
+}
+
+// follow makes cluster broker leader of queue with term and sends it records
+// of the queue. If this broker was leader of the queue, the queue is
+// released. Connected consumers of the queue are told about new leader. It
+// should be called under role lock.
+func (br *Broker) follow(queue string, term uint64, leader string) {
+	c := br.cluster
+	c.Lock()
+	cq := c.queue(queue)
+	leading := cq.leader == c.self
+	cq.leader, cq.term, cq.ready, cq.synced = leader, term, false, nil
+	if leader == c.self {
+		// Stale leadership of this broker, elect again with higher term
+		cq.leader = ""
+	}
+	c.drop(queue)
+	c.Unlock()
+
+	if leading {
+		br.release(queue)
+	}
+	if leader == c.self {
+		return
+	}
+	log.Printf(logprefix+"follow cluster leader %s of queue %q, term %d\n",
+		leader, queue, term)
+	for _, ch := range br.peers.list() {
+		if hello, ok := br.queues.consumer(ch); ok &&
+			slices.Contains(hello.QueuesOrDefault(), queue) {
+			br.sendLeaders(ch, queue)
+		}
+	}
+	if ch, ok := c.channel(leader); ok {
+		br.catchUp(ch, queue, term)
+	}
+}
+
+// resign releases queues led by this broker when it lost majority of
+// cluster brokers. Queues become unled and are elected when majority is
+// connected again.
+func (br *Broker) resign() {
+	c := br.cluster
+	c.role.Lock()
+	defer c.role.Unlock()
+
+	for queue := range c.led() {
+		c.Lock()
+		cq := c.queue(queue)
+		cq.leader, cq.ready, cq.synced = "", false, nil
+		c.drop(queue)
+		c.Unlock()
+		br.release(queue)
+		log.Printf(logprefix+"resign cluster leadership of queue %q, "+
+			"majority of cluster brokers lost\n", queue)
+	}
+}
+
+// serve restores queue from local storage, sends queue snapshot to followers
+// which sent their records and starts serving the queue. It should be called
+// under role lock.
+func (br *Broker) serve(queue string) {
+	c := br.cluster
+	c.Lock()
+	cq := c.queue(queue)
+	if cq.leader != c.self || cq.ready {
+		c.Unlock()
+		return
+	}
+	cq.ready = true
+	synced := make([]teomq.Channel, 0, len(cq.synced))
+	for addr := range cq.synced {
+		if ch, ok := c.members[addr]; ok {
+			synced = append(synced, ch)
+		}
+	}
+	c.Unlock()
+
+	if err := br.load(func(name string) bool { return name == queue }); err != nil {
+		log.Printf(logprefix+"restore queue %q replica error: %s\n", queue,
+			err)
+	}
+	for _, ch := range synced {
+		br.snapshot(ch, queue)
+	}
+	log.Printf(logprefix+"serve queue %q\n", queue)
+	br.wakeup()
+}
+
+// catchUp sends local records of queue to its new leader. The leader merges
+// records of majority of cluster brokers before it serves the queue.
+func (br *Broker) catchUp(ch teomq.Channel, queue string, term uint64) {
+	c := br.cluster
+	c.repl.Lock()
+	defer c.repl.Unlock()
+
+	n := 0
+	var err error
+	rerr := c.storage.Range(func(key string, data []byte) bool {
+		if q, ok := c.queueOf(key); !ok || q != queue {
+			return true
+		}
+		err = br.sendCluster(ch, clusterMessage{op: clusterOpCatchUp,
+			term: term, queue: queue, key: key, data: data})
+		n++
+		return err == nil
+	})
+	if err = errors.Join(err, rerr); err == nil {
+		err = br.sendCluster(ch, clusterMessage{op: clusterOpCaughtUp,
+			term: term, queue: queue})
+	}
+	if err != nil {
+		log.Printf(logprefix+"send queue %q records to %s error: %s\n",
+			queue, ch, err)
+		return
+	}
+	log.Printf(logprefix+"send %d queue %q records to %s\n", n, queue, ch)
+}
+
+// merge saves record of follower which this broker does not have, if this
+// broker is new leader of record queue and does not serve it yet.
+func (br *Broker) merge(m clusterMessage) {
+	c := br.cluster
+	c.repl.Lock()
+	defer c.repl.Unlock()
+
+	cur := c.state(m.queue)
+	if cur.leader != c.self || cur.term != m.term || cur.ready {
+		return
+	}
+	if _, ok := c.queueOf(m.key); ok {
+		return
+	}
+	if err := c.storage.Set(m.key, m.data); err != nil {
+		log.Printf(logprefix+"merge record error: %s\n", err)
+		return
+	}
+	c.setIndex(m.key, m.queue)
+}
+
+// caughtUp marks follower which sent its records of queue. Leader serves the
+// queue when majority of cluster brokers sent their records, follower which
+// sent records after that gets queue snapshot.
+func (br *Broker) caughtUp(ch teomq.Channel, m clusterMessage) {
+	c := br.cluster
+	c.role.Lock()
+	defer c.role.Unlock()
+
+	c.Lock()
+	cq := c.queue(m.queue)
+	if cq.leader != c.self || cq.term != m.term {
+		c.Unlock()
+		return
+	}
+	cq.synced[ch.Address()] = true
+	ready, synced := cq.ready, len(cq.synced)+1 >= c.majority()
+	c.Unlock()
+
+	switch {
+	case ready:
+		br.snapshot(ch, m.queue)
+	case synced:
+		br.serve(m.queue)
+	}
+}
+
+// snapshot sends local records of queue to follower. Follower replaces its
+// records of the queue with them. Snapshot records are not numbered, the
+// follower acknowledges records replicated after snapshot.
+func (br *Broker) snapshot(ch teomq.Channel, queue string) {
+	c := br.cluster
+	c.repl.Lock()
+	defer c.repl.Unlock()
+
+	m := clusterMessage{op: clusterOpSync, term: c.state(queue).term,
+		queue: queue}
+	n := 0
+	err := br.sendCluster(ch, m)
+	if err == nil {
+		m.op = clusterOpSet
+		rerr := c.storage.Range(func(key string, data []byte) bool {
+			if q, ok := c.queueOf(key); !ok || q != queue {
+				return true
+			}
+			m.key, m.data = key, data
+			err = br.sendCluster(ch, m)
+			n++
+			return err == nil
+		})
+		err = errors.Join(err, rerr)
+	}
+	if err != nil {
+		log.Printf(logprefix+"send queue %q snapshot to %s error: %s\n",
+			queue, ch, err)
+		return
+	}
+	log.Printf(logprefix+"send queue %q snapshot of %d records to %s\n",
+		queue, n, ch)
+}
+
+// apply applies record replicated by queue leader to local storage and
+// acknowledges it when broker got queue snapshot. Record of leader with
+// stale term gets announcement of current leader, record of leader with
+// higher term makes broker follow it.
+func (br *Broker) apply(ch teomq.Channel, m clusterMessage) {
+	c := br.cluster
+	from := ch.Address()
+	cur := c.state(m.queue)
+	switch {
+	case m.term < cur.term:
+		if cur.leader != "" {
+			br.sendLeader(ch, m.queue, cur.term, cur.leader)
+		}
+		return
+	case m.term > cur.term || cur.leader == "":
+		br.announced(ch, clusterMessage{op: clusterOpLeader, term: m.term,
+			queue: m.queue, key: from})
+	}
+
+	c.repl.Lock()
+	defer c.repl.Unlock()
+	c.Lock()
+	cq := c.queue(m.queue)
+	if cq.leader != from || cq.term != m.term {
+		c.Unlock()
+		return
+	}
+	if m.op == clusterOpSync {
+		cq.ready = true
+	}
+	ready := cq.ready
+	c.Unlock()
+
+	var err error
+	switch m.op {
+	case clusterOpSync:
+		var keys []string
+		err = c.storage.Range(func(key string, data []byte) bool {
+			if q, ok := c.queueOf(key); ok && q == m.queue {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		for _, key := range keys {
+			err = errors.Join(err, c.storage.Del(key))
+			c.delIndex(key)
+		}
+	case clusterOpSet:
+		err = c.storage.Set(m.key, m.data)
+		c.setIndex(m.key, m.queue)
+	case clusterOpDel:
+		err = c.storage.Del(m.key)
+		c.delIndex(m.key)
+	}
+	if err != nil {
+		log.Printf(logprefix+"apply replicated record error: %s\n", err)
+		return
+	}
+	if ready && m.seq > 0 {
+		br.sendCluster(ch, clusterMessage{op: clusterOpAck, term: m.term,
+			seq: m.seq, queue: m.queue})
+	}
+}
+
+// release removes queued, delayed and in-flight messages, answers, dead
+// letters and idempotency keys of queue from broker memory. Records remain
+// in storage.
+func (br *Broker) release(queue string) {
+	f := queueFilter(func(name string) bool { return name == queue })
+	br.queues.release(f)
+	br.inflight.release(f)
+	br.answers.release(f)
+	br.deadLetters.release(f)
+	br.dedup.release(f)
+}
+
+// forward sends producer message of queue to cluster leader of the queue.
+// If the leader is not known or not connected, the message is rejected.
+func (br *Broker) forward(ch teomq.Channel, id int, data []byte,
+	queue string) {
+
+	c := br.cluster
+	c.touch(queue)
+	if leader := c.state(queue).leader; leader != c.self {
+		if lch, ok := c.channel(leader); ok {
+			err := br.sendCluster(lch, clusterMessage{op: clusterOpProduce,
+				seq: uint64(id), queue: queue, key: ch.Address(), data: data})
+			if err == nil {
+				return
+			}
+			log.Printf(logprefix+"forward message id %d to %s error: %s\n",
+				id, lch, err)
+		}
+	}
+	br.reject(ch, id, queue)
+}
+
+// reject rejects producer message of queue which cluster leader is not
+// ready with redirect control message without leader. Producer gets
+// teomq.ErrNotLeader and may send the message again.
+func (br *Broker) reject(ch teomq.Channel, id int, queue string) {
+	log.Printf(logprefix+"reject message id %d from %s, cluster leader of "+
+		"queue %q is not ready\n", id, ch, queue)
+	data, _ := teomq.Control{Cmd: teomq.CtrlRedirect,
+		IDs: []int{id}}.MarshalBinary()
+	if _, err := ch.Send(data); err != nil {
+		log.Printf(logprefix+"send redirect to %s error: %s\n", ch, err)
+	}
+}
+
+// sendTo sends data to producer. Producer which messages were forwarded by
+// other cluster broker gets data through that broker.
+func (br *Broker) sendTo(addr string, data []byte) error {
+	_, err := br.transport.SendTo(addr, data)
+	if err == nil || br.cluster == nil {
+		return err
+	}
+	ch, ok := br.cluster.routeOf(addr)
+	if !ok {
+		return err
+	}
+	return br.sendCluster(ch, clusterMessage{op: clusterOpRelay, key: addr,
+		data: data})
+}
+
+// sendLeaders sends consumer leaders of queues led by other cluster
+// brokers, so consumer connects to them.
+func (br *Broker) sendLeaders(ch teomq.Channel, queues ...string) {
+	if br.cluster == nil {
+		return
+	}
+	for _, queue := range queues {
+		br.cluster.touch(queue)
+		leader := br.cluster.state(queue).leader
+		if leader == "" || leader == br.cluster.self {
+			continue
+		}
+		data, _ := teomq.Control{Cmd: teomq.CtrlLeader, Queue: queue,
+			Broker: leader}.MarshalBinary()
+		if _, err := ch.Send(data); err != nil {
+			log.Printf(logprefix+"send leader to %s error: %s\n", ch, err)
+		}
+	}
+}
+
+// sendLeader sends queue leader announcement to cluster broker.
+func (br *Broker) sendLeader(ch teomq.Channel, queue string, term uint64,
+	leader string) {
+
+	err := br.sendCluster(ch, clusterMessage{op: clusterOpLeader, term: term,
+		queue: queue, key: leader})
+	if err != nil {
+		log.Printf(logprefix+"send leader to %s error: %s\n", ch, err)
+	}
+}
+
+// sendCluster sends cluster message to cluster broker.
+func (br *Broker) sendCluster(ch teomq.Channel, m clusterMessage) (
+	err error) {
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return
+	}
+	_, err = ch.Send(data)
+	return
+}
+
+// relayed is channel of producer which messages are forwarded by other
+// cluster broker.
+type relayed struct {
+	br   *Broker
+	addr string
+}
+
+// Address returns producer address.
+func (r relayed) Address() string { return r.addr }
+
+// Send sends data to producer through cluster broker.
+func (r relayed) Send(data []byte) (id int, err error) {
+	return 0, r.br.sendTo(r.addr, data)
+}
+
+// ServerMode returns true, producer is connected to broker side.
+func (r relayed) ServerMode() bool { return true }
+
+// ClientMode returns false.
+func (r relayed) ClientMode() bool { return false }
+
+// Triptime returns zero round-trip time.
+func (r relayed) Triptime() time.Duration { return 0 }
+
+// String returns channel name.
+func (r relayed) String() string { return r.addr }
+
+// clusterPacket is producer message forwarded by cluster broker.
+type clusterPacket struct {
+	id   int
+	data []byte
+}
+
+// ID returns producer message id.
+func (p clusterPacket) ID() int { return p.id }
+
+// Data returns producer message data.
+func (p clusterPacket) Data() []byte { return p.data }
+
+// MarshalBinary marshals cluster message.
+func (m clusterMessage) MarshalBinary() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	buf.Write(clusterMagic)
+	buf.WriteByte(m.op)
+	writeUvarint(buf, m.term)
+	writeUvarint(buf, m.seq)
+	writeBytes(buf, []byte(m.queue))
+	writeBytes(buf, []byte(m.key))
+	writeBytes(buf, m.data)
+	data = buf.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshals cluster message.
+func (m *clusterMessage) UnmarshalBinary(data []byte) (err error) {
+	if !bytes.HasPrefix(data, clusterMagic) {
+		return ErrWrongClusterMessage
+	}
+	buf := bytes.NewBuffer(data[len(clusterMagic):])
+	if m.op, err = buf.ReadByte(); err != nil {
+		return
+	}
+	if m.term, err = binary.ReadUvarint(buf); err != nil {
+		return
+	}
+	if m.seq, err = binary.ReadUvarint(buf); err != nil {
+		return
+	}
+	queue, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	key, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	if m.data, err = readBytes(buf); err != nil {
+		return
+	}
+	m.queue, m.key = string(queue), string(key)
+	return
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// clusterMember is cluster broker which is driven by test.
+type clusterMember struct {
+	t        *teomq.LoopbackTransport
+	messages chan clusterMessage
+}
+
+// newClusterMember creates cluster broker driven by test and connects it to
+// broker.
+func newClusterMember(net *teomq.Loopback, addr, broker string) (
+	m *clusterMember, err error) {
+
+	m = &clusterMember{t: net.Transport(addr),
+		messages: make(chan clusterMessage, 1024)}
+	m.t.AddReader(func(c teomq.Channel, p teomq.Payload, e teomq.Event) bool {
+		var cm clusterMessage
+		if e == teomq.EventData && cm.UnmarshalBinary(p.Data()) == nil {
+			m.messages <- cm
+		}
+		return true
+	})
+	err = m.t.ConnectTo(broker)
+	return
+}
+
+// send sends cluster message to broker.
+func (m *clusterMember) send(broker string, cm clusterMessage) {
+	data, _ := cm.MarshalBinary()
+	m.t.SendTo(broker, data)
+}
+
+// next returns next cluster message of queue with operation.
+func (m *clusterMember) next(queue string, op byte) (cm clusterMessage,
+	ok bool) {
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case cm = <-m.messages:
+			if cm.queue == queue && cm.op == op {
+				return cm, true
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// newClusterLeader creates broker b1 of cluster with members b2 and b3
+// driven by test, and makes b1 leader which serves queue "audit".
+func newClusterLeader(t *testing.T) (br *Broker,
+	members map[string]*clusterMember, ok bool) {
+
+	net := teomq.NewLoopback()
+	br, err := New("b1", net.Transport("b1"), Cluster{"b1", "b2", "b3"},
+		ElectionTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	members = make(map[string]*clusterMember)
+	for _, addr := range []string{"b2", "b3"} {
+		if members[addr], err = newClusterMember(net, addr, "b1"); err != nil {
+			t.Error("can't connect cluster broker:", err)
+			return
+		}
+	}
+
+	// Broker b1 is the first in "audit" queue order, so it should announce
+	// itself leader and serve the queue when b2 sent its records
+	br.cluster.touch("audit")
+	m, found := members["b2"].next("audit", clusterOpLeader)
+	if !found || m.key != "b1" || m.term != 1 {
+		t.Errorf("wrong leader announcement %+v", m)
+		return
+	}
+	members["b2"].send("b1", clusterMessage{op: clusterOpCaughtUp, term: 1,
+		queue: "audit"})
+	if _, found = members["b2"].next("audit", clusterOpSync); !found {
+		t.Error("snapshot was not sent to follower")
+		return
+	}
+	if !br.leads("audit") {
+		t.Error("b1 does not serve queue")
+		return
+	}
+	return br, members, true
+}
+
+func TestClusterReplication(t *testing.T) {
+	br, members, ok := newClusterLeader(t)
+	if !ok {
+		return
+	}
+	defer br.Close()
+
+	// Message should be queued when follower acknowledged its record
+	br.enqueue(br.queues.get("audit"),
+		&message{from: "producer", id: 1, queue: "audit", data: []byte("a")})
+	m, found := members["b2"].next("audit", clusterOpSet)
+	if !found || m.term != 1 || m.seq == 0 {
+		t.Errorf("wrong replicated record %+v", m)
+		return
+	}
+	time.Sleep(20 * time.Millisecond)
+	if l := br.QueueLen("audit"); l != 0 {
+		t.Errorf("message queued before acknowledge, queue length %d", l)
+		return
+	}
+	members["b2"].send("b1", clusterMessage{op: clusterOpAck, term: m.term,
+		seq: m.seq, queue: "audit"})
+	for deadline := time.Now().Add(time.Second); br.QueueLen("audit") != 1; {
+		if time.Now().After(deadline) {
+			t.Error("message was not queued after acknowledge")
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClusterTerm(t *testing.T) {
+	br, members, ok := newClusterLeader(t)
+	if !ok {
+		return
+	}
+	defer br.Close()
+	br.enqueue(br.queues.get("audit"),
+		&message{from: "producer", id: 1, queue: "audit", data: []byte("a")})
+
+	// Leader should step down when it gets announcement with higher term
+	// and send its records to the new leader
+	members["b3"].send("b1", clusterMessage{op: clusterOpLeader, term: 5,
+		queue: "audit", key: "b3"})
+	m, found := members["b3"].next("audit", clusterOpCatchUp)
+	if !found || m.term != 5 {
+		t.Errorf("wrong catch-up record %+v", m)
+		return
+	}
+	if _, found = members["b3"].next("audit", clusterOpCaughtUp); !found {
+		t.Error("caught up message was not sent")
+		return
+	}
+	if br.leads("audit") || br.Leader("audit") != "b3" {
+		t.Errorf("b1 did not step down, leader %s", br.Leader("audit"))
+		return
+	}
+	if l := br.QueueLen("audit"); l != 0 {
+		t.Errorf("wrong released queue length %d, expected 0", l)
+		return
+	}
+
+	// Record of leader with stale term should be rejected with announcement
+	// of current leader
+	members["b2"].send("b1", clusterMessage{op: clusterOpSet, term: 1,
+		seq: 10, queue: "audit", key: "q/stale"})
+	m, found = members["b2"].next("audit", clusterOpLeader)
+	if !found || m.key != "b3" || m.term != 5 {
+		t.Errorf("wrong leader announcement %+v", m)
+		return
+	}
+	if _, ok := br.cluster.queueOf("q/stale"); ok {
+		t.Error("record of stale leader was applied")
+		return
+	}
+}
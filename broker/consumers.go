@@ -8,16 +8,21 @@
 package broker
 
 import (
+	"cmp"
 	"container/list"
 	"errors"
+	"hash/fnv"
+	"slices"
+	"strconv"
 	"sync"
 
-	"github.com/teonet-go/teonet"
+	"github.com/teonet-go/teomq"
 )
 
 var (
 	ErrConsumerNotFound      = errors.New("consumer not found")
 	ErrConsumerAlreadyExists = errors.New("consumer already exists")
+	ErrConsumersBusy         = errors.New("all consumers are busy")
 )
 
 // queue contain messages queue data and methods to process it.
@@ -26,19 +31,40 @@ type consumers struct {
 	indexMap                    // map of list elements by consumer channel
 	*sync.RWMutex               // mutext
 	element       *list.Element // current list element used in get function
+	ring          []ringNode    // consistent hashing ring used in sticky func
+	ringDirty     bool          // ring should be rebuilt
+	address       addressFunc   // returns consumer address
+}
+type indexMap map[teomq.Channel]*list.Element
+type addressFunc func(ch teomq.Channel) string
+
+// ringNode is consistent hashing ring node. Each consumer has ringReplicas
+// nodes in ring.
+type ringNode struct {
+	hash uint32        // node hash
+	e    *list.Element // consumers list element
+}
+
+// ringReplicas is number of consumer nodes in consistent hashing ring.
+const ringReplicas = 64
+
+// consumer is the consumers list data type.
+type consumer struct {
+	ch    teomq.Channel // Consumer channel
+	hello teomq.Hello   // Consumer hello options
 }
-type indexMap map[*teonet.Channel]*list.Element
 
 // newConsumers creates a new consumers object.
 func newConsumers() (c *consumers) {
 	c = new(consumers)
 	c.indexMap = make(indexMap)
 	c.RWMutex = new(sync.RWMutex)
+	c.address = func(ch teomq.Channel) string { return ch.Address() }
 	return
 }
 
 // add adds new consumer to the back of consumers list.
-func (c *consumers) add(ch *teonet.Channel) error {
+func (c *consumers) add(ch teomq.Channel, hello teomq.Hello) error {
 	c.Lock()
 	defer c.Unlock()
 
@@ -48,14 +74,15 @@ func (c *consumers) add(ch *teonet.Channel) error {
 	}
 
 	// Insert new consumer to consumers list and index
-	e := c.PushBack(ch)
+	e := c.PushBack(&consumer{ch, hello})
 	c.indexMap[ch] = e
+	c.ringDirty = true
 
 	return nil
 }
 
 // del delete consumer from the consumers list.
-func (c *consumers) del(ch *teonet.Channel) error {
+func (c *consumers) del(ch teomq.Channel) error {
 	c.Lock()
 	defer c.Unlock()
 
@@ -65,14 +92,22 @@ func (c *consumers) del(ch *teonet.Channel) error {
 		}
 		c.Remove(e)
 		delete(c.indexMap, ch)
+		c.ringDirty = true
 		return nil
 	}
 
 	return ErrConsumerNotFound
 }
 
-// get gets next consumer from consumers list.
-func (c *consumers) get() (*teonet.Channel, error) {
+// get gets next consumer from consumers list. Ready consumers are passed to
+// selector in round-robin order starting after previously selected consumer.
+// The info function returns consumer state and readiness, nil info function
+// means that all consumers are ready. Nil selector selects consumers in
+// round-robin order. It returns ErrConsumersBusy if there is no ready
+// consumers in list.
+func (c *consumers) get(s Selector,
+	info func(co *consumer) (ConsumerInfo, bool)) (teomq.Channel, error) {
+
 	c.Lock()
 	defer c.Unlock()
 
@@ -81,52 +116,142 @@ func (c *consumers) get() (*teonet.Channel, error) {
 		return nil, ErrConsumerNotFound
 	}
 
-	// Get current element from list
-	if c.element == nil {
-		c.element = c.Front()
-	} else if c.element = c.element.Next(); c.element == nil {
-		c.element = c.Front()
+	// Get ready elements from list starting after current element
+	var infos []ConsumerInfo
+	var elements []*list.Element
+	e := c.element
+	for range c.Len() {
+		if e == nil || e.Next() == nil {
+			e = c.Front()
+		} else {
+			e = e.Next()
+		}
+		co, ok := e.Value.(*consumer)
+		if !ok {
+			continue
+		}
+		ci, ready := ConsumerInfo{Channel: co.ch,
+			Capacity: co.hello.CapacityOrDefault()}, true
+		if info != nil {
+			ci, ready = info(co)
+		}
+		if !ready {
+			continue
+		}
+		infos = append(infos, ci)
+		elements = append(elements, e)
+	}
+
+	// Select consumer
+	if s == nil {
+		s = RoundRobin{}
+	}
+	i := s.Select(infos)
+	if i < 0 || i >= len(infos) {
+		return nil, ErrConsumersBusy
 	}
-	// TODO: perhaps this condition is not needed here, because we first check
-	// the length of the list and the element of the list must be found.
-	if c.element == nil {
+	c.element = elements[i]
+
+	return infos[i].Channel, nil
+}
+
+// sticky gets consumer of routing key from consistent hashing ring. So the
+// messages with the same key go to the same consumer while it is connected,
+// and only keys of joined or left consumer move to other consumers. Only
+// consumers which acknowledge messages are in the ring, so it returns
+// ErrConsumerNotFound if there are legacy consumers only. It returns
+// ErrConsumersBusy if the consumer of the key is not ready.
+func (c *consumers) sticky(key string,
+	info func(co *consumer) (ConsumerInfo, bool)) (teomq.Channel, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Check length of consumers ring
+	if c.ringDirty {
+		c.buildRing()
+	}
+	if len(c.ring) == 0 {
 		return nil, ErrConsumerNotFound
 	}
 
-	// Get list value
-	if ch, ok := c.element.Value.(*teonet.Channel); ok {
-		return ch, nil
+	// Find first ring node after the key hash
+	h := ringHash(key)
+	i, _ := slices.BinarySearchFunc(c.ring, h, func(n ringNode, h uint32) int {
+		return cmp.Compare(n.hash, h)
+	})
+	if i == len(c.ring) {
+		i = 0
 	}
 
-	return nil, ErrConsumerNotFound
-}
+	// Check consumer is ready
+	co, ok := c.ring[i].e.Value.(*consumer)
+	if !ok {
+		return nil, ErrConsumerNotFound
+	}
+	if info != nil {
+		if _, ready := info(co); !ready {
+			return nil, ErrConsumersBusy
+		}
+	}
 
-// list returns consumers list.
-// TODO: Get list of channels which was subscribed to this command
-func (c *consumers) list(cmd string) (l []*teonet.Channel) {
-	c.RLock()
-	defer c.RUnlock()
+	return co.ch, nil
+}
 
+// buildRing builds consistent hashing ring of consumers which acknowledge
+// messages. Consumer nodes hashes depend on consumer address, so reconnected
+// consumer gets the same keys. It should be called under lock.
+func (c *consumers) buildRing() {
+	c.ring = c.ring[:0]
 	for e := c.Front(); e != nil; e = e.Next() {
-		ch, ok := e.Value.(*teonet.Channel)
-		if !ok {
+		co, ok := e.Value.(*consumer)
+		if !ok || !co.hello.Acks() {
 			continue
 		}
-		l = append(l, ch)
+		addr := c.address(co.ch)
+		for i := range ringReplicas {
+			c.ring = append(c.ring,
+				ringNode{ringHash(addr + "/" + strconv.Itoa(i)), e})
+		}
 	}
+	slices.SortFunc(c.ring, func(a, b ringNode) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	c.ringDirty = false
+}
 
-	return
+// ringHash returns consistent hashing ring hash of string.
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
 }
 
 // exists returns true if consumer exists in list or false if not.
-func (c *consumers) exists(ch *teonet.Channel) bool {
+func (c *consumers) exists(ch teomq.Channel) bool {
 	c.RLock()
 	defer c.RUnlock()
 	return c.existsUnsafe(ch) != nil
 }
 
+// hello returns consumer hello options.
+func (c *consumers) hello(ch teomq.Channel) (hello teomq.Hello, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	e := c.existsUnsafe(ch)
+	if e == nil {
+		return
+	}
+	co, ok := e.Value.(*consumer)
+	if !ok {
+		return
+	}
+	return co.hello, true
+}
+
 // existsUnsafe returns list.Element if consumer exists in list or nil if not.
-func (c *consumers) existsUnsafe(ch *teonet.Channel) (e *list.Element) {
+func (c *consumers) existsUnsafe(ch teomq.Channel) (e *list.Element) {
 	e, exists := c.indexMap[ch]
 	if !exists {
 		return nil
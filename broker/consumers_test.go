@@ -1,8 +1,11 @@
 package broker
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teonet"
 )
 
@@ -14,13 +17,13 @@ func TestConsumers(t *testing.T) {
 	const numOfConsumers = 2
 
 	// Create consumers and add it to consumers list
-	c1 := new(teonet.Channel)
-	if err := consumers.add(c1); err != nil {
+	c1 := newChannel()
+	if err := consumers.add(c1, teomq.Hello{}); err != nil {
 		t.Errorf("can't add %p consumer, error: %s", c1, err)
 		return
 	}
-	c2 := new(teonet.Channel)
-	if err := consumers.add(c2); err != nil {
+	c2 := newChannel()
+	if err := consumers.add(c2, teomq.Hello{}); err != nil {
 		t.Errorf("can't add %p consumer, error: %s", c1, err)
 		return
 	}
@@ -34,12 +37,12 @@ func TestConsumers(t *testing.T) {
 
 	// Get consumers from list
 	for i := 0; i < numOfConsumers; i++ {
-		ch, err := consumers.get()
+		ch, err := consumers.get(nil, nil)
 		if err != nil {
 			t.Errorf("can't get %d consumer", i+1)
 			return
 		}
-		var initCh *teonet.Channel
+		var initCh teomq.Channel
 		switch i + 1 {
 		case 1:
 			initCh = c1
@@ -59,7 +62,7 @@ func TestConsumers(t *testing.T) {
 	}
 
 	// Get should return c2 channel
-	if ch, _ := consumers.get(); ch != c2 {
+	if ch, _ := consumers.get(nil, nil); ch != c2 {
 		t.Errorf("get return wrong channel %p", ch)
 		return
 	}
@@ -71,9 +74,168 @@ func TestConsumers(t *testing.T) {
 	}
 
 	// Get should return nil
-	if ch, err := consumers.get(); err == nil && ch != nil {
+	if ch, err := consumers.get(nil, nil); err == nil && ch != nil {
 		t.Errorf("get return wrong channel %p", ch)
 		return
 	}
 
 }
+
+func TestConsumersReady(t *testing.T) {
+
+	// Create consumers list with three consumers
+	consumers := newConsumers()
+	c1, c2, c3 := newChannel(), newChannel(), newChannel()
+	for _, c := range []teomq.Channel{c1, c2, c3} {
+		consumers.add(c, teomq.Hello{Version: 1, Prefetch: 1})
+	}
+
+	// Get should skip busy consumer
+	busy := map[teomq.Channel]bool{c2: true}
+	ready := func(co *consumer) (ConsumerInfo, bool) {
+		return ConsumerInfo{Channel: co.ch}, !busy[co.ch]
+	}
+	for _, c := range []teomq.Channel{c1, c3, c1} {
+		if ch, _ := consumers.get(nil, ready); ch != c {
+			t.Errorf("get return wrong channel %p, expected %p", ch, c)
+			return
+		}
+	}
+
+	// Get should return error if all consumers are busy
+	busy[c1], busy[c3] = true, true
+	if _, err := consumers.get(nil, ready); err != ErrConsumersBusy {
+		t.Errorf("wrong error %v, expected %v", err, ErrConsumersBusy)
+		return
+	}
+}
+
+func TestConsumersSelector(t *testing.T) {
+
+	// Create consumers list with three consumers and their states
+	consumers := newConsumers()
+	c1, c2, c3 := newChannel(), newChannel(), newChannel()
+	for _, c := range []teomq.Channel{c1, c2, c3} {
+		consumers.add(c, teomq.Hello{Version: 1})
+	}
+	infos := map[teomq.Channel]ConsumerInfo{
+		c1: {Capacity: 1, Outstanding: 2, Triptime: 30 * time.Millisecond},
+		c2: {Capacity: 8, Outstanding: 4, Triptime: 10 * time.Millisecond},
+		c3: {Capacity: 2, Outstanding: 1, Triptime: 20 * time.Millisecond},
+	}
+	info := func(co *consumer) (ConsumerInfo, bool) {
+		ci := infos[co.ch]
+		ci.Channel = co.ch
+		return ci, true
+	}
+
+	// Each strategy should select its consumer
+	tests := []struct {
+		s  Selector
+		ch teomq.Channel
+	}{
+		{LeastOutstanding{}, c3},
+		{WeightedCapacity{}, c2},
+		{LowestTriptime{}, c2},
+		{RoundRobin{}, c3},
+	}
+	for _, test := range tests {
+		if ch, _ := consumers.get(test.s, info); ch != test.ch {
+			t.Errorf("%T selected wrong channel %p, expected %p", test.s, ch,
+				test.ch)
+			return
+		}
+	}
+
+	// Equal consumers should be selected in round-robin order
+	for _, c := range []teomq.Channel{c1, c2, c3} {
+		ci := infos[c]
+		ci.Outstanding = 0
+		infos[c] = ci
+	}
+	for _, c := range []teomq.Channel{c1, c2, c3, c1} {
+		if ch, _ := consumers.get(LeastOutstanding{}, info); ch != c {
+			t.Errorf("get return wrong channel %p, expected %p", ch, c)
+			return
+		}
+	}
+}
+
+func TestConsumersSticky(t *testing.T) {
+
+	// Create consumers list with three consumers
+	consumers := newConsumers()
+	c1, c2, c3 := newChannel(), newChannel(), newChannel()
+	addrs := map[teomq.Channel]string{c1: "c-addr-1", c2: "c-addr-2",
+		c3: "c-addr-3"}
+	consumers.address = func(ch teomq.Channel) string { return addrs[ch] }
+	for _, c := range []teomq.Channel{c1, c2, c3} {
+		consumers.add(c, teomq.Hello{Version: 1})
+	}
+
+	// Get consumers of keys, each consumer should get some keys
+	keys := make(map[string]teomq.Channel)
+	used := make(map[teomq.Channel]int)
+	for i := range 100 {
+		key := fmt.Sprintf("player-%d", i)
+		ch, err := consumers.sticky(key, nil)
+		if err != nil {
+			t.Error("can't get consumer of key:", err)
+			return
+		}
+		keys[key] = ch
+		used[ch]++
+	}
+	if len(used) != 3 {
+		t.Errorf("wrong number of used consumers %d, expected 3", len(used))
+		return
+	}
+
+	// Only keys of removed consumer should move to other consumers
+	consumers.del(c2)
+	for key, c := range keys {
+		ch, _ := consumers.sticky(key, nil)
+		if c != c2 && ch != c {
+			t.Errorf("key %s moved from %p to %p", key, c, ch)
+			return
+		}
+		if ch == c2 {
+			t.Errorf("key %s got removed consumer", key)
+			return
+		}
+	}
+
+	// Legacy consumer should not get keys, keys should not be routed if
+	// there are legacy consumers only
+	legacy := newChannel()
+	addrs[legacy] = "c-addr-4"
+	consumers.add(legacy, teomq.Hello{})
+	for key := range keys {
+		if ch, _ := consumers.sticky(key, nil); ch == legacy {
+			t.Errorf("key %s got legacy consumer", key)
+			return
+		}
+	}
+	only := newConsumers()
+	only.address = consumers.address
+	only.add(legacy, teomq.Hello{})
+	if _, err := only.sticky("player-1", nil); err != ErrConsumerNotFound {
+		t.Errorf("wrong error %v, expected %v", err, ErrConsumerNotFound)
+		return
+	}
+
+	// Sticky should return error if the consumer of key is not ready
+	ch, _ := consumers.sticky("player-1", nil)
+	busy := func(co *consumer) (ConsumerInfo, bool) {
+		return ConsumerInfo{Channel: co.ch}, co.ch != ch
+	}
+	if _, err := consumers.sticky("player-1", busy); err != ErrConsumersBusy {
+		t.Errorf("wrong error %v, expected %v", err, ErrConsumersBusy)
+		return
+	}
+}
+
+// newChannel returns new transport channel.
+func newChannel() teomq.Channel {
+	return teomq.TeonetChannel(new(teonet.Channel))
+}
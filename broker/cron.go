@@ -0,0 +1,168 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Cron module provides cron-style schedule
+// specification parser.
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrWrongCronSpec = errors.New("wrong cron schedule specification")
+
+// cronSpec is parsed cron schedule specification. Fields contain bit sets of
+// allowed values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool          // day fields are '*'
+	every                         time.Duration // interval of @every spec
+}
+
+// cronField describes cron specification field values range.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [...]cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// cronDescriptors contains predefined schedules.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses cron schedule specification. The specification contains
+// five space separated fields: minute, hour, day of month, month and day of
+// week. Each field may be '*', number, range 'a-b', step '*/n' or 'a-b/n',
+// or comma separated list of them. Day of week 0 and 7 are Sunday.
+// Descriptors @yearly, @monthly, @weekly, @daily, @hourly and
+// '@every <duration>' are supported too.
+func parseCron(spec string) (s *cronSpec, err error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("%w: %q", ErrWrongCronSpec, spec)
+		}
+		return &cronSpec{every: every}, nil
+	}
+	if d, ok := cronDescriptors[spec]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%w: %q", ErrWrongCronSpec, spec)
+	}
+	var bits [len(cronFields)]uint64
+	for i, f := range fields {
+		if bits[i], err = parseCronField(f, cronFields[i]); err != nil {
+			return nil, fmt.Errorf("%w: %s field %q", ErrWrongCronSpec,
+				cronFields[i].name, f)
+		}
+	}
+
+	s = &cronSpec{minute: bits[0], hour: bits[1], dom: bits[2],
+		month: bits[3], dow: bits[4]}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return
+}
+
+// parseCronField parses one field of cron specification to bit set.
+func parseCronField(field string, f cronField) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rng, stepstr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepstr); err != nil || step <= 0 {
+				return 0, ErrWrongCronSpec
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			lostr, histr, isRange := strings.Cut(rng, "-")
+			if lo, err = strconv.Atoi(lostr); err != nil {
+				return
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(histr); err != nil {
+					return
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, ErrWrongCronSpec
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return
+}
+
+// next returns next schedule time after t. It returns zero time if there is
+// no such time during next five years.
+func (s *cronSpec) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatch(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0,
+				t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatch returns true if day of t matches day of month and day of week
+// fields. If both fields are restricted the day matches when any of them
+// matches, as in standard cron.
+func (s *cronSpec) dayMatch(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+
+	from := time.Date(2024, time.March, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.March, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.March, 15, 10, 15, 0, 0, time.UTC)},
+		{"5,10 9-11 * * *", time.Date(2024, time.March, 15, 10, 10, 0, 0, time.UTC)},
+		{"0 8 * * 1", time.Date(2024, time.March, 18, 8, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, time.March, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2024, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2024, time.March, 15, 10, 9, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		s, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("can't parse %q: %s", test.spec, err)
+			return
+		}
+		if next := s.next(from); !next.Equal(test.next) {
+			t.Errorf("wrong next time of %q: %s, expected %s", test.spec,
+				next, test.next)
+			return
+		}
+	}
+
+	// Wrong specifications
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *",
+		"5-1 * * * *", "0 0 0 * *", "@every", "@every -1s", "@often"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("wrong spec %q parsed without error", spec)
+			return
+		}
+	}
+}
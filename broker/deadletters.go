@@ -0,0 +1,395 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Dead letters module provides dead-letter queue types
+// and methods.
+
+package broker
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// DropExpired sets broker to drop expired messages instead of moving them to
+// dead-letter queue.
+type DropExpired bool
+
+// MaxDeliveries sets number of failed deliveries after which message moves
+// to dead-letter queue. The default value is 5.
+type MaxDeliveries int
+
+const defaultMaxDeliveries = 5
+
+// DeadReason is the reason why message moved to dead-letter queue.
+type DeadReason byte
+
+const (
+	DeadMaxDeliveries DeadReason = iota + 1 // Too many failed deliveries
+	DeadRejected                            // Rejected by consumer
+	DeadExpired                             // Message time-to-live expired
+	DeadUnroutable                          // No consumers to process message
+)
+
+// String returns dead reason name.
+func (r DeadReason) String() string {
+	switch r {
+	case DeadMaxDeliveries:
+		return "max deliveries"
+	case DeadRejected:
+		return "rejected"
+	case DeadExpired:
+		return "expired"
+	case DeadUnroutable:
+		return "unroutable"
+	}
+	return fmt.Sprintf("unknown(%d)", r)
+}
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is message moved to dead-letter queue.
+type DeadLetter struct {
+	ID         uint64       // Dead letter ID
+	From       string       // Producer address
+	MessageID  int          // Producer message ID
+	Data       []byte       // Message data
+	Queue      string       // Queue name
+	Deliveries int          // Number of delivery attempts
+	Reason     DeadReason   // Why message moved to dead-letter queue
+	Time       time.Time    // When message moved to dead-letter queue
+	Priority   int          // Message priority
+	Key        string       // Message routing key
+	Header     teomq.Header // Message header
+	fanOut     bool         // Producer waits fan-out control message
+}
+
+// deadLetters contain dead-letter queue data and methods to process it.
+type deadLetters struct {
+	list.List                              // list of dead letters
+	indexMap      map[uint64]*list.Element // map of list elements by ID
+	*sync.RWMutex                          // mutex
+	storage       Storage                  // persistent storage, may be nil
+}
+
+// newDeadLetters creates a new dead-letter queue object.
+func newDeadLetters(storage Storage) (d *deadLetters) {
+	d = new(deadLetters)
+	d.indexMap = make(map[uint64]*list.Element)
+	d.RWMutex = new(sync.RWMutex)
+	d.storage = storage
+	return
+}
+
+// load restores dead letters of queues selected by filter from persistent
+// storage.
+func (d *deadLetters) load(f queueFilter) (err error) {
+	if d.storage == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	return rangePrefix(d.storage, storageDeadPrefix,
+		func(key string, data []byte) (err error) {
+			dl := new(DeadLetter)
+			if err = dl.UnmarshalBinary(data); err != nil || !f.match(dl.Queue) {
+				return
+			}
+			d.indexMap[dl.ID] = d.PushBack(dl)
+			return
+		},
+	)
+}
+
+// add adds message to dead-letter queue.
+func (d *deadLetters) add(m *message, reason DeadReason) *DeadLetter {
+	d.Lock()
+	defer d.Unlock()
+
+	dl := &DeadLetter{
+		ID:         m.seq,
+		From:       m.from,
+		MessageID:  m.id,
+		Data:       m.data,
+		Queue:      m.queue,
+		Deliveries: m.deliveries,
+		Reason:     reason,
+		Time:       time.Now(),
+		Priority:   m.priority,
+		Key:        m.routingKey,
+		Header:     m.header,
+		fanOut:     m.fanOut,
+	}
+	d.indexMap[dl.ID] = d.PushBack(dl)
+
+	if d.storage != nil {
+		data, _ := dl.MarshalBinary()
+		if err := d.storage.Set(dl.key(), data); err != nil {
+			log.Printf(logprefix+"save dead letter error: %s\n", err)
+		}
+	}
+
+	return dl
+}
+
+// get returns dead letter by ID.
+func (d *deadLetters) get(id uint64) (*DeadLetter, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	e, ok := d.indexMap[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return e.Value.(*DeadLetter), nil
+}
+
+// del removes dead letter by ID and returns it.
+func (d *deadLetters) del(id uint64) (*DeadLetter, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.delUnsafe(id)
+}
+
+// delUnsafe removes dead letter by ID without lock.
+func (d *deadLetters) delUnsafe(id uint64) (*DeadLetter, error) {
+	e, ok := d.indexMap[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	dl := d.Remove(e).(*DeadLetter)
+	delete(d.indexMap, id)
+
+	if d.storage != nil {
+		if err := d.storage.Del(dl.key()); err != nil {
+			log.Printf(logprefix+"remove dead letter error: %s\n", err)
+		}
+	}
+	return dl, nil
+}
+
+// list returns copy of dead letters list.
+func (d *deadLetters) list() (l []DeadLetter) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for e := d.Front(); e != nil; e = e.Next() {
+		l = append(l, *e.Value.(*DeadLetter))
+	}
+	return
+}
+
+// purge removes all dead letters and returns number of removed.
+func (d *deadLetters) purge() (n int) {
+	d.Lock()
+	defer d.Unlock()
+
+	for id := range d.indexMap {
+		d.delUnsafe(id)
+		n++
+	}
+	return
+}
+
+// release removes dead letters of queues selected by filter from memory,
+// they remain in persistent storage.
+func (d *deadLetters) release(f queueFilter) {
+	d.Lock()
+	defer d.Unlock()
+	for id, e := range d.indexMap {
+		if f.match(e.Value.(*DeadLetter).Queue) {
+			d.Remove(e)
+			delete(d.indexMap, id)
+		}
+	}
+}
+
+// len returns dead-letter queue length.
+func (d *deadLetters) len() int {
+	d.RLock()
+	defer d.RUnlock()
+	return d.Len()
+}
+
+// key returns dead letter key in persistent storage.
+func (dl *DeadLetter) key() string {
+	return fmt.Sprintf("%s%016x", storageDeadPrefix, dl.ID)
+}
+
+// MarshalBinary marshals dead letter.
+func (dl DeadLetter) MarshalBinary() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	writeUvarint(buf, dl.ID)
+	writeBytes(buf, []byte(dl.From))
+	writeUvarint(buf, uint64(dl.MessageID))
+	writeBytes(buf, dl.Data)
+	writeUvarint(buf, uint64(dl.Deliveries))
+	buf.WriteByte(byte(dl.Reason))
+	writeUvarint(buf, uint64(dl.Time.UnixNano()))
+	writeBytes(buf, []byte(dl.Queue))
+	writeUvarint(buf, uint64(dl.Priority))
+	writeBytes(buf, []byte(dl.Key))
+	header, _ := dl.Header.MarshalBinary()
+	writeBytes(buf, header)
+	var flags byte
+	if dl.fanOut {
+		flags |= messageFlagFanOut
+	}
+	buf.WriteByte(flags)
+	data = buf.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshals dead letter.
+func (dl *DeadLetter) UnmarshalBinary(data []byte) (err error) {
+	buf := bytes.NewBuffer(data)
+	if dl.ID, err = binary.ReadUvarint(buf); err != nil {
+		return
+	}
+	from, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	id, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	if dl.Data, err = readBytes(buf); err != nil {
+		return
+	}
+	deliveries, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	reason, err := buf.ReadByte()
+	if err != nil {
+		return
+	}
+	t, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	queue, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	dl.Queue = string(queue)
+	dl.From = string(from)
+	dl.MessageID = int(id)
+	dl.Deliveries = int(deliveries)
+	dl.Reason = DeadReason(reason)
+	dl.Time = time.Unix(0, int64(t))
+	if buf.Len() == 0 {
+		return
+	}
+	priority, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	key, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	header, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	if err = dl.Header.UnmarshalBinary(header); err != nil {
+		return
+	}
+	if len(dl.Header) == 0 {
+		dl.Header = nil
+	}
+	dl.Priority = int(priority)
+	dl.Key = string(key)
+	if buf.Len() > 0 {
+		flags, err := buf.ReadByte()
+		if err != nil {
+			return err
+		}
+		dl.fanOut = flags&messageFlagFanOut != 0
+	}
+	return
+}
+
+// DeadLetters returns list of messages in dead-letter queue.
+func (br *Broker) DeadLetters() []DeadLetter {
+	return br.deadLetters.list()
+}
+
+// DeadLetter returns dead letter by ID.
+func (br *Broker) DeadLetter(id uint64) (dl DeadLetter, err error) {
+	d, err := br.deadLetters.get(id)
+	if err != nil {
+		return
+	}
+	return *d, nil
+}
+
+// RequeueDeadLetter moves dead letter back to the messages queue. The message
+// deliveries counter and time-to-live are reset, its answer is routed to the
+// message producer.
+func (br *Broker) RequeueDeadLetter(id uint64) error {
+	dl, err := br.deadLetters.del(id)
+	if err != nil {
+		return err
+	}
+	br.enqueue(br.queues.get(dl.Queue), &message{
+		from:       dl.From,
+		id:         dl.MessageID,
+		data:       dl.Data,
+		queue:      dl.Queue,
+		priority:   dl.Priority,
+		routingKey: dl.Key,
+		header:     dl.Header,
+		fanOut:     dl.fanOut,
+	})
+	log.Printf(logprefix+"requeue dead letter %d, message id %d from %s\n",
+		dl.ID, dl.MessageID, dl.From)
+	br.wakeup()
+	return nil
+}
+
+// DeleteDeadLetter removes dead letter by ID.
+func (br *Broker) DeleteDeadLetter(id uint64) error {
+	_, err := br.deadLetters.del(id)
+	return err
+}
+
+// PurgeDeadLetters removes all dead letters and returns number of removed.
+func (br *Broker) PurgeDeadLetters() int {
+	return br.deadLetters.purge()
+}
+
+// lastID returns the greatest dead letter ID.
+func (d *deadLetters) lastID() (id uint64) {
+	d.RLock()
+	defer d.RUnlock()
+	for k := range d.indexMap {
+		id = max(id, k)
+	}
+	return
+}
+
+// deadLetter moves message taken from queue to dead-letter queue and notifies
+// its producer that the message will not be answered.
+func (br *Broker) deadLetter(m *message, reason DeadReason) {
+	dl := br.deadLetters.add(m, reason)
+	br.queues.get(m.queue).done(m)
+	producer := answersData{m.from, m.id}
+	br.notifyProducers(teomq.CtrlNoAnswer, []answersData{producer})
+	br.dedupForget(producer)
+	log.Printf(logprefix+"dead letter %d, message id %d from %s, "+
+		"deliveries %d, reason: %s\n",
+		dl.ID, m.id, m.from, m.deliveries, reason)
+}
@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/teonet-go/teomq"
+)
+
+func TestDeadLetters(t *testing.T) {
+
+	st, err := NewFileStorage(t.TempDir(), SyncNever)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+
+	// Add messages to dead-letter queue
+	d := newDeadLetters(st)
+	d.add(&message{from: "p-addr-1", id: 1, data: []byte("m1"), seq: 1},
+		DeadRejected)
+	d.add(&message{from: "p-addr-2", id: 2, data: []byte("m2"), seq: 2,
+		deliveries: 5, fanOut: true}, DeadMaxDeliveries)
+
+	// Get dead letter
+	dl, err := d.get(2)
+	if err != nil {
+		t.Error("dead letter 2 not found:", err)
+		return
+	}
+	if dl.From != "p-addr-2" || dl.Deliveries != 5 ||
+		dl.Reason != DeadMaxDeliveries {
+		t.Error("wrong dead letter 2", dl)
+		return
+	}
+
+	// Delete dead letter and restore dead-letter queue from storage
+	if _, err = d.del(1); err != nil {
+		t.Error("can't delete dead letter 1:", err)
+		return
+	}
+	d = newDeadLetters(st)
+	if err = d.load(nil); err != nil {
+		t.Error("can't load dead letters:", err)
+		return
+	}
+	l := d.list()
+	if len(l) != 1 || l[0].ID != 2 || string(l[0].Data) != "m2" ||
+		!l[0].fanOut {
+		t.Error("wrong restored dead letters", l)
+		return
+	}
+
+	// Purge dead-letter queue
+	if n := d.purge(); n != 1 || d.len() != 0 {
+		t.Error("wrong purge result", n)
+		return
+	}
+}
+
+func TestRequeueDeadLetter(t *testing.T) {
+
+	br, err := New("broker", teomq.NewLoopback().Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+
+	// Requeued dead letter should keep producer answer route and fan-out
+	// flag
+	dl := br.deadLetters.add(&message{from: "p-addr-1", id: 1,
+		data: []byte("m1"), seq: 1, queue: DefaultQueue, fanOut: true},
+		DeadUnroutable)
+	if err = br.RequeueDeadLetter(dl.ID); err != nil {
+		t.Error("can't requeue dead letter:", err)
+		return
+	}
+	m, _, err := br.queues.get(DefaultQueue).queue.get()
+	if err != nil || m.from != "p-addr-1" || m.id != 1 || !m.fanOut {
+		t.Error("wrong requeued message", m, err)
+		return
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Dedup module provides table of producers messages
+// idempotency keys which is used to drop duplicate messages.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// DedupWindow sets time during which broker keeps idempotency key of
+// answered message. Messages with the same idempotency key in the same queue
+// are dropped while the message is processed and during dedup window after
+// it answered, their producers get answer of the first message. Zero value
+// disables deduplication. The default value is 10 minutes.
+type DedupWindow time.Duration
+
+const defaultDedupWindow = 10 * time.Minute
+
+// dedup contains idempotency keys of messages which are processed or were
+// answered during dedup window.
+type dedup struct {
+	m             map[dedupKey]*dedupEntry    // entries by queue and key
+	producers     map[answersData]*dedupEntry // processed entries by producer
+	*sync.RWMutex                             // mutex
+	storage       Storage                     // persistent storage, may be nil
+	window        time.Duration               // dedup window
+}
+
+// dedupKey is idempotency key of queue message.
+type dedupKey struct {
+	queue string // queue name
+	key   string // idempotency key
+}
+
+// dedupEntry is idempotency key of processed or answered message.
+type dedupEntry struct {
+	k        dedupKey      // queue and idempotency key
+	producer answersData   // producer message
+	done     bool          // message answered or acknowledged
+	answer   []byte        // marshalled answer packet, nil if no answer
+	expires  time.Time     // time when answered entry is removed
+	waiters  []answersData // duplicates waiting answer of processed message
+}
+
+// newDedup creates a new dedup table object.
+func newDedup(storage Storage, window time.Duration) (d *dedup) {
+	d = new(dedup)
+	d.m = make(map[dedupKey]*dedupEntry)
+	d.producers = make(map[answersData]*dedupEntry)
+	d.RWMutex = new(sync.RWMutex)
+	d.storage = storage
+	d.window = window
+	return
+}
+
+// load restores dedup entries of queues selected by filter from persistent
+// storage.
+func (d *dedup) load(f queueFilter) (err error) {
+	if d.storage == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	return rangePrefix(d.storage, storageDedupPrefix,
+		func(key string, data []byte) (err error) {
+			e := new(dedupEntry)
+			if err = e.UnmarshalBinary(data); err != nil || !f.match(e.k.queue) {
+				return
+			}
+			d.m[e.k] = e
+			if !e.done {
+				d.producers[e.producer] = e
+			}
+			return
+		},
+	)
+}
+
+// check checks idempotency key of message from producer. It adds the key
+// and returns false if there is no message with this key. Otherwise message
+// is duplicate and it returns true with marshalled answer and true done if
+// the first message is answered, or adds the duplicate to the waiters of
+// answer if the first message is processed yet.
+func (d *dedup) check(m *message) (dup bool, answer []byte, done bool) {
+	key := m.header.IdempotencyKey()
+	if d.window <= 0 || key == "" || m.from == "" {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	k := dedupKey{m.queue, key}
+	producer := answersData{m.from, m.id}
+	e, ok := d.m[k]
+	switch {
+	case !ok:
+		e = &dedupEntry{k: k, producer: producer}
+		d.m[k] = e
+		d.producers[producer] = e
+	case e.done:
+		return true, e.answer, true
+	default:
+		e.waiters = append(e.waiters, producer)
+		dup = true
+	}
+	d.save(e)
+	return
+}
+
+// complete marks message of producer answered and saves its answer during
+// dedup window. It returns duplicates waiting the answer.
+func (d *dedup) complete(producer answersData, answer []byte) (
+	waiters []answersData) {
+
+	d.Lock()
+	defer d.Unlock()
+
+	e, ok := d.producers[producer]
+	if !ok {
+		return
+	}
+	delete(d.producers, producer)
+	waiters = e.waiters
+	e.done, e.answer, e.waiters = true, answer, nil
+	e.expires = time.Now().Add(d.window)
+	d.save(e)
+	return
+}
+
+// forget removes idempotency key of message of producer which is not
+// answered, so the message may be sent again. It returns duplicates waiting
+// the answer.
+func (d *dedup) forget(producer answersData) (waiters []answersData) {
+	d.Lock()
+	defer d.Unlock()
+
+	e, ok := d.producers[producer]
+	if !ok {
+		return
+	}
+	delete(d.producers, producer)
+	d.remove(e)
+	return e.waiters
+}
+
+// expired removes answered entries with expired dedup window and returns
+// number of removed entries.
+func (d *dedup) expired(now time.Time) (n int) {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, e := range d.m {
+		if e.done && !now.Before(e.expires) {
+			d.remove(e)
+			n++
+		}
+	}
+	return
+}
+
+// release removes entries of queues selected by filter from memory, they
+// remain in persistent storage.
+func (d *dedup) release(f queueFilter) {
+	d.Lock()
+	defer d.Unlock()
+	for k, e := range d.m {
+		if f.match(k.queue) {
+			delete(d.m, k)
+			delete(d.producers, e.producer)
+		}
+	}
+}
+
+// len returns number of entries in dedup table.
+func (d *dedup) len() int {
+	d.RLock()
+	defer d.RUnlock()
+	return len(d.m)
+}
+
+// save saves entry to persistent storage. It should be called under lock.
+func (d *dedup) save(e *dedupEntry) {
+	if d.storage == nil {
+		return
+	}
+	data, _ := e.MarshalBinary()
+	if err := d.storage.Set(e.key(), data); err != nil {
+		log.Printf(logprefix+"save dedup entry error: %s\n", err)
+	}
+}
+
+// remove removes entry from dedup table and persistent storage. It should be
+// called under lock.
+func (d *dedup) remove(e *dedupEntry) {
+	delete(d.m, e.k)
+	if d.storage == nil {
+		return
+	}
+	if err := d.storage.Del(e.key()); err != nil {
+		log.Printf(logprefix+"remove dedup entry error: %s\n", err)
+	}
+}
+
+// key returns entry key in persistent storage.
+func (e *dedupEntry) key() string {
+	return fmt.Sprintf("%s%d/%s/%s", storageDedupPrefix, len(e.k.queue),
+		e.k.queue, e.k.key)
+}
+
+// MarshalBinary marshals dedup entry.
+func (e dedupEntry) MarshalBinary() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	writeBytes(buf, []byte(e.k.queue))
+	writeBytes(buf, []byte(e.k.key))
+	e.producer.write(buf)
+	var done byte
+	if e.done {
+		done = 1
+	}
+	buf.WriteByte(done)
+	writeBytes(buf, e.answer)
+	writeUvarint(buf, uint64(e.expires.UnixNano()))
+	writeUvarint(buf, uint64(len(e.waiters)))
+	for _, w := range e.waiters {
+		w.write(buf)
+	}
+	data = buf.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshals dedup entry.
+func (e *dedupEntry) UnmarshalBinary(data []byte) (err error) {
+	buf := bytes.NewBuffer(data)
+	queue, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	key, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	if err = e.producer.read(buf); err != nil {
+		return
+	}
+	done, err := buf.ReadByte()
+	if err != nil {
+		return
+	}
+	answer, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	expires, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	if n > uint64(buf.Len()) {
+		return ErrWrongRecord
+	}
+	e.waiters = make([]answersData, n)
+	for i := range e.waiters {
+		if err = e.waiters[i].read(buf); err != nil {
+			return
+		}
+	}
+	e.k = dedupKey{string(queue), string(key)}
+	e.done = done == 1
+	if len(answer) > 0 {
+		e.answer = answer
+	}
+	e.expires = time.Unix(0, int64(expires))
+	return
+}
+
+// dedupAnswer saves answer to message of producer in dedup table and sends
+// it to duplicates waiting the answer when the answer is replicated to
+// cluster brokers.
+func (br *Broker) dedupAnswer(queue string, producer answersData,
+	ans *teomq.Packet) {
+
+	var answer []byte
+	if ans != nil {
+		answer, _ = ans.MarshalBinary()
+	}
+	waiters := br.dedup.complete(producer, answer)
+	if len(waiters) == 0 {
+		return
+	}
+	br.commit(queue, func() {
+		for _, w := range waiters {
+			br.sendDedupAnswer(w, answer)
+		}
+	})
+}
+
+// dedupForget removes idempotency keys of producers messages which are not
+// answered and notifies duplicates waiting the answers that they will not be
+// answered.
+func (br *Broker) dedupForget(producers ...answersData) {
+	var waiters []answersData
+	for _, p := range producers {
+		waiters = append(waiters, br.dedup.forget(p)...)
+	}
+	if len(waiters) > 0 {
+		br.notifyProducers(teomq.CtrlNoAnswer, waiters)
+	}
+}
+
+// sendDedupAnswer sends marshalled answer of the first message to producer
+// of duplicate message. If the first message was acknowledged without answer
+// the acked control message is sent.
+func (br *Broker) sendDedupAnswer(producer answersData, answer []byte) {
+	if answer == nil {
+		br.notifyProducers(teomq.CtrlAcked, []answersData{producer})
+		return
+	}
+	ans := new(teomq.Packet)
+	if err := ans.UnmarshalBinary(answer); err != nil {
+		log.Printf(logprefix+"unmarshal dedup answer error: %s\n", err)
+		return
+	}
+	data, err := teomq.NewPacket(uint32(producer.id), ans.Data()).
+		SetHeader(ans.Header()).SetFlags(ans.Flags()).MarshalBinary()
+	if err != nil {
+		log.Printf(logprefix+"MarshalBinary error: %s\n", err)
+		return
+	}
+	if err := br.sendTo(producer.addr, data); err != nil {
+		log.Printf(logprefix+"send dedup answer err: %s\n", err)
+		return
+	}
+	log.Printf(logprefix+"send id %d, len %d, to producer %s, duplicate "+
+		"answer\n", producer.id, len(ans.Data()), producer.addr)
+}
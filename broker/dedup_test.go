@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+func TestDedup(t *testing.T) {
+
+	st, err := NewFileStorage(t.TempDir(), SyncNever)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+	key := teomq.Header{teomq.HeaderIdempotencyKey: "k1"}
+
+	// The first message is added, the second is duplicate waiting answer
+	d := newDedup(st, time.Minute)
+	m1 := &message{from: "p-addr-1", id: 1, queue: "q", header: key}
+	m2 := &message{from: "p-addr-2", id: 2, queue: "q", header: key}
+	if dup, _, _ := d.check(m1); dup {
+		t.Error("first message is duplicate")
+		return
+	}
+	if dup, _, done := d.check(m2); !dup || done {
+		t.Error("wrong second message check", dup, done)
+		return
+	}
+	if dup, _, _ := d.check(&message{from: "p-addr-2", id: 3, queue: "other",
+		header: key}); dup {
+		t.Error("message of other queue is duplicate")
+		return
+	}
+
+	// Restore dedup table from storage and answer the first message
+	d = newDedup(st, time.Minute)
+	if err = d.load(nil); err != nil {
+		t.Error("can't load dedup table:", err)
+		return
+	}
+	waiters := d.complete(answersData{"p-addr-1", 1}, []byte("answer"))
+	if len(waiters) != 1 || waiters[0] != (answersData{"p-addr-2", 2}) {
+		t.Error("wrong waiters", waiters)
+		return
+	}
+
+	// Retried message gets cached answer
+	m4 := &message{from: "p-addr-1", id: 4, queue: "q", header: key}
+	if dup, answer, done := d.check(m4); !dup || !done ||
+		string(answer) != "answer" {
+		t.Error("wrong retried message check", dup, done, string(answer))
+		return
+	}
+
+	// Forgotten message and expired key may be sent again
+	if waiters = d.forget(answersData{"p-addr-2", 3}); len(waiters) != 0 {
+		t.Error("wrong forgotten waiters", waiters)
+		return
+	}
+	if n := d.expired(time.Now().Add(time.Minute)); n != 1 || d.len() != 0 {
+		t.Error("wrong expired result", n, d.len())
+		return
+	}
+	if dup, _, _ := d.check(m4); dup {
+		t.Error("message with expired key is duplicate")
+		return
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Delayed messages module provides timer-ordered
+// messages heap which holds messages until they become eligible for delivery.
+
+package broker
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// delayed contains messages which should not be delivered before their
+// notBefore time. Messages are ordered by notBefore time.
+type delayed struct {
+	delayedHeap               // heap of delayed messages
+	*sync.Mutex               // mutex
+	wake        chan struct{} // wakes up scheduler when message added
+}
+type delayedHeap []*message
+
+// newDelayed creates a new delayed messages object.
+func newDelayed() (d *delayed) {
+	d = new(delayed)
+	d.Mutex = new(sync.Mutex)
+	d.wake = make(chan struct{}, 1)
+	return
+}
+
+// add adds message to delayed messages and wakes up scheduler.
+func (d *delayed) add(m *message) {
+	d.Lock()
+	heap.Push(&d.delayedHeap, m)
+	d.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// eligible removes and returns messages which notBefore time passed.
+func (d *delayed) eligible(now time.Time) (l []*message) {
+	d.Lock()
+	defer d.Unlock()
+
+	for len(d.delayedHeap) > 0 && !d.delayedHeap[0].notBefore.After(now) {
+		l = append(l, heap.Pop(&d.delayedHeap).(*message))
+	}
+	return
+}
+
+// next returns notBefore time of the first delayed message.
+func (d *delayed) next() (t time.Time, ok bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if len(d.delayedHeap) == 0 {
+		return
+	}
+	return d.delayedHeap[0].notBefore, true
+}
+
+// len returns number of delayed messages.
+func (d *delayed) len() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.delayedHeap)
+}
+
+// messages returns all delayed messages.
+func (d *delayed) messages() []*message {
+	d.Lock()
+	defer d.Unlock()
+	return append([]*message(nil), d.delayedHeap...)
+}
+
+// release removes delayed messages of queues selected by filter and returns
+// them.
+func (d *delayed) release(f queueFilter) (l []*message) {
+	d.Lock()
+	defer d.Unlock()
+	var keep delayedHeap
+	for _, m := range d.delayedHeap {
+		if f.match(m.queue) {
+			l = append(l, m)
+		} else {
+			keep = append(keep, m)
+		}
+	}
+	d.delayedHeap = keep
+	heap.Init(&d.delayedHeap)
+	return
+}
+
+// heap.Interface implementation
+func (h delayedHeap) Len() int { return len(h) }
+func (h delayedHeap) Less(i, j int) bool {
+	return h[i].notBefore.Before(h[j].notBefore)
+}
+func (h delayedHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *delayedHeap) Push(x any)   { *h = append(*h, x.(*message)) }
+func (h *delayedHeap) Pop() any {
+	old := *h
+	n := len(old)
+	m := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return m
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Drain module provides broker drain mode used to
+// shut down broker gracefully and hand off its queue to the next start.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// drainPollInterval is interval of checking not answered messages in Drain.
+const drainPollInterval = 100 * time.Millisecond
+
+// controlMaxIDs is maximum number of message ids in one control message.
+const controlMaxIDs = 512
+
+// peers contains channels of consumers and producers connected to broker.
+type peers struct {
+	m map[teomq.Channel]struct{}
+	*sync.RWMutex
+}
+
+// newPeers creates a new peers object.
+func newPeers() *peers {
+	return &peers{
+		m:       make(map[teomq.Channel]struct{}),
+		RWMutex: new(sync.RWMutex),
+	}
+}
+
+// add adds connected peer channel.
+func (p *peers) add(ch teomq.Channel) {
+	p.Lock()
+	defer p.Unlock()
+	p.m[ch] = struct{}{}
+}
+
+// del removes disconnected peer channel.
+func (p *peers) del(ch teomq.Channel) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.m, ch)
+}
+
+// list returns connected peers channels.
+func (p *peers) list() (l []teomq.Channel) {
+	p.RLock()
+	defer p.RUnlock()
+	for ch := range p.m {
+		l = append(l, ch)
+	}
+	return
+}
+
+// Drain switches broker to drain mode and waits until messages sent to
+// consumers are answered or context done. In drain mode broker does not
+// accept new producers messages and does not send queued messages to
+// consumers, connected consumers and producers get going away control
+// message, producers get it with ids of rejected messages.
+//
+// When waiting finished, messages which are not answered yet remain in
+// broker storage if it is set, or are saved to handoff Storage passed in
+// attr, so the broker started with this storage delivers them. If messages
+// are not saved, their producers get going away control message with their
+// ids. It returns context error if context done before all messages
+// answered.
+func (br *Broker) Drain(ctx context.Context, attr ...any) (err error) {
+
+	// Get handoff storage
+	var handoff Storage
+	for _, v := range attr {
+		switch v := v.(type) {
+		case Storage:
+			handoff = v
+		}
+	}
+
+	// Stop accepting and sending messages and notify peers
+	if !br.draining.Swap(true) {
+		br.stopping.Store(true)
+		log.Println(logprefix + "drain mode is on")
+		for _, ch := range br.peers.list() {
+			br.goingAway(ch)
+		}
+	}
+
+	// Wait until messages sent to consumers are answered
+	tick := time.NewTicker(drainPollInterval)
+	defer tick.Stop()
+wait:
+	for br.answers.len() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		case <-br.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+
+	// Save not answered messages to handoff storage or notify producers
+	switch {
+	case handoff != nil && handoff != br.storage:
+		if herr := br.handoff(handoff); herr != nil {
+			err = errors.Join(err, herr)
+		}
+	case br.storage == nil:
+		br.notifyLost()
+	}
+
+	return
+}
+
+// Draining returns true if broker is in drain mode.
+func (br *Broker) Draining() bool {
+	return br.draining.Load()
+}
+
+// goingAway sends going away control message to channel. The ids are
+// producer messages ids rejected by broker.
+func (br *Broker) goingAway(ch teomq.Channel, ids ...int) {
+	data, _ := teomq.Control{Cmd: teomq.CtrlGoingAway, IDs: ids}.
+		MarshalBinary()
+	if _, err := ch.Send(data); err != nil {
+		log.Printf(logprefix+"send going away to %s error: %s\n", ch, err)
+	}
+}
+
+// queued returns queued and delayed messages.
+func (br *Broker) queued() (l []*message) {
+	for _, q := range br.queues.list() {
+		l = append(l, q.queue.messages()...)
+	}
+	return append(l, br.queues.delayed.messages()...)
+}
+
+// handoff saves not answered messages to storage.
+func (br *Broker) handoff(st Storage) error {
+	l := append(br.queued(), br.inflight.messages()...)
+	for _, m := range l {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err = st.Set(m.key(), data); err != nil {
+			return err
+		}
+	}
+	log.Printf(logprefix+"hand off %d messages\n", len(l))
+	return nil
+}
+
+// notifyLost sends going away control message with ids of messages which
+// will not be delivered or answered to their producers.
+func (br *Broker) notifyLost() {
+
+	// Get lost messages, in-flight messages are in answers
+	lost := br.answers.producers()
+	for _, m := range br.queued() {
+		lost = append(lost, answersData{m.from, m.id})
+	}
+	br.notifyProducers(teomq.CtrlGoingAway, lost)
+}
+
+// notifyProducers sends control message with messages ids to their
+// producers. Messages without producer, e.g. schedule messages, are skipped.
+func (br *Broker) notifyProducers(cmd string, l []answersData) {
+
+	// Get messages ids by producers
+	ids := make(map[string][]int)
+	for _, p := range l {
+		if p.addr != "" {
+			ids[p.addr] = append(ids[p.addr], p.id)
+		}
+	}
+
+	// Send control messages
+	for addr, ids := range ids {
+		for chunk := range slices.Chunk(ids, controlMaxIDs) {
+			data, _ := teomq.Control{Cmd: cmd, IDs: chunk}.MarshalBinary()
+			if err := br.sendTo(addr, data); err != nil {
+				log.Printf(logprefix+"send %s to %s error: %s\n", cmd, addr,
+					err)
+				break
+			}
+		}
+		log.Printf(logprefix+"send %s of %d messages to producer %s\n", cmd,
+			len(ids), addr)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. In-flight messages module provides types and methods
+// to hold messages sent to consumers until they are acknowledged.
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// VisibilityTimeout sets time during which message sent to consumer waits
+// for consumer answer or acknowledge. When the timeout expires the message
+// is redelivered to another consumer. The default value is 30 seconds.
+type VisibilityTimeout time.Duration
+
+const defaultVisibilityTimeout = 30 * time.Second
+
+// inflight contains messages sent to consumers and not acknowledged yet.
+type inflight struct {
+	inflightMap                     // map of in-flight messages by consumers answerData
+	*sync.Mutex                     // mutex
+	keys        map[inflightKey]int // number of in-flight messages by routing key
+}
+type inflightMap map[answersData]*inflightData
+type inflightKey struct {
+	queue string // queue name
+	key   string // message routing key
+}
+type inflightData struct {
+	msg      *message      // Message sent to consumer
+	ch       teomq.Channel // Consumer channel
+	deadline time.Time     // Visibility timeout deadline
+}
+
+// newInflight creates a new inflight object.
+func newInflight() (f *inflight) {
+	f = new(inflight)
+	f.Mutex = new(sync.Mutex)
+	f.inflightMap = make(inflightMap)
+	f.keys = make(map[inflightKey]int)
+	return
+}
+
+// add adds message sent to consumer.
+func (f *inflight) add(consumer answersData, ch teomq.Channel, msg *message,
+	timeout time.Duration) {
+
+	f.Lock()
+	defer f.Unlock()
+	f.inflightMap[consumer] = &inflightData{msg, ch, time.Now().Add(timeout)}
+	if msg.routingKey != "" {
+		f.keys[inflightKey{msg.queue, msg.routingKey}]++
+	}
+}
+
+// del removes and returns in-flight message by consumers answerData.
+func (f *inflight) del(consumer answersData) (d *inflightData, ok bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	if d, ok = f.inflightMap[consumer]; ok {
+		f.remove(consumer, d)
+	}
+	return
+}
+
+// remove removes in-flight message from map and routing keys. It should be
+// called under lock.
+func (f *inflight) remove(consumer answersData, d *inflightData) {
+	delete(f.inflightMap, consumer)
+	if d.msg.routingKey == "" {
+		return
+	}
+	k := inflightKey{d.msg.queue, d.msg.routingKey}
+	if f.keys[k]--; f.keys[k] <= 0 {
+		delete(f.keys, k)
+	}
+}
+
+// hasKey returns true if message with routing key of queue is in-flight.
+func (f *inflight) hasKey(queue, key string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.keys[inflightKey{queue, key}] > 0
+}
+
+// expired removes and returns in-flight messages with expired deadline.
+func (f *inflight) expired(now time.Time) (l map[answersData]*inflightData) {
+	f.Lock()
+	defer f.Unlock()
+
+	for k, d := range f.inflightMap {
+		if now.Before(d.deadline) {
+			continue
+		}
+		if l == nil {
+			l = make(map[answersData]*inflightData)
+		}
+		l[k] = d
+		f.remove(k, d)
+	}
+	return
+}
+
+// delChannel removes and returns all in-flight messages of consumer channel.
+func (f *inflight) delChannel(ch teomq.Channel) (
+	l map[answersData]*inflightData) {
+
+	f.Lock()
+	defer f.Unlock()
+
+	for k, d := range f.inflightMap {
+		if d.ch != ch {
+			continue
+		}
+		if l == nil {
+			l = make(map[answersData]*inflightData)
+		}
+		l[k] = d
+		f.remove(k, d)
+	}
+	return
+}
+
+// len returns number of in-flight messages.
+func (f *inflight) len() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.inflightMap)
+}
+
+// messages returns all in-flight messages.
+func (f *inflight) messages() (l []*message) {
+	f.Lock()
+	defer f.Unlock()
+	for _, d := range f.inflightMap {
+		l = append(l, d.msg)
+	}
+	return
+}
+
+// release removes in-flight messages of queues selected by filter and
+// returns them.
+func (f *inflight) release(filter queueFilter) (l []*message) {
+	f.Lock()
+	defer f.Unlock()
+	for k, d := range f.inflightMap {
+		if filter.match(d.msg.queue) {
+			l = append(l, d.msg)
+			f.remove(k, d)
+		}
+	}
+	return
+}
@@ -8,38 +8,163 @@
 package broker
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"log"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
 )
 
 var ErrMessageNotFound = errors.New("message not found")
 
-// queue contain messages queue data and methods to process it.
+// PriorityAging sets time after which waiting message priority is increased
+// by one level to avoid starvation of low priority messages. Zero value
+// disables aging. The default value is 10 seconds.
+type PriorityAging time.Duration
+
+const defaultPriorityAging = 10 * time.Second
+
+// queue contain messages queue data and methods to process it. Messages are
+// stored in lists by priority levels.
 type queue struct {
-	list.List     // list of messages
-	*sync.RWMutex // mutext
+	levels        [teomq.MaxPriority + 1]list.List // lists of messages by priority
+	*sync.RWMutex                                  // mutext
+	storage       Storage                          // persistent storage, may be nil
+	seq           *sequence                        // last message sequence number
+	aging         time.Duration                    // priority aging interval
 }
 
 // message is the messageQueue data type.
 type message struct {
-	from string // Got message from
-	id   int    // Message ID
-	data []byte // Message data
+	from       string       // Got message from
+	id         int          // Message ID
+	data       []byte       // Message data
+	queue      string       // Queue name
+	seq        uint64       // Message sequence number in queue
+	deliveries int          // Number of delivery attempts
+	expires    time.Time    // Message expiration time, zero if never expires
+	priority   int          // Message priority
+	added      time.Time    // Time when message added to queue
+	notBefore  time.Time    // Message is not delivered before this time
+	routingKey string       // Message routing key
+	header     teomq.Header // Message header
+	fanOut     bool         // Producer waits fan-out control message
 }
 
-// newQueue creates a new queue object.
-func newQueue() (q *queue) {
+// Stored message flags
+const messageFlagFanOut byte = 1 << iota // producer waits fan-out message
+
+// newQueue creates a new queue object. The seq parameter is messages sequence
+// number counter which may be shared between queues, it creates if nil.
+func newQueue(storage Storage, seq *sequence) (q *queue) {
 	q = new(queue)
 	q.RWMutex = new(sync.RWMutex)
+	q.storage = storage
+	q.seq = seq
+	if q.seq == nil {
+		q.seq = new(sequence)
+	}
+	q.aging = defaultPriorityAging
 	return
 }
 
+// level returns messages list of message priority.
+func (q *queue) level(m *message) *list.List {
+	return &q.levels[min(max(m.priority, 0), teomq.MaxPriority)]
+}
+
+// restore adds message restored from persistent storage to the back of queue.
+// Message keeps time when it was added to queue, delayed message is added
+// now.
+func (q *queue) restore(m *message) {
+	q.Lock()
+	defer q.Unlock()
+	if m.added.IsZero() {
+		m.added = time.Now()
+	}
+	q.level(m).PushBack(m)
+}
+
 // set adds new message to the back of queue.
-func (q *queue) set(messages *message) {
+func (q *queue) set(m *message) {
 	q.Lock()
 	defer q.Unlock()
-	q.PushBack(messages)
+	m.seq = q.seq.next()
+	m.added = time.Now()
+	q.save(m)
+	q.level(m).PushBack(m)
+}
+
+// hold saves new message to persistent storage without adding it to queue,
+// e.g. delayed message or message which is not replicated to cluster yet.
+// The message is added to queue by restore.
+func (q *queue) hold(m *message) {
+	q.Lock()
+	defer q.Unlock()
+	m.seq = q.seq.next()
+	q.save(m)
+}
+
+// save writes message to persistent storage.
+func (q *queue) save(m *message) {
+	if q.storage == nil {
+		return
+	}
+	data, _ := m.MarshalBinary()
+	if err := q.storage.Set(m.key(), data); err != nil {
+		log.Printf(logprefix+"save queue message error: %s\n", err)
+	}
+}
+
+// remove removes message from persistent storage.
+func (q *queue) remove(m *message) {
+	if q.storage == nil {
+		return
+	}
+	if err := q.storage.Del(m.key()); err != nil {
+		log.Printf(logprefix+"remove queue message error: %s\n", err)
+	}
+}
+
+// front returns element of message which should be processed next. It is the
+// first message of the highest priority level. When aging is on, the
+// priority of first message in each level is increased by one for each aging
+// interval the message waits in queue, so low priority messages are not
+// starved by high priority ones.
+func (q *queue) front() (front *list.Element) {
+	if levels := q.order(); len(levels) > 0 {
+		front = levels[0].Front()
+	}
+	return
+}
+
+// order returns not empty priority levels ordered by effective priority of
+// their first messages.
+func (q *queue) order() (levels []*list.List) {
+	now := time.Now()
+	priorities := make(map[*list.List]int)
+	for level := len(q.levels) - 1; level >= 0; level-- {
+		e := q.levels[level].Front()
+		if e == nil {
+			continue
+		}
+		priority := level
+		if m, ok := e.Value.(*message); ok && q.aging > 0 {
+			priority += int(now.Sub(m.added) / q.aging)
+		}
+		priorities[&q.levels[level]] = priority
+		levels = append(levels, &q.levels[level])
+	}
+	slices.SortStableFunc(levels, func(a, b *list.List) int {
+		return priorities[b] - priorities[a]
+	})
+	return
 }
 
 // get returns first element from queue and remove it, or returns nil and error
@@ -49,7 +174,7 @@ func (q *queue) get(removes ...bool) (*message, *list.Element, error) {
 	defer q.Unlock()
 
 	// Get first element of messages queue
-	e := q.Front()
+	e := q.front()
 	if e == nil {
 		return nil, nil, ErrMessageNotFound
 	}
@@ -62,22 +187,303 @@ func (q *queue) get(removes ...bool) (*message, *list.Element, error) {
 
 	// Remove element from messages queue
 	if len(removes) == 0 || removes[0] {
-		q.Remove(e)
+		q.level(m).Remove(e)
+		q.remove(m)
 	}
 
 	return m, e, nil
 }
 
+// take returns first message from queue and remove it from queue list, but
+// keeps message in persistent storage until done or requeue called. If
+// eligible function is not nil the first message for which it returns true
+// is taken, messages are checked in priority order.
+func (q *queue) take(eligible func(m *message) bool) (*message, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, level := range q.order() {
+		for e := level.Front(); e != nil; e = e.Next() {
+			m, ok := e.Value.(*message)
+			if !ok || (eligible != nil && !eligible(m)) {
+				continue
+			}
+			level.Remove(e)
+			return m, nil
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+// expired removes and returns expired messages from queue.
+func (q *queue) expired(now time.Time) (l []*message) {
+	q.Lock()
+	defer q.Unlock()
+
+	for i := range q.levels {
+		level := &q.levels[i]
+		for e := level.Front(); e != nil; {
+			next := e.Next()
+			if m, ok := e.Value.(*message); ok && m.expired(now) {
+				level.Remove(e)
+				l = append(l, m)
+			}
+			e = next
+		}
+	}
+	return
+}
+
+// done removes taken message from persistent storage.
+func (q *queue) done(m *message) {
+	q.Lock()
+	defer q.Unlock()
+	q.remove(m)
+}
+
+// requeue returns taken message to the front of queue.
+func (q *queue) requeue(m *message) {
+	q.Lock()
+	defer q.Unlock()
+	q.save(m)
+	q.level(m).PushFront(m)
+}
+
 // del removes element from queue.
 func (q *queue) del(e *list.Element) {
 	q.Lock()
 	defer q.Unlock()
-	q.Remove(e)
+	m, ok := e.Value.(*message)
+	if !ok {
+		return
+	}
+	q.level(m).Remove(e)
+	q.remove(m)
+}
+
+// release removes all messages from queue and returns them. Messages remain
+// in persistent storage.
+func (q *queue) release() (l []*message) {
+	q.Lock()
+	defer q.Unlock()
+	for i := range q.levels {
+		for e := q.levels[i].Front(); e != nil; e = e.Next() {
+			if m, ok := e.Value.(*message); ok {
+				l = append(l, m)
+			}
+		}
+		q.levels[i].Init()
+	}
+	return
 }
 
 // len returns number of elements in queue
-func (q *queue) len() int {
+func (q *queue) len() (n int) {
+	q.RLock()
+	defer q.RUnlock()
+	for i := range q.levels {
+		n += q.levels[i].Len()
+	}
+	return
+}
+
+// messages returns all messages in queue.
+func (q *queue) messages() (l []*message) {
 	q.RLock()
 	defer q.RUnlock()
-	return q.Len()
+	for i := range q.levels {
+		for e := q.levels[i].Front(); e != nil; e = e.Next() {
+			if m, ok := e.Value.(*message); ok {
+				l = append(l, m)
+			}
+		}
+	}
+	return
+}
+
+// newMessage creates queue message from producer data. If data contains
+// message envelope the message metadata is taken from it.
+func newMessage(from string, id int, data []byte) (m *message, err error) {
+	m = &message{from: from, id: id, data: data}
+	if !teomq.IsMessage(data) {
+		return
+	}
+	var envelope teomq.Message
+	if err = envelope.UnmarshalBinary(data); err != nil {
+		return
+	}
+	m.data = envelope.Data
+	m.queue = envelope.Queue
+	m.priority = envelope.Priority
+	m.routingKey = envelope.Key
+	m.header = envelope.Header
+	m.fanOut = envelope.FanOut
+	m.setDelay(envelope.Delay, envelope.DeliverAt)
+	m.setTTL(envelope.TTL)
+	return
+}
+
+// setDelay sets time before which message is not delivered. It is the latest
+// of now plus delay and deliverAt time.
+func (m *message) setDelay(delay time.Duration, deliverAt time.Time) {
+	now := time.Now()
+	if delay > 0 {
+		m.notBefore = now.Add(delay)
+	}
+	if deliverAt.After(now) && deliverAt.After(m.notBefore) {
+		m.notBefore = deliverAt
+	}
+}
+
+// setTTL sets message expiration time from now or from message delivery time
+// if message is delayed.
+func (m *message) setTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	from := time.Now()
+	if m.notBefore.After(from) {
+		from = m.notBefore
+	}
+	m.expires = from.Add(ttl)
+}
+
+// delayed returns true if message should not be delivered at now time.
+func (m *message) delayed(now time.Time) bool {
+	return m.notBefore.After(now)
+}
+
+// expired returns true if message expiration time passed.
+func (m *message) expired(now time.Time) bool {
+	return !m.expires.IsZero() && now.After(m.expires)
+}
+
+// key returns message key in persistent storage.
+func (m *message) key() string {
+	return fmt.Sprintf("%s%016x", storageQueuePrefix, m.seq)
+}
+
+// MarshalBinary marshals message to store it in persistent storage.
+func (m *message) MarshalBinary() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	writeUvarint(buf, m.seq)
+	writeBytes(buf, []byte(m.from))
+	writeUvarint(buf, uint64(m.id))
+	writeBytes(buf, m.data)
+	writeUvarint(buf, uint64(m.deliveries))
+	writeBytes(buf, []byte(m.queue))
+	var expires int64
+	if !m.expires.IsZero() {
+		expires = m.expires.UnixNano()
+	}
+	writeUvarint(buf, uint64(expires))
+	writeUvarint(buf, uint64(m.priority))
+	var notBefore int64
+	if !m.notBefore.IsZero() {
+		notBefore = m.notBefore.UnixNano()
+	}
+	writeUvarint(buf, uint64(notBefore))
+	writeBytes(buf, []byte(m.routingKey))
+	header, _ := m.header.MarshalBinary()
+	writeBytes(buf, header)
+	var flags byte
+	if m.fanOut {
+		flags |= messageFlagFanOut
+	}
+	buf.WriteByte(flags)
+	var added int64
+	if !m.added.IsZero() {
+		added = m.added.UnixNano()
+	}
+	writeUvarint(buf, uint64(added))
+	data = buf.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshals message restored from persistent storage.
+func (m *message) UnmarshalBinary(data []byte) (err error) {
+	buf := bytes.NewBuffer(data)
+	if m.seq, err = binary.ReadUvarint(buf); err != nil {
+		return
+	}
+	from, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	id, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	if m.data, err = readBytes(buf); err != nil {
+		return
+	}
+	deliveries, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	queue, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	expires, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	if expires > 0 {
+		m.expires = time.Unix(0, int64(expires))
+	}
+	priority, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	m.priority = int(priority)
+	if buf.Len() > 0 {
+		notBefore, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return err
+		}
+		if notBefore > 0 {
+			m.notBefore = time.Unix(0, int64(notBefore))
+		}
+	}
+	if buf.Len() > 0 {
+		routingKey, err := readBytes(buf)
+		if err != nil {
+			return err
+		}
+		m.routingKey = string(routingKey)
+	}
+	if buf.Len() > 0 {
+		header, err := readBytes(buf)
+		if err != nil {
+			return err
+		}
+		if err = m.header.UnmarshalBinary(header); err != nil {
+			return err
+		}
+		if len(m.header) == 0 {
+			m.header = nil
+		}
+	}
+	if buf.Len() > 0 {
+		flags, err := buf.ReadByte()
+		if err != nil {
+			return err
+		}
+		m.fanOut = flags&messageFlagFanOut != 0
+	}
+	if buf.Len() > 0 {
+		added, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return err
+		}
+		if added > 0 {
+			m.added = time.Unix(0, int64(added))
+		}
+	}
+	m.deliveries = int(deliveries)
+	m.queue = string(queue)
+	m.from = string(from)
+	m.id = int(id)
+	return
 }
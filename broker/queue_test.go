@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+func TestQueuePriority(t *testing.T) {
+
+	// Create queue without priority aging
+	q := newQueue(nil, nil)
+	q.aging = 0
+
+	// Add messages with different priorities
+	q.set(&message{id: 1})
+	q.set(&message{id: 2, priority: 5})
+	q.set(&message{id: 3})
+	q.set(&message{id: 4, priority: 9})
+
+	// Messages should be taken by priority and by order in one priority
+	for _, id := range []int{4, 2, 1, 3} {
+		m, err := q.take(nil)
+		if err != nil {
+			t.Error("can't take message:", err)
+			return
+		}
+		if m.id != id {
+			t.Errorf("wrong message id %d, expected %d", m.id, id)
+			return
+		}
+	}
+
+	// Low priority message waiting longer than aging interval should be
+	// taken before high priority message
+	q.aging = time.Second
+	q.set(&message{id: 5})
+	q.set(&message{id: 6, priority: 1})
+	q.levels[0].Front().Value.(*message).added = time.Now().Add(-2 * time.Second)
+	if m, _ := q.take(nil); m.id != 5 {
+		t.Errorf("wrong message id %d, expected 5", m.id)
+		return
+	}
+}
+
+func TestQueueDelayed(t *testing.T) {
+
+	// Create queues with delayed and not delayed messages
+	q := newQueues(nil)
+	now := time.Now()
+	q.get("q1").set(&message{id: 1, queue: "q1",
+		notBefore: now.Add(2 * time.Second)})
+	q.get("q1").set(&message{id: 2, queue: "q1",
+		notBefore: now.Add(time.Second)})
+	q.get("q1").set(&message{id: 3, queue: "q1"})
+
+	// Only not delayed message should be in queue
+	if l := q.get("q1").queue.len(); l != 1 {
+		t.Errorf("wrong queue length %d, expected 1", l)
+		return
+	}
+	if l := q.delayed.len(); l != 2 {
+		t.Errorf("wrong delayed length %d, expected 2", l)
+		return
+	}
+
+	// Delayed messages should be moved to queue by their delivery time
+	if n := q.promote(now.Add(1500 * time.Millisecond)); n != 1 {
+		t.Errorf("wrong number of promoted messages %d, expected 1", n)
+		return
+	}
+	if next, _ := q.delayed.next(); !next.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("wrong next delayed time %s", next)
+		return
+	}
+	q.promote(now.Add(3 * time.Second))
+	for _, id := range []int{3, 2, 1} {
+		m, err := q.get("q1").queue.take(nil)
+		if err != nil {
+			t.Error("can't take message:", err)
+			return
+		}
+		if m.id != id {
+			t.Errorf("wrong message id %d, expected %d", m.id, id)
+			return
+		}
+	}
+}
+
+func TestQueueTakeEligible(t *testing.T) {
+
+	// Create queue with messages of two routing keys
+	q := newQueue(nil, nil)
+	q.set(&message{id: 1, routingKey: "a"})
+	q.set(&message{id: 2, routingKey: "a"})
+	q.set(&message{id: 3, routingKey: "b"})
+
+	// Messages of blocked key should be skipped
+	blocked := map[string]bool{"a": true}
+	eligible := func(m *message) bool { return !blocked[m.routingKey] }
+	if m, _ := q.take(eligible); m == nil || m.id != 3 {
+		t.Error("wrong message taken, expected id 3")
+		return
+	}
+	if _, err := q.take(eligible); err != ErrMessageNotFound {
+		t.Errorf("wrong error %v, expected %v", err, ErrMessageNotFound)
+		return
+	}
+
+	// Messages of unblocked key should be taken in order
+	blocked["a"] = false
+	for _, id := range []int{1, 2} {
+		if m, _ := q.take(eligible); m == nil || m.id != id {
+			t.Errorf("wrong message taken, expected id %d", id)
+			return
+		}
+	}
+}
+
+func TestQueueTTL(t *testing.T) {
+
+	// Run broker without consumers with fast housekeeping, set default
+	// time-to-live of named queue
+	br, err := New("broker", teomq.NewLoopback().Transport("broker"),
+		VisibilityTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	br.SetQueueTTL("jobs", 30*time.Millisecond)
+
+	// Add message with its own short time-to-live and message with queue
+	// default time-to-live
+	m := &message{from: "p-addr-1", id: 1, data: []byte("m1")}
+	m.setTTL(30 * time.Millisecond)
+	br.queues.get(DefaultQueue).set(m)
+	br.queues.get("jobs").set(&message{from: "p-addr-2", id: 2,
+		data: []byte("m2"), queue: "jobs"})
+
+	// Both messages should move to dead-letter queue as expired after
+	// housekeeping runs past their deadlines and never be delivered
+	time.Sleep(150 * time.Millisecond)
+	if n, n2 := br.QueueLen(DefaultQueue), br.QueueLen("jobs"); n+n2 != 0 {
+		t.Errorf("wrong queues length %d and %d, expected 0", n, n2)
+		return
+	}
+	dls := br.DeadLetters()
+	if len(dls) != 2 {
+		t.Errorf("wrong number of dead letters %d, expected 2", len(dls))
+		return
+	}
+	for _, dl := range dls {
+		if dl.Reason != DeadExpired || dl.Deliveries != 0 {
+			t.Errorf("wrong dead letter %d reason %s, deliveries %d",
+				dl.MessageID, dl.Reason, dl.Deliveries)
+			return
+		}
+	}
+}
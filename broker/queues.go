@@ -0,0 +1,302 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Named queues module provides named queues map types
+// and methods.
+
+package broker
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// DefaultQueue is name of the queue used by producers and consumers which
+// don't set queue name.
+const DefaultQueue = teomq.DefaultQueue
+
+// QueueTTL sets default time-to-live of messages in named queue. It used for
+// messages sent by producers without time-to-live.
+type QueueTTL struct {
+	Queue string        // Queue name
+	TTL   time.Duration // Default messages time-to-live
+}
+
+// namedQueue contains messages queue and consumers list of one named queue.
+type namedQueue struct {
+	name string       // Queue name
+	ttl  atomic.Int64 // Default messages time-to-live
+	*queue
+	*consumers
+	delayed *delayed // Delayed messages of all queues
+}
+
+// queues contain named queues and methods to process it. Each named queue has
+// independent messages queue and consumers list. Answers and in-flight
+// messages are stored by broker in common maps because consumers address
+// and packet id identifies them in all queues.
+type queues struct {
+	m             map[string]*namedQueue // map of queues by name
+	names         []string               // queues names in creation order
+	*sync.RWMutex                        // mutex
+	storage       Storage                // persistent storage, may be nil
+	seq           *sequence              // messages sequence number
+	aging         time.Duration          // messages priority aging interval
+	delayed       *delayed               // delayed messages of all queues
+}
+
+// newQueues creates a new queues object with default queue.
+func newQueues(storage Storage) (q *queues) {
+	q = new(queues)
+	q.m = make(map[string]*namedQueue)
+	q.RWMutex = new(sync.RWMutex)
+	q.storage = storage
+	q.seq = new(sequence)
+	q.aging = defaultPriorityAging
+	q.delayed = newDelayed()
+	q.get(DefaultQueue)
+	return
+}
+
+// get returns named queue by name, the queue is created if it does not exist.
+func (q *queues) get(name string) *namedQueue {
+	q.RLock()
+	nq, ok := q.m[name]
+	q.RUnlock()
+	if ok {
+		return nq
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if nq, ok = q.m[name]; ok {
+		return nq
+	}
+	nq = &namedQueue{name: name, queue: newQueue(q.storage, q.seq),
+		consumers: newConsumers(), delayed: q.delayed}
+	nq.queue.aging = q.aging
+	q.m[name] = nq
+	q.names = append(q.names, name)
+	return nq
+}
+
+// list returns named queues in creation order.
+func (q *queues) list() (l []*namedQueue) {
+	q.RLock()
+	defer q.RUnlock()
+	for _, name := range q.names {
+		l = append(l, q.m[name])
+	}
+	return
+}
+
+// queueFilter selects queues which records are restored from persistent
+// storage or released from memory, nil filter selects all queues.
+type queueFilter func(queue string) bool
+
+// match returns true if filter selects queue.
+func (f queueFilter) match(queue string) bool {
+	return f == nil || f(queue)
+}
+
+// sequence is messages sequence number counter. Cluster brokers use
+// different numbers of one sequence: each broker gets numbers which have its
+// own remainder of division by number of cluster brokers, so messages
+// queued by leaders of different queues don't have the same numbers.
+type sequence struct {
+	atomic.Uint64
+	step   uint64 // number of cluster brokers, zero if cluster mode is off
+	offset uint64 // remainder of this broker numbers
+}
+
+// next returns next sequence number.
+func (s *sequence) next() uint64 {
+	for {
+		v := s.Add(1)
+		if s.step <= 1 || v%s.step == s.offset {
+			return v
+		}
+	}
+}
+
+// load restores queues messages selected by filter from persistent storage.
+// Messages which are not eligible for delivery yet are restored to delayed
+// messages.
+func (q *queues) load(f queueFilter) (err error) {
+	if q.storage == nil {
+		return
+	}
+	now := time.Now()
+	return rangePrefix(q.storage, storageQueuePrefix,
+		func(key string, data []byte) (err error) {
+			m := new(message)
+			if err = m.UnmarshalBinary(data); err != nil {
+				return
+			}
+			if !f.match(m.queue) {
+				return
+			}
+			if m.delayed(now) {
+				q.delayed.add(m)
+			} else {
+				q.get(m.queue).restore(m)
+			}
+			q.setSeq(m.seq)
+			return
+		},
+	)
+}
+
+// promote moves delayed messages which became eligible for delivery to their
+// queues. It returns number of moved messages.
+func (q *queues) promote(now time.Time) (n int) {
+	for _, m := range q.delayed.eligible(now) {
+		q.get(m.queue).restore(m)
+		n++
+	}
+	return
+}
+
+// setAging sets messages priority aging interval of all queues.
+func (q *queues) setAging(aging time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	q.aging = aging
+	for _, nq := range q.m {
+		nq.queue.Lock()
+		nq.queue.aging = aging
+		nq.queue.Unlock()
+	}
+}
+
+// setSeq sets last message sequence number if it is greater than current.
+func (q *queues) setSeq(seq uint64) {
+	for {
+		cur := q.seq.Load()
+		if cur >= seq || q.seq.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+// release removes messages of queues selected by filter from queues and
+// delayed messages and returns them. Messages remain in persistent storage.
+func (q *queues) release(f queueFilter) (l []*message) {
+	for _, nq := range q.list() {
+		if f.match(nq.name) {
+			l = append(l, nq.queue.release()...)
+		}
+	}
+	return append(l, q.delayed.release(f)...)
+}
+
+// addConsumer adds consumer to consumers lists of queues declared in hello.
+func (q *queues) addConsumer(ch teomq.Channel, hello teomq.Hello) {
+	for _, name := range hello.QueuesOrDefault() {
+		q.get(name).consumers.add(ch, hello)
+	}
+}
+
+// delConsumer removes consumer from consumers lists of all queues. It
+// returns true if consumer was found.
+func (q *queues) delConsumer(ch teomq.Channel) (ok bool) {
+	for _, nq := range q.list() {
+		if nq.consumers.del(ch) == nil {
+			ok = true
+		}
+	}
+	return
+}
+
+// consumer returns consumer hello options if consumer exists in any queue.
+func (q *queues) consumer(ch teomq.Channel) (hello teomq.Hello, ok bool) {
+	for _, nq := range q.list() {
+		if hello, ok = nq.consumers.hello(ch); ok {
+			return
+		}
+	}
+	return
+}
+
+// queueNames returns queues names.
+func (q *queues) queueNames() []string {
+	q.RLock()
+	defer q.RUnlock()
+	return slices.Clone(q.names)
+}
+
+// len returns number of messages in all queues.
+func (q *queues) len() (n int) {
+	for _, nq := range q.list() {
+		n += nq.queue.len()
+	}
+	return
+}
+
+// set adds new message to the back of named queue and sets queue default
+// time-to-live to message if message has not its own. Delayed message is
+// held in delayed messages until it becomes eligible for delivery. It
+// returns false if message was delayed.
+func (nq *namedQueue) set(m *message) bool {
+	nq.hold(m)
+	return nq.push(m)
+}
+
+// hold sets queue default time-to-live to new message and saves it to
+// persistent storage without adding it to queue. The message is added to
+// queue by push.
+func (nq *namedQueue) hold(m *message) {
+	now := time.Now()
+	if m.expires.IsZero() {
+		m.setTTL(time.Duration(nq.ttl.Load()))
+	}
+	if !m.delayed(now) {
+		m.added = now
+	}
+	nq.queue.hold(m)
+}
+
+// push adds held message to the back of named queue, or to delayed messages
+// if it is not eligible for delivery yet. It returns false if message was
+// delayed.
+func (nq *namedQueue) push(m *message) bool {
+	if m.delayed(time.Now()) {
+		nq.delayed.add(m)
+		return false
+	}
+	nq.queue.restore(m)
+	return true
+}
+
+// Queues returns broker queues names.
+func (br *Broker) Queues() []string {
+	return br.queues.queueNames()
+}
+
+// QueueLen returns number of messages in the named queue.
+func (br *Broker) QueueLen(name string) int {
+	br.queues.RLock()
+	nq, ok := br.queues.m[name]
+	br.queues.RUnlock()
+	if !ok {
+		return 0
+	}
+	return nq.queue.len()
+}
+
+// DelayedLen returns number of delayed messages in all queues which are not
+// eligible for delivery yet.
+func (br *Broker) DelayedLen() int {
+	return br.queues.delayed.len()
+}
+
+// SetQueueTTL sets default time-to-live of messages in named queue. Zero ttl
+// means that messages never expire.
+func (br *Broker) SetQueueTTL(name string, ttl time.Duration) {
+	br.queues.get(name).ttl.Store(int64(ttl))
+}
@@ -0,0 +1,345 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Schedule module provides recurring messages
+// schedules registered on broker and scheduler which delivers delayed and
+// scheduled messages.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Schedule is recurring message schedule registered on broker. The broker
+// adds schedule message to the queue at each schedule time as if it was sent
+// by producer. Answers to schedule messages are dropped. Schedules are saved
+// in broker persistent storage.
+type Schedule struct {
+	ID    int       // Schedule ID
+	Spec  string    // Cron-style schedule specification
+	Queue string    // Queue name
+	Data  []byte    // Message data
+	Next  time.Time // Next schedule time
+}
+
+// schedule is registered schedule with parsed specification.
+type schedule struct {
+	Schedule
+	spec *cronSpec
+}
+
+// schedules contains registered schedules.
+type schedules struct {
+	m           map[int]*schedule // map of schedules by ID
+	lastID      int               // last schedule ID
+	*sync.Mutex                   // mutex
+	storage     Storage           // persistent storage, may be nil
+	wake        chan struct{}     // wakes up scheduler when schedule added
+}
+
+// newSchedules creates a new schedules object.
+func newSchedules(storage Storage) (s *schedules) {
+	s = new(schedules)
+	s.m = make(map[int]*schedule)
+	s.Mutex = new(sync.Mutex)
+	s.storage = storage
+	s.wake = make(chan struct{}, 1)
+	return
+}
+
+// load restores schedules of queues selected by filter from persistent
+// storage and wakes up scheduler. Schedules which are registered already are
+// skipped.
+func (s *schedules) load(f queueFilter) (err error) {
+	if s.storage == nil {
+		return
+	}
+	s.Lock()
+	defer s.wakeup()
+	defer s.Unlock()
+
+	now := time.Now()
+	return rangePrefix(s.storage, storageSchedPrefix,
+		func(key string, data []byte) (err error) {
+			sch := new(schedule)
+			if err = sch.UnmarshalBinary(data); err != nil || !f.match(sch.Queue) {
+				return
+			}
+			if sch.spec, err = parseCron(sch.Spec); err != nil {
+				return
+			}
+			if _, ok := s.find(sch); ok {
+				return
+			}
+			sch.Next = sch.spec.next(now)
+			if _, ok := s.m[sch.ID]; ok {
+				s.set(sch, 0)
+				return
+			}
+			s.set(sch, sch.ID)
+			return
+		},
+	)
+}
+
+// add adds schedule and wakes up scheduler. If the same schedule is
+// registered already it returns its ID.
+func (s *schedules) add(sch *schedule) int {
+	s.Lock()
+	defer s.wakeup()
+	defer s.Unlock()
+
+	if id, ok := s.find(sch); ok {
+		return id
+	}
+	s.set(sch, 0)
+	return sch.ID
+}
+
+// set sets schedule with ID, or with new ID if id is zero, and saves it to
+// persistent storage. It should be called under lock.
+func (s *schedules) set(sch *schedule, id int) {
+	if id == 0 {
+		id = s.lastID + 1
+	}
+	sch.ID = id
+	s.lastID = max(s.lastID, id)
+	s.m[id] = sch
+	if s.storage == nil {
+		return
+	}
+	data, _ := sch.MarshalBinary()
+	if err := s.storage.Set(sch.key(), data); err != nil {
+		log.Printf(logprefix+"save schedule error: %s\n", err)
+	}
+}
+
+// find returns ID of registered schedule with the same specification, queue
+// and data. It should be called under lock.
+func (s *schedules) find(sch *schedule) (id int, ok bool) {
+	for id, v := range s.m {
+		if v.Spec == sch.Spec && v.Queue == sch.Queue &&
+			bytes.Equal(v.Data, sch.Data) {
+			return id, true
+		}
+	}
+	return
+}
+
+// wakeup wakes up scheduler.
+func (s *schedules) wakeup() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// del removes schedule by ID.
+func (s *schedules) del(id int) error {
+	s.Lock()
+	defer s.Unlock()
+	sch, ok := s.m[id]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	delete(s.m, id)
+	if s.storage == nil {
+		return nil
+	}
+	if err := s.storage.Del(sch.key()); err != nil {
+		log.Printf(logprefix+"remove schedule error: %s\n", err)
+	}
+	return nil
+}
+
+// due returns schedules which time passed and sets their next time.
+func (s *schedules) due(now time.Time) (l []Schedule) {
+	s.Lock()
+	defer s.Unlock()
+	for _, sch := range s.m {
+		if sch.Next.IsZero() || sch.Next.After(now) {
+			continue
+		}
+		l = append(l, sch.Schedule)
+		sch.Next = sch.spec.next(now)
+	}
+	return
+}
+
+// next returns the earliest next time of schedules.
+func (s *schedules) next() (t time.Time, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, sch := range s.m {
+		if sch.Next.IsZero() {
+			continue
+		}
+		if !ok || sch.Next.Before(t) {
+			t, ok = sch.Next, true
+		}
+	}
+	return
+}
+
+// list returns schedules sorted by ID.
+func (s *schedules) list() (l []Schedule) {
+	s.Lock()
+	defer s.Unlock()
+	for _, sch := range s.m {
+		l = append(l, sch.Schedule)
+	}
+	slices.SortFunc(l, func(a, b Schedule) int { return a.ID - b.ID })
+	return
+}
+
+// len returns number of schedules.
+func (s *schedules) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.m)
+}
+
+// key returns schedule key in persistent storage.
+func (sch *Schedule) key() string {
+	return fmt.Sprintf("%s%016x", storageSchedPrefix, sch.ID)
+}
+
+// MarshalBinary marshals schedule. Next schedule time is not marshalled, it
+// is calculated when schedule restored.
+func (sch Schedule) MarshalBinary() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	writeUvarint(buf, uint64(sch.ID))
+	writeBytes(buf, []byte(sch.Spec))
+	writeBytes(buf, []byte(sch.Queue))
+	writeBytes(buf, sch.Data)
+	data = buf.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshals schedule.
+func (sch *Schedule) UnmarshalBinary(data []byte) (err error) {
+	buf := bytes.NewBuffer(data)
+	id, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	spec, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	queue, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	if sch.Data, err = readBytes(buf); err != nil {
+		return
+	}
+	sch.ID = int(id)
+	sch.Spec = string(spec)
+	sch.Queue = string(queue)
+	return
+}
+
+// AddSchedule registers recurring message which the broker adds to the named
+// queue by cron-style schedule specification, e.g. "*/5 * * * *" or
+// "@every 10s". In command mode the data should be valid broker command. It
+// returns schedule ID. The schedule is saved in broker persistent storage
+// and restored when broker restarts, so registering the same schedule again
+// returns ID of registered schedule.
+func (br *Broker) AddSchedule(spec, queue string, data []byte) (id int,
+	err error) {
+
+	s, err := parseCron(spec)
+	if err != nil {
+		return
+	}
+	if br.commandMode() {
+		if _, _, _, _, err = br.ParseCommand(data); err != nil {
+			return
+		}
+	}
+
+	id = br.schedules.add(&schedule{
+		Schedule: Schedule{Spec: spec, Queue: queue, Data: data,
+			Next: s.next(time.Now())},
+		spec: s,
+	})
+	log.Printf(logprefix+"add schedule %d %q to queue %q\n", id, spec, queue)
+	return
+}
+
+// DeleteSchedule removes recurring message schedule by ID.
+func (br *Broker) DeleteSchedule(id int) error {
+	return br.schedules.del(id)
+}
+
+// Schedules returns registered recurring message schedules.
+func (br *Broker) Schedules() []Schedule {
+	return br.schedules.list()
+}
+
+// scheduler moves delayed messages to queues when they become eligible for
+// delivery and adds scheduled messages to queues at schedule time.
+func (br *Broker) scheduler() {
+	defer br.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+
+		// Add eligible delayed messages to queues
+		if br.queues.promote(now) > 0 {
+			br.wakeup()
+		}
+
+		// Add scheduled messages to queues, cluster brokers skip messages of
+		// queues led by other brokers
+		for _, sch := range br.schedules.due(now) {
+			if !br.leads(sch.Queue) {
+				continue
+			}
+			msg := &message{data: sch.Data, queue: sch.Queue}
+			q := br.queues.get(sch.Queue)
+			br.enqueue(q, msg)
+			log.Printf(logprefix+"add queue %q schedule %d message, len %d, "+
+				"queue length: %d\n", q.name, sch.ID, len(msg.data),
+				q.queue.len())
+			br.wakeup()
+		}
+
+		// Sleep until next delayed message or schedule time
+		next := now.Add(time.Hour)
+		if t, ok := br.queues.delayed.next(); ok && t.Before(next) {
+			next = t
+		}
+		if t, ok := br.schedules.next(); ok && t.Before(next) {
+			next = t
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+
+		select {
+		case <-timer.C:
+		case <-br.queues.delayed.wake:
+		case <-br.schedules.wake:
+		case <-br.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Selector module provides consumer selection
+// strategies used by broker to choose consumer which gets next message.
+
+package broker
+
+import (
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// Selector is consumer selection strategy. It is broker attribute, the
+// default strategy is RoundRobin.
+//
+// Select gets ready consumers of a queue, which don't reach their prefetch
+// limit, in round-robin order starting after previously selected consumer
+// and returns index of consumer which gets next message. Negative index means
+// that no consumer selected.
+type Selector interface {
+	Select(consumers []ConsumerInfo) int
+}
+
+// ConsumerInfo contains consumer state used by selection strategy.
+type ConsumerInfo struct {
+	Channel     teomq.Channel // Consumer channel
+	Capacity    int           // Consumer declared capacity, at least 1
+	Outstanding int           // Number of not answered messages
+	Triptime    time.Duration // Consumer channel round-trip time
+}
+
+// RoundRobin selects consumers in turn.
+type RoundRobin struct{}
+
+// LeastOutstanding selects consumer with the least number of not answered
+// messages.
+type LeastOutstanding struct{}
+
+// WeightedCapacity selects consumer with the least ratio of not answered
+// messages to consumer declared capacity, so consumers get messages in
+// proportion to their capacity.
+type WeightedCapacity struct{}
+
+// LowestTriptime selects consumer with the lowest channel round-trip time.
+type LowestTriptime struct{}
+
+// Select selects first consumer.
+func (RoundRobin) Select(consumers []ConsumerInfo) int {
+	if len(consumers) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// Select selects consumer with the least outstanding messages.
+func (LeastOutstanding) Select(consumers []ConsumerInfo) int {
+	return selectMin(consumers, func(a, b ConsumerInfo) bool {
+		return a.Outstanding < b.Outstanding
+	})
+}
+
+// Select selects consumer with the least outstanding messages to capacity
+// ratio.
+func (WeightedCapacity) Select(consumers []ConsumerInfo) int {
+	return selectMin(consumers, func(a, b ConsumerInfo) bool {
+		return a.Outstanding*max(b.Capacity, 1) <
+			b.Outstanding*max(a.Capacity, 1)
+	})
+}
+
+// Select selects consumer with the lowest round-trip time.
+func (LowestTriptime) Select(consumers []ConsumerInfo) int {
+	return selectMin(consumers, func(a, b ConsumerInfo) bool {
+		return a.Triptime < b.Triptime
+	})
+}
+
+// selectMin returns index of the first minimal consumer by less function.
+func selectMin(consumers []ConsumerInfo, less func(a, b ConsumerInfo) bool) (
+	idx int) {
+
+	if len(consumers) == 0 {
+		return -1
+	}
+	for i := range consumers[1:] {
+		if less(consumers[i+1], consumers[idx]) {
+			idx = i + 1
+		}
+	}
+	return
+}
+
+// consumerInfo returns consumer state for selection strategy and true if
+// consumer is ready to get next message: it does not set prefetch or number
+// of its not answered messages is less than prefetch.
+func (br *Broker) consumerInfo(co *consumer) (info ConsumerInfo, ready bool) {
+	info.Channel = co.ch
+	info.Outstanding = br.answers.count(co.ch.Address())
+	info.Capacity = co.hello.CapacityOrDefault()
+	info.Triptime = co.ch.Triptime()
+	ready = co.hello.Prefetch <= 0 || info.Outstanding < co.hello.Prefetch
+	return
+}
@@ -0,0 +1,134 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Storage module provides broker persistent storage
+// interface and helpers to marshal stored records.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Storage is broker persistent storage interface. The broker writes queued
+// messages and pending answer routes to the storage and replays them when
+// the broker is created. If storage is not set in broker.New attributes the
+// broker keeps messages in memory only.
+type Storage interface {
+	// Set adds or replaces record by key.
+	Set(key string, data []byte) error
+	// Del removes record by key.
+	Del(key string) error
+	// Range calls f for each record in keys order until f returns false.
+	Range(f func(key string, data []byte) bool) error
+	// Close flushes and closes storage.
+	Close() error
+}
+
+// Storage keys prefixes
+const (
+	storageQueuePrefix   = "q/"
+	storageAnswersPrefix = "a/"
+	storageDeadPrefix    = "d/"
+	storageDedupPrefix   = "k/"
+	storageSchedPrefix   = "s/"
+)
+
+var ErrWrongRecord = errors.New("wrong storage record")
+
+// memStorage is in-memory storage. It is used by cluster broker without
+// persistent storage to keep replica of leader storage.
+type memStorage struct {
+	m map[string][]byte
+	*sync.RWMutex
+}
+
+// newMemStorage creates a new in-memory storage.
+func newMemStorage() *memStorage {
+	return &memStorage{m: make(map[string][]byte), RWMutex: new(sync.RWMutex)}
+}
+
+// Set adds or replaces record by key.
+func (s *memStorage) Set(key string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.m[key] = bytes.Clone(data)
+	return nil
+}
+
+// Del removes record by key.
+func (s *memStorage) Del(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, key)
+	return nil
+}
+
+// Range calls f for each record in keys order until f returns false.
+func (s *memStorage) Range(f func(key string, data []byte) bool) error {
+	s.RLock()
+	m := maps.Clone(s.m)
+	s.RUnlock()
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		if !f(key, m[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close does nothing.
+func (s *memStorage) Close() error {
+	return nil
+}
+
+// rangePrefix calls f for each storage record with key started from prefix.
+func rangePrefix(st Storage, prefix string,
+	f func(key string, data []byte) error) (err error) {
+
+	rerr := st.Range(func(key string, data []byte) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		err = f(key, data)
+		return err == nil
+	})
+	if err == nil {
+		err = rerr
+	}
+	return
+}
+
+// writeBytes writes length prefixed bytes slice to buffer.
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+	buf.Write(data)
+}
+
+// readBytes reads length prefixed bytes slice from buffer.
+func readBytes(buf *bytes.Buffer) (data []byte, err error) {
+	l, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	if l > uint64(buf.Len()) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	data = make([]byte, l)
+	_, err = buf.Read(data)
+	return
+}
+
+// writeUvarint writes unsigned integer to buffer.
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	buf.Write(binary.AppendUvarint(nil, v))
+}
@@ -0,0 +1,539 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Write-ahead log module provides durable file storage
+// for the broker based on append-only segment files.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncPolicy defines when FileStorage flushes segment file to disk.
+type SyncPolicy byte
+
+const (
+	// SyncAlways calls fsync after each record (default).
+	SyncAlways SyncPolicy = iota
+	// SyncInterval calls fsync periodically, see SyncEvery.
+	SyncInterval
+	// SyncNever leaves flushing to operating system.
+	SyncNever
+)
+
+// SyncEvery sets fsync interval used in SyncInterval policy. The default
+// value is 1 second.
+type SyncEvery time.Duration
+
+// SegmentSize sets maximum segment file size. When active segment reaches
+// this size new segment is started and the log is compacted if it is needed.
+// The default value is 16 MiB.
+type SegmentSize int64
+
+const (
+	walSegmentExt         = ".wal"
+	walTempExt            = ".tmp"
+	walDefaultSegmentSize = 16 << 20
+	walDefaultSyncEvery   = time.Second
+	walRecordHeaderLen    = 8 // length(4) + crc32(4)
+)
+
+// Write-ahead log record operations
+const (
+	walOpSet byte = iota + 1
+	walOpDel
+)
+
+var ErrStorageClosed = errors.New("storage closed")
+
+// FileStorage is write-ahead log storage which keeps records in append-only
+// segment files in directory. FileStorage implements Storage interface.
+type FileStorage struct {
+	dir         string            // segments directory
+	live        map[string][]byte // current records
+	liveSize    int64             // size of current records in log
+	logSize     int64             // size of all segments
+	segments    []int             // segments numbers
+	file        *os.File          // active segment file
+	fileSize    int64             // active segment size
+	policy      SyncPolicy        // sync policy
+	syncEvery   time.Duration     // sync interval
+	segmentSize int64             // max segment size
+	dirty       bool              // active segment has not synced data
+	closed      chan struct{}     // closed when storage closed
+	*sync.Mutex                   // mutex
+}
+
+// NewFileStorage opens or creates write-ahead log storage in directory and
+// replays existing segments.
+//
+// Optional parameters can be passed in the attr parameter:
+//   - SyncPolicy: segment file fsync policy, SyncAlways by default
+//   - SyncEvery: fsync interval in SyncInterval policy
+//   - SegmentSize: maximum segment file size
+func NewFileStorage(dir string, attr ...any) (s *FileStorage, err error) {
+	s = &FileStorage{
+		dir:         dir,
+		live:        make(map[string][]byte),
+		syncEvery:   walDefaultSyncEvery,
+		segmentSize: walDefaultSegmentSize,
+		closed:      make(chan struct{}),
+		Mutex:       new(sync.Mutex),
+	}
+	for _, a := range attr {
+		switch v := a.(type) {
+		case SyncPolicy:
+			s.policy = v
+		case SyncEvery:
+			s.syncEvery = time.Duration(v)
+		case SegmentSize:
+			s.segmentSize = int64(v)
+		}
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err = s.replay(); err != nil {
+		return nil, err
+	}
+	if err = s.openSegment(); err != nil {
+		return nil, err
+	}
+	if s.policy == SyncInterval {
+		go s.syncer()
+	}
+
+	return
+}
+
+// Set adds or replaces record by key.
+func (s *FileStorage) Set(key string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.write(walOpSet, key, data); err != nil {
+		return err
+	}
+	s.setLive(key, data)
+	return s.rotate()
+}
+
+// Del removes record by key.
+func (s *FileStorage) Del(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.live[key]; !ok {
+		return nil
+	}
+	if err := s.write(walOpDel, key, nil); err != nil {
+		return err
+	}
+	s.delLive(key)
+	return s.rotate()
+}
+
+// Range calls f for each record in keys order until f returns false.
+func (s *FileStorage) Range(f func(key string, data []byte) bool) error {
+	s.Lock()
+	keys := make([]string, 0, len(s.live))
+	for k := range s.live {
+		keys = append(keys, k)
+	}
+	s.Unlock()
+
+	slices.Sort(keys)
+	for _, k := range keys {
+		s.Lock()
+		data, ok := s.live[k]
+		s.Unlock()
+		if !ok {
+			continue
+		}
+		if !f(k, data) {
+			break
+		}
+	}
+	return nil
+}
+
+// Len returns number of records in storage.
+func (s *FileStorage) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.live)
+}
+
+// Compact rewrites current records to new segment and removes old segments.
+func (s *FileStorage) Compact() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.compact()
+}
+
+// Close flushes and closes active segment file. Storage without active
+// segment, e.g. after failed compaction, is closed without flush.
+func (s *FileStorage) Close() (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case <-s.closed:
+		return ErrStorageClosed
+	default:
+	}
+	close(s.closed)
+	if s.file == nil {
+		return
+	}
+	if err = s.file.Sync(); err != nil {
+		s.file.Close()
+	} else {
+		err = s.file.Close()
+	}
+	s.file = nil
+	return
+}
+
+// setLive sets copy of record to live map and updates sizes.
+func (s *FileStorage) setLive(key string, data []byte) {
+	if old, ok := s.live[key]; ok {
+		s.liveSize -= walRecordLen(key, old)
+	}
+	s.live[key] = bytes.Clone(data)
+	s.liveSize += walRecordLen(key, data)
+}
+
+// delLive removes record from live map and updates sizes.
+func (s *FileStorage) delLive(key string) {
+	if old, ok := s.live[key]; ok {
+		s.liveSize -= walRecordLen(key, old)
+		delete(s.live, key)
+	}
+}
+
+// write appends record to active segment file.
+func (s *FileStorage) write(op byte, key string, data []byte) (err error) {
+	if s.file == nil {
+		return ErrStorageClosed
+	}
+	rec := walMarshal(op, key, data)
+	if _, err = s.file.Write(rec); err != nil {
+		return
+	}
+	s.fileSize += int64(len(rec))
+	s.logSize += int64(len(rec))
+
+	switch s.policy {
+	case SyncAlways:
+		err = s.file.Sync()
+	case SyncInterval:
+		s.dirty = true
+	}
+	return
+}
+
+// rotate starts new segment when active segment is full and compacts log
+// when it contains more garbage than live records.
+func (s *FileStorage) rotate() (err error) {
+	if s.fileSize < s.segmentSize {
+		return
+	}
+	if s.logSize > 2*s.liveSize {
+		return s.compact()
+	}
+	if err = s.closeSegment(); err != nil {
+		return
+	}
+	return s.openSegment()
+}
+
+// compact writes live records to new segment and removes old segments.
+func (s *FileStorage) compact() (err error) {
+	if s.file == nil {
+		return ErrStorageClosed
+	}
+	if err = s.closeSegment(); err != nil {
+		return
+	}
+	defer func() {
+		// Continue writing to new segment if compaction failed
+		if err != nil && s.file == nil {
+			s.openSegment()
+		}
+	}()
+
+	// Write live records to temporary file
+	num := s.nextSegment()
+	name := s.segmentName(num)
+	tmp, err := os.Create(name + walTempExt)
+	if err != nil {
+		return
+	}
+	keys := make([]string, 0, len(s.live))
+	for k := range s.live {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var size int64
+	for _, k := range keys {
+		rec := walMarshal(walOpSet, k, s.live[k])
+		if _, err = tmp.Write(rec); err != nil {
+			tmp.Close()
+			return
+		}
+		size += int64(len(rec))
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(name+walTempExt, name); err != nil {
+		return
+	}
+	if err = syncDir(s.dir); err != nil {
+		return
+	}
+
+	// Remove old segments
+	for _, n := range s.segments {
+		if err := os.Remove(s.segmentName(n)); err != nil {
+			log.Printf(logprefix+"remove wal segment error: %s\n", err)
+		}
+	}
+	s.segments = []int{num}
+	s.logSize = size
+	s.liveSize = size
+
+	return s.openSegment()
+}
+
+// syncer flushes active segment periodically in SyncInterval policy.
+func (s *FileStorage) syncer() {
+	ticker := time.NewTicker(s.syncEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		s.Lock()
+		if s.dirty && s.file != nil {
+			if err := s.file.Sync(); err != nil {
+				log.Printf(logprefix+"sync wal segment error: %s\n", err)
+			}
+			s.dirty = false
+		}
+		s.Unlock()
+	}
+}
+
+// openSegment creates new active segment file.
+func (s *FileStorage) openSegment() (err error) {
+	num := s.nextSegment()
+	s.file, err = os.OpenFile(s.segmentName(num),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	s.fileSize = 0
+	s.segments = append(s.segments, num)
+	return
+}
+
+// closeSegment flushes and closes active segment file.
+func (s *FileStorage) closeSegment() (err error) {
+	if err = s.file.Sync(); err != nil {
+		return
+	}
+	s.dirty = false
+	err = s.file.Close()
+	s.file = nil
+	return
+}
+
+// syncDir flushes directory to disk, so renamed segment file survives crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// nextSegment returns next segment number.
+func (s *FileStorage) nextSegment() int {
+	if len(s.segments) == 0 {
+		return 1
+	}
+	return s.segments[len(s.segments)-1] + 1
+}
+
+// segmentName returns segment file name by number.
+func (s *FileStorage) segmentName(num int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d%s", num, walSegmentExt))
+}
+
+// replay reads all segments from directory and restores live records.
+// Temporary segment files left by failed compaction are removed.
+func (s *FileStorage) replay() (err error) {
+	tmps, err := filepath.Glob(filepath.Join(s.dir,
+		"*"+walSegmentExt+walTempExt))
+	if err != nil {
+		return
+	}
+	for _, name := range tmps {
+		if err = os.Remove(name); err != nil {
+			return
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+walSegmentExt))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		var num int
+		_, err := fmt.Sscanf(filepath.Base(name), "%08d"+walSegmentExt, &num)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, num)
+	}
+	sort.Ints(s.segments)
+
+	segments := s.segments[:0]
+	for i, num := range s.segments {
+		var empty bool
+		empty, err = s.replaySegment(num, i == len(s.segments)-1)
+		if err != nil {
+			return
+		}
+		if empty {
+			os.Remove(s.segmentName(num))
+			continue
+		}
+		segments = append(segments, num)
+	}
+	s.segments = segments
+
+	return
+}
+
+// replaySegment reads records from segment file. Broken tail of the last
+// segment, which may be written when the broker crashed, is truncated.
+// Returns true if segment is empty.
+func (s *FileStorage) replaySegment(num int, last bool) (empty bool,
+	err error) {
+
+	name := s.segmentName(num)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		empty = true
+		return
+	}
+
+	var offset int
+	for offset < len(data) {
+		op, key, value, n, err := walUnmarshal(data[offset:])
+		if err != nil {
+			if !last {
+				return false, fmt.Errorf("%s: %w", name, err)
+			}
+			log.Printf(logprefix+"truncate wal segment %s at %d: %s\n",
+				name, offset, err)
+			s.logSize += int64(offset)
+			return offset == 0, os.Truncate(name, int64(offset))
+		}
+		switch op {
+		case walOpSet:
+			s.setLive(key, value)
+		case walOpDel:
+			s.delLive(key)
+		}
+		offset += n
+	}
+	s.logSize += int64(offset)
+
+	return
+}
+
+// walRecordLen returns length of set record in write-ahead log.
+func walRecordLen(key string, data []byte) int64 {
+	return int64(walRecordHeaderLen + 1 +
+		len(binary.AppendUvarint(nil, uint64(len(key)))) + len(key) +
+		len(binary.AppendUvarint(nil, uint64(len(data)))) + len(data))
+}
+
+// walMarshal marshals write-ahead log record:
+// length(4) | crc32(4) | op(1) | key length | key | data length | data
+func walMarshal(op byte, key string, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(op)
+	writeBytes(buf, []byte(key))
+	writeBytes(buf, data)
+	payload := buf.Bytes()
+
+	rec := make([]byte, walRecordHeaderLen, walRecordHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	return append(rec, payload...)
+}
+
+// walUnmarshal unmarshals write-ahead log record and returns its length.
+func walUnmarshal(rec []byte) (op byte, key string, data []byte, n int,
+	err error) {
+
+	if len(rec) < walRecordHeaderLen {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	l := int(binary.LittleEndian.Uint32(rec[0:]))
+	if len(rec) < walRecordHeaderLen+l {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	payload := rec[walRecordHeaderLen : walRecordHeaderLen+l]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(rec[4:]) {
+		err = ErrWrongRecord
+		return
+	}
+
+	buf := bytes.NewBuffer(payload)
+	if op, err = buf.ReadByte(); err != nil {
+		return
+	}
+	k, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+	if data, err = readBytes(buf); err != nil {
+		return
+	}
+	key = string(k)
+	n = walRecordHeaderLen + l
+
+	return
+}
@@ -0,0 +1,281 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+func TestFileStorage(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// Create storage and add records
+	st, err := NewFileStorage(dir)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+	st.Set("k1", []byte("v1"))
+	st.Set("k2", []byte("v2"))
+	st.Set("k3", []byte("v3"))
+	st.Del("k2")
+	st.Close()
+
+	// Reopen storage and check records replayed
+	st, err = NewFileStorage(dir)
+	if err != nil {
+		t.Error("can't reopen storage:", err)
+		return
+	}
+	var keys []string
+	st.Range(func(key string, data []byte) bool {
+		keys = append(keys, key+"="+string(data))
+		return true
+	})
+	if len(keys) != 2 || keys[0] != "k1=v1" || keys[1] != "k3=v3" {
+		t.Error("wrong records after replay:", keys)
+		return
+	}
+
+	// Compact storage and check only one segment left
+	if err = st.Compact(); err != nil {
+		t.Error("can't compact storage:", err)
+		return
+	}
+	st.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if len(segments) != 2 {
+		t.Error("wrong number of segments after compaction:", segments)
+		return
+	}
+
+	// Write broken record tail and check it truncated on replay
+	f, _ := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{10, 0, 0, 0, 1, 2})
+	f.Close()
+	st, err = NewFileStorage(dir)
+	if err != nil {
+		t.Error("can't reopen storage with broken tail:", err)
+		return
+	}
+	if st.Len() != 2 {
+		t.Error("wrong number of records after truncate:", st.Len())
+		return
+	}
+	st.Close()
+
+	// Stale temporary segment should be removed on open
+	tmp := filepath.Join(dir, "00000009"+walSegmentExt+walTempExt)
+	os.WriteFile(tmp, []byte{1, 2, 3}, 0644)
+	if st, err = NewFileStorage(dir); err != nil {
+		t.Error("can't reopen storage with temporary segment:", err)
+		return
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("temporary segment was not removed:", err)
+		return
+	}
+
+	// Record should not be changed by caller after it is set
+	data := []byte("v4")
+	st.Set("k4", data)
+	data[1] = '5'
+	st.Range(func(key string, v []byte) bool {
+		if key == "k4" && string(v) != "v4" {
+			t.Errorf("record changed by caller: %q", v)
+		}
+		return true
+	})
+
+	// Storage without active segment should be closed
+	st.file.Close()
+	st.file = nil
+	if err = st.Close(); err != nil {
+		t.Error("can't close storage without segment:", err)
+		return
+	}
+	select {
+	case <-st.closed:
+	default:
+		t.Error("storage closed channel is not closed")
+		return
+	}
+	if err = st.Close(); err != ErrStorageClosed {
+		t.Errorf("wrong error %v, expected %v", err, ErrStorageClosed)
+		return
+	}
+}
+
+func TestQueueStorage(t *testing.T) {
+
+	st, err := NewFileStorage(t.TempDir(), SyncNever)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+
+	// Add messages to queues and remove first
+	q := newQueues(st)
+	q.get("q1").set(&message{from: "p-addr-1", id: 1, data: []byte("m1"),
+		queue: "q1"})
+	m2 := &message{from: "p-addr-2", id: 2, data: []byte("m2"), queue: "q1"}
+	q.get("q1").set(m2)
+	q.get("q2").set(&message{from: "p-addr-3", id: 3, data: []byte("m3"),
+		queue: "q2"})
+	q.get("q1").queue.get()
+
+	// Restore queues from storage
+	q = newQueues(st)
+	if err = q.load(nil); err != nil {
+		t.Error("can't load queues:", err)
+		return
+	}
+	if q.len() != 2 || q.get("q2").queue.len() != 1 || q.seq.Load() != 3 {
+		t.Error("wrong restored queues")
+		return
+	}
+	m, _, err := q.get("q1").queue.get()
+	if err != nil || m.from != "p-addr-2" || m.id != 2 || string(m.data) != "m2" {
+		t.Error("wrong restored message", m, err)
+		return
+	}
+
+	// Restored message should keep time when it was added to queue
+	if !m.added.Equal(m2.added) {
+		t.Errorf("wrong restored message added time %s, expected %s",
+			m.added, m2.added)
+		return
+	}
+}
+
+func TestBrokerRestartDelayed(t *testing.T) {
+
+	// Run broker with persistent storage and add delayed message
+	dir := t.TempDir()
+	st, err := NewFileStorage(dir, SyncNever)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+	br, err := New("broker", st, teomq.NewLoopback().Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	m := &message{from: "p-addr-1", id: 1, data: []byte("m1")}
+	m.setDelay(time.Hour, time.Time{})
+	br.queues.get(DefaultQueue).set(m)
+	br.Close()
+
+	// Restarted broker should keep message delayed
+	if st, err = NewFileStorage(dir, SyncNever); err != nil {
+		t.Error("can't open storage:", err)
+		return
+	}
+	br, err = New("broker", st, teomq.NewLoopback().Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	if br.DelayedLen() != 1 || br.QueueLen(DefaultQueue) != 0 {
+		t.Error("wrong restored delayed message", br.DelayedLen(),
+			br.QueueLen(DefaultQueue))
+		return
+	}
+	if _, _, err = br.queues.get(DefaultQueue).queue.get(); err == nil {
+		t.Error("delayed message was taken")
+		return
+	}
+}
+
+func TestBrokerRestartSchedule(t *testing.T) {
+
+	// Run broker with persistent storage and add schedule
+	dir := t.TempDir()
+	st, err := NewFileStorage(dir, SyncNever)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+	br, err := New("broker", st, teomq.NewLoopback().Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	id, err := br.AddSchedule("@every 50ms", "jobs", []byte("tick"))
+	if err != nil {
+		t.Error("can't add schedule:", err)
+		return
+	}
+	br.Close()
+
+	// Restarted broker should restore schedule, the same schedule should not
+	// be registered twice
+	restart := func() bool {
+		if st, err = NewFileStorage(dir, SyncNever); err != nil {
+			t.Error("can't open storage:", err)
+			return false
+		}
+		br, err = New("broker", st, teomq.NewLoopback().Transport("broker"))
+		if err != nil {
+			t.Error("can't create broker:", err)
+			return false
+		}
+		return true
+	}
+	if !restart() {
+		return
+	}
+	if l := br.Schedules(); len(l) != 1 || l[0].ID != id ||
+		l[0].Spec != "@every 50ms" || string(l[0].Data) != "tick" {
+		t.Error("wrong restored schedules", l)
+		br.Close()
+		return
+	}
+	if id2, _ := br.AddSchedule("@every 50ms", "jobs",
+		[]byte("tick")); id2 != id || len(br.Schedules()) != 1 {
+		t.Errorf("schedule registered twice with id %d", id2)
+		br.Close()
+		return
+	}
+
+	// Restored schedule should add messages to queue
+	for i := 0; br.QueueLen("jobs") == 0; i++ {
+		if i == 100 {
+			t.Error("schedule message was not added to queue")
+			br.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Deleted schedule should not add messages and should not be restored
+	if err = br.DeleteSchedule(id); err != nil {
+		t.Error("can't delete schedule:", err)
+		br.Close()
+		return
+	}
+	time.Sleep(10 * time.Millisecond)
+	n := br.QueueLen("jobs")
+	time.Sleep(150 * time.Millisecond)
+	if l := br.QueueLen("jobs"); l != n {
+		t.Errorf("deleted schedule added messages, queue length %d, "+
+			"expected %d", l, n)
+		br.Close()
+		return
+	}
+	br.Close()
+	if !restart() {
+		return
+	}
+	defer br.Close()
+	if l := br.Schedules(); len(l) != 0 {
+		t.Error("deleted schedule was restored", l)
+		return
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/broker"
 	"github.com/teonet-go/teonet"
 )
@@ -27,6 +30,9 @@ func main() {
 	// Parse application flags
 	var nomsg = flag.Bool("nomsg", false, "don't show log messages")
 	var stat = flag.Bool("stat", false, "show statistics")
+	var wal = flag.String("wal", "", "directory of durable queue storage")
+	var cluster = flag.String("cluster", "",
+		"comma separated addresses of cluster brokers")
 	flag.Parse()
 
 	// Don't show log messages
@@ -40,8 +46,26 @@ func main() {
 		attr = append(attr, teonet.Stat(true))
 	}
 
+	// Set durable queue storage
+	if len(*wal) > 0 {
+		storage, err := broker.NewFileStorage(*wal)
+		if err != nil {
+			panic("can't open queue storage, error: " + err.Error())
+		}
+		attr = append(attr, storage)
+	}
+
+	// Set cluster brokers
+	if len(*cluster) > 0 {
+		attr = append(attr, broker.Cluster(strings.Split(*cluster, ",")))
+	}
+
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages broker
-	teo, err := broker.New(appShort, attr...)
+	teo, err := broker.NewContext(ctx, appShort, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
@@ -50,5 +74,7 @@ func main() {
 	addr := teo.Address()
 	fmt.Println("Connected to Teonet, this app address:", addr)
 
-	select {}
+	// Wait signal and close broker
+	<-ctx.Done()
+	teo.Close()
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/consumer"
 	"github.com/teonet-go/teonet"
 )
@@ -30,6 +32,9 @@ func main() {
 	var nomsg = flag.Bool("nomsg", false, "don't show log messages")
 	var broker = flag.String("broker", "", "broker address")
 	var stat = flag.Bool("stat", false, "show statistics")
+	var queue = flag.String("queue", "", "broker queue name")
+	var prefetch = flag.Int("prefetch", consumer.DefaultPrefetch,
+		"max number of not answered messages")
 	flag.Parse()
 
 	// Check requered parameter -broker
@@ -54,15 +59,24 @@ func main() {
 	if *stat {
 		attr = append(attr, teonet.Stat(true))
 	}
+	if len(*queue) > 0 {
+		attr = append(attr, consumer.Queues{*queue})
+	}
+	attr = append(attr, consumer.Prefetch(*prefetch))
 
 	// Create messages consumer reader callback function
-	reader := func(p *teonet.Packet) (answer []byte, err error) {
-		log.Printf("process message %s, from %s\n",string(p.Data()), p.From())
+	reader := func(p *consumer.Packet) (answer []byte, err error) {
+		log.Printf("process message %s, from %s, deliveries %d\n",
+			string(p.Data()), p.From(), p.Deliveries())
 		return []byte("Answer to " + string(p.Data())), nil
 	}
 
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages consumer
-	teo, err := consumer.New(short, *broker, reader, attr...)
+	teo, err := consumer.NewContext(ctx, short, *broker, reader, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
@@ -71,5 +85,7 @@ func main() {
 	addr := teo.Teonet.Address()
 	fmt.Println("Connected to Teonet, this app address:", addr)
 
-	select {}
+	// Wait signal and close consumer
+	<-ctx.Done()
+	teo.Close()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/producer"
 	"github.com/teonet-go/teonet"
 )
@@ -32,6 +34,10 @@ func main() {
 	var nomsg = flag.Bool("nomsg", false, "don't show log messages")
 	var broker = flag.String("broker", "", "broker address")
 	var stat = flag.Bool("stat", false, "show statistics")
+	var queue = flag.String("queue", "", "broker queue name")
+	var key = flag.String("key", "", "messages routing key")
+	var outbox = flag.Int("outbox", 0, "outbox size, messages are queued in "+
+		"outbox while broker is unreachable")
 	flag.Parse()
 
 	// Check requered parameter -broker
@@ -57,12 +63,21 @@ func main() {
 		attr = append(attr, teonet.Stat(true))
 	}
 
+	// Queue messages in outbox while broker is unreachable
+	if *outbox > 0 {
+		attr = append(attr, producer.OutboxSize(*outbox))
+	}
+
 	// Add custom Reader to process additional info or process messages without
 	// answer callback function
 	attr = append(attr, reader)
 
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages producer
-	prod, err := producer.New(short, *broker, attr...)
+	prod, err := producer.NewContext(ctx, short, *broker, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
@@ -72,7 +87,7 @@ func main() {
 	fmt.Println("Connected to Teonet, this app address:", addr)
 
 	// Message sender
-	for i := 1; ; i++ {
+	for i := 1; ctx.Err() == nil; i++ {
 
 		// Make message to send
 		data := []byte(fmt.Sprintf("Hello wold #%d!", i))
@@ -88,7 +103,8 @@ func main() {
 		}
 
 		// Send message to broker
-		id, err := prod.Send(data, answer)
+		id, err := prod.Send(data, answer, producer.Queue(*queue),
+			producer.Key(*key))
 		if err != nil {
 			fmt.Printf("send to error: %s\n", err)
 			time.Sleep(1 * time.Second)
@@ -98,6 +114,9 @@ func main() {
 
 		time.Sleep(time.Microsecond * time.Duration(*delay))
 	}
+
+	// Close producer when signal received
+	prod.Close()
 }
 
 // reader is Producer teonet main reader connected to brokers peer
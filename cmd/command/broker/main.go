@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 
 	"github.com/kirill-scherba/command/v2"
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/broker"
 	"github.com/teonet-go/teonet"
 )
@@ -44,8 +46,12 @@ func main() {
 	// Add broker commands
 	attr = append(attr, Commands)
 
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages broker
-	teo, err := broker.New(appShort, attr...)
+	teo, err := broker.NewContext(ctx, appShort, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
@@ -54,7 +60,9 @@ func main() {
 	addr := teo.Address()
 	fmt.Println("Connected to Teonet, this app address:", addr)
 
-	select {}
+	// Wait signal and close broker
+	<-ctx.Done()
+	teo.Close()
 }
 
 // Commands adds available broker commands.
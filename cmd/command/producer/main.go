@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/producer"
 	"github.com/teonet-go/teonet"
 )
@@ -64,8 +66,12 @@ func main() {
 	// Set producer command schema
 	attr = append(attr, producer.CommandMode(true))
 
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages producer
-	prod, err := producer.New(short, *broker, attr...)
+	prod, err := producer.NewContext(ctx, short, *broker, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
@@ -75,33 +81,34 @@ func main() {
 	fmt.Println("Connected to Teonet, this app address:", addr)
 
 	// Message sender
-	for i := 1; ; i++ {
+	for i := 1; ctx.Err() == nil; i++ {
 
 		// Make message to send
 		data := []byte("version/some_data")
 
-		// Answer callback function
+		// Send command to broker and gather answers of all consumers
 		t := time.Now()
-		answer := func(id int, data []byte, err error) bool {
-			if err != nil {
-				log.Printf("message id %d removed from answers queue\n", id)
-				return true
+		log.Printf("send command: %s\n", string(data))
+		replies, err := prod.Gather(ctx, data)
+		for _, r := range replies {
+			if r.Err != nil {
+				log.Printf("recv error   from %s: %s\n", r.From, r.Err)
+				continue
 			}
-			log.Printf("recv answer  id %d: %s, time: %v\n", id, data, time.Since(t))
-			return true
+			log.Printf("recv answer  from %s: %s, time: %v\n", r.From, r.Data,
+				time.Since(t))
 		}
-
-		// Send message to broker
-		id, err := prod.Send(data, answer)
 		if err != nil {
-			fmt.Printf("send to error: %s\n", err)
+			fmt.Printf("gather error: %s\n", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		log.Printf("send message id %d: %s\n", id, string(data))
 
 		time.Sleep(time.Microsecond * time.Duration(*delay))
 	}
+
+	// Close producer when signal received
+	prod.Close()
 }
 
 // reader is Producer teonet main reader connected to brokers peer
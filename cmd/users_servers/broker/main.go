@@ -2,12 +2,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 
 	"github.com/kirill-scherba/command/v2"
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/broker"
 	"github.com/teonet-go/teonet"
 )
@@ -29,6 +32,8 @@ func main() {
 	// Parse application flags
 	var nomsg = flag.Bool("nomsg", false, "don't show log messages")
 	var stat = flag.Bool("stat", false, "show statistics")
+	var schedule = flag.String("schedule", "",
+		"recurring command: cron spec and command, e.g. \"@every 5s num_players/10\"")
 	flag.Parse()
 
 	// Don't show log messages
@@ -45,12 +50,29 @@ func main() {
 	// Add broker commands
 	attr = append(attr, Commands)
 
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages broker
-	teo, err := broker.New(appShort, attr...)
+	teo, err := broker.NewContext(ctx, appShort, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
 
+	// Add recurring command schedule
+	if len(*schedule) > 0 {
+		i := strings.LastIndex(*schedule, " ")
+		if i < 0 {
+			panic("wrong schedule: " + *schedule)
+		}
+		_, err := teo.AddSchedule((*schedule)[:i], broker.DefaultQueue,
+			[]byte((*schedule)[i+1:]))
+		if err != nil {
+			panic("can't add schedule, error: " + err.Error())
+		}
+	}
+
 	// Add API commands
 	ApiCommands(teo)
 
@@ -59,7 +81,9 @@ func main() {
 	fmt.Println("Connected to Teonet, this app address:", addr)
 	fmt.Println()
 
-	select {}
+	// Wait signal and close broker
+	<-ctx.Done()
+	teo.Close()
 }
 
 // Commands adds available broker commands.
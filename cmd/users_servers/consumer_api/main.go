@@ -4,6 +4,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"os"
 
 	"github.com/kirill-scherba/command/v2"
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/consumer"
 	"github.com/teonet-go/teonet"
 )
@@ -68,8 +70,12 @@ func main() {
 		attr = append(attr, consumer.API(true))
 	}
 
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages consumer
-	teo, err := consumer.New(short, *broker, nil, attr...)
+	teo, err := consumer.NewContext(ctx, short, *broker, nil, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
@@ -78,7 +84,9 @@ func main() {
 	addr := teo.Teonet.Address()
 	fmt.Println("Connected to Teonet, this app address:", addr)
 
-	select {}
+	// Wait signal and close consumer
+	<-ctx.Done()
+	teo.Close()
 }
 
 // Commands adds available broker commands.
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +12,7 @@ import (
 
 	"math/rand/v2"
 
+	"github.com/teonet-go/teomq"
 	"github.com/teonet-go/teomq/producer"
 	"github.com/teonet-go/teonet"
 )
@@ -58,8 +60,12 @@ func main() {
 	// Set producer command schema
 	attr = append(attr, producer.CommandMode(true))
 
+	// Close application on Ctrl+C or SIGTERM signal
+	ctx, stop := teomq.SignalContext(context.Background())
+	defer stop()
+
 	// Create and start new Teonet messages producer
-	prod, err := producer.New(short, *broker, attr...)
+	prod, err := producer.NewContext(ctx, short, *broker, attr...)
 	if err != nil {
 		panic("can't connect to Teonet, error: " + err.Error())
 	}
@@ -72,7 +78,7 @@ func main() {
 	r2 := rand.New(s2)
 
 	// Send messages to broker
-	for {
+	for ctx.Err() == nil {
 
 		// Generate random value 1..100
 		value := r2.IntN(100) + 1
@@ -87,4 +93,7 @@ func main() {
 		// Sleep
 		time.Sleep(time.Microsecond * time.Duration(*delay))
 	}
+
+	// Close producer when signal received
+	prod.Close()
 }
@@ -6,30 +6,88 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"slices"
+	"sync"
 
 	"github.com/kirill-scherba/command/v2"
 	"github.com/teonet-go/teomq"
+	"github.com/teonet-go/teomq/subscribers"
 	"github.com/teonet-go/teonet"
 )
 
 const logprefix = "consumer: "
 
+// ErrAPITransport is returned by API if consumer does not use teonet
+// transport.
+var ErrAPITransport = errors.New("broker api requires teonet transport")
+
+// ErrReject is returned (or wrapped) by ProcessMessage to reject message. The
+// rejected message is not redelivered and moves to brokers dead-letter queue.
+var ErrReject = errors.New("message rejected")
+
 // Consumer is Teonet messages queue consumer type.
 type Consumer struct {
 	*teonet.Teonet
 	*teonet.APIClient
 	ProcessMessage
 	*command.Commands
+	transport teomq.Transport
+	failover  *teomq.Failover // brokers addresses and current broker
+	queues    Queues
+	topics    Topics
+	prefetch  Prefetch
+	capacity  Capacity
+	sem       chan struct{}      // limits number of concurrently processed messages
+	ctx       context.Context    // consumer context, done when closed
+	cancel    context.CancelFunc // cancels consumer context
+	wg        sync.WaitGroup     // messages processing goroutines
+	stopping  bool               // shutdown started
+	mut       sync.Mutex         // protects stopping and wg.Add
+	closeOnce sync.Once
+	closeErr  error
 }
 
-type ProcessMessage func(p *teonet.Packet) (answer []byte, err error)
+// ProcessMessage is consumer message processor callback function. It gets
+// message received from broker and returns answer which will be sent to
+// producer. If it returns error the message will be redelivered, if it
+// returns ErrReject the message moves to brokers dead-letter queue. If it
+// returns teomq.RemoteError the message is not redelivered and the error is
+// sent to producer in error answer.
+type ProcessMessage func(p *Packet) (answer []byte, err error)
 
 type API bool
 
+// Queues is consumer attribute with names of broker queues served by
+// consumer. Consumer without this attribute serves the default queue.
+type Queues []string
+
+// Prefetch is consumer attribute with maximum number of messages which broker
+// sends to consumer before it answers or acknowledges them. It also limits
+// number of messages processed by consumer concurrently. The default value is
+// DefaultPrefetch.
+type Prefetch int
+
+// DefaultPrefetch is default consumer prefetch.
+const DefaultPrefetch = 64
+
+// Capacity is consumer attribute with consumer capacity relative to other
+// consumers of the queue. Broker with WeightedCapacity selection strategy
+// sends messages to consumers in proportion to their capacity. The default
+// capacity is equal to prefetch.
+type Capacity int
+
+// Topics is consumer attribute with broker command topics the consumer
+// subscribes to in command mode. Topics are hierarchical command names, e.g.
+// game.eu.num_players, and may contain wildcards: '*' matches one topic
+// segment and '#' matches zero or more segments, e.g. game.*.num_players or
+// game.#.
+type Topics []string
+
 // New creates a new Teonet MQueue Consumer object.
 //
 // Args:
@@ -37,8 +95,13 @@ type API bool
 //	appShort: teonet application short name
 //	broker: broker address
 //	reader: consumer message processor callback function:
-//	        func(p *teonet.Packet) ([]byte, error)
-//	attr: teonet application attributes
+//	        func(p *consumer.Packet) ([]byte, error)
+//	attr: teonet application attributes and consumer attributes:
+//	      API, Queues, Prefetch, Capacity, Topics, func(*command.Commands),
+//	      teomq.Transport, teomq.Brokers; teonet application attributes are
+//	      not used and embedded Teonet is nil if transport is set. Consumer
+//	      fails over to teomq.Brokers standby brokers when connected broker
+//	      disconnects
 //
 // Returns:
 //
@@ -46,12 +109,18 @@ type API bool
 //	error: error if occurred
 func New(appShort, broker string, reader ProcessMessage, attr ...any) (
 	co *Consumer, err error) {
+	return NewContext(context.Background(), appShort, broker, reader, attr...)
+}
+
+// NewContext creates a new Teonet MQueue Consumer object which is closed when
+// context done. See New for arguments description.
+func NewContext(ctx context.Context, appShort, broker string,
+	reader ProcessMessage, attr ...any) (co *Consumer, err error) {
 
 	// Create new consumer object and connect to teonet
 	co = new(Consumer)
-
-	// Append custom Reader to teonet application attributes
-	attr = append(attr, co.reader)
+	co.ctx, co.cancel = context.WithCancel(ctx)
+	co.failover, attr = teomq.NewFailover(broker, attr...)
 
 	// Add consumer commands in command schema
 	attr = co.addCommands(attr...)
@@ -59,42 +128,112 @@ func New(appShort, broker string, reader ProcessMessage, attr ...any) (
 	// Get connectAPI attribute
 	attr, connectAPI := co.addAPI(attr...)
 
-	// Connect to teonet
-	co.Teonet, err = teomq.NewTeonet(appShort, attr...)
+	// Get queues, topics, prefetch and capacity attributes
+	attr = co.addQueues(attr...)
+	attr = co.addTopics(attr...)
+	attr = co.addPrefetch(attr...)
+
+	// Connect to teonet or get transport from attributes
+	co.transport, co.Teonet, err = teomq.NewTransport(co.ctx, appShort,
+		co.reader, attr...)
 	if err != nil {
+		co.cancel()
 		return
 	}
 
 	// Add custom Reader if it exists in attributes
 	co.ProcessMessage = reader
 
-	// Subscribe to broker commands when connected to broker
-	co.Teonet.WhenConnectedTo(broker, func() {
-		go func() {
-			// Add teonet api interface
-			if connectAPI {
-				co.API(broker)
-			}
+	// Subscribe to broker commands when connected to broker, consumer
+	// subscribes again when it fails over to standby broker
+	for _, broker := range co.failover.Brokers() {
+		co.transport.WhenConnectedTo(broker, func() {
+			go func() {
+				// Add teonet api interface
+				if connectAPI {
+					co.API(broker)
+				}
 
-			// Subscribe to broker commands in command mode
-			if co.Commands != nil {
-				err = co.subscribeCommands(broker)
-			}
-		}()
-	})
+				// Subscribe to broker commands and topics in command mode
+				co.subscribeAll(broker)
+			}()
+		})
+	}
 
 	// Connect to broker
-	err = teomq.ConnectToBroker(co.Teonet, broker)
+	err = co.failover.Connect(co.transport)
 	if err != nil {
+		co.Close()
 		return
 	}
+	context.AfterFunc(co.ctx, func() { co.Close() })
 
 	return
 }
 
+// Close stops receiving messages from broker and closes consumer transport.
+// Messages which are processed now are not answered, broker redelivers them.
+func (co *Consumer) Close() error {
+	co.closeOnce.Do(func() {
+		co.stop()
+		co.cancel()
+		co.closeErr = co.transport.Close()
+	})
+	return co.closeErr
+}
+
+// Shutdown gracefully shuts down consumer. It waits until messages which are
+// processed now are answered and closes consumer, new messages received
+// during shutdown are returned to broker. If context done before, consumer
+// is closed and context error is returned.
+func (co *Consumer) Shutdown(ctx context.Context) error {
+	co.stop()
+	done := make(chan struct{})
+	go func() {
+		co.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		co.Close()
+		return ctx.Err()
+	}
+	return co.Close()
+}
+
+// stop stops processing of new messages.
+func (co *Consumer) stop() {
+	co.mut.Lock()
+	defer co.mut.Unlock()
+	co.stopping = true
+}
+
+// start adds message processing goroutine to wait group, it returns false
+// if consumer is stopping.
+func (co *Consumer) start() bool {
+	co.mut.Lock()
+	defer co.mut.Unlock()
+	if co.stopping {
+		return false
+	}
+	co.wg.Add(1)
+	return true
+}
+
+// Address returns consumer address.
+func (co *Consumer) Address() string {
+	return co.transport.Address()
+}
+
 // API connects to brokers api.
 func (co *Consumer) API(broker string) (err error) {
 
+	if co.Teonet == nil {
+		err = ErrAPITransport
+		log.Println(logprefix+"can't connect to broker api, error:", err)
+		return
+	}
 	co.APIClient, err = co.Teonet.NewAPIClient(broker)
 	if err != nil {
 		log.Println(logprefix+"can't connect to broker api, error:", err)
@@ -105,6 +244,18 @@ func (co *Consumer) API(broker string) (err error) {
 	return
 }
 
+// Subscribe subscribes consumer to broker command topic. The topic may contain
+// wildcards, see Topics.
+func (co *Consumer) Subscribe(topic string) error {
+	return co.subscribe(co.failover.Broker(), topic)
+}
+
+// Unsubscribe unsubscribes consumer from broker command topic.
+func (co *Consumer) Unsubscribe(topic string) error {
+	return co.send(co.failover.Broker(),
+		fmt.Appendf(nil, "%s/%s", subscribers.CmdUnsubscribe, topic))
+}
+
 // subscribe subscribe to brokers command.
 //
 // Args:
@@ -117,15 +268,19 @@ func (co *Consumer) API(broker string) (err error) {
 //	error: error if occurred
 func (co *Consumer) subscribe(broker, command string) (err error) {
 	// Send subscribe command to broker
-	data := fmt.Appendf(nil, "subscribe/%s", command)
+	data := fmt.Appendf(nil, "%s/%s", subscribers.CmdSubscribe, command)
+	return co.send(broker, data)
+}
 
+// send sends data to broker directly or using API.
+func (co *Consumer) send(broker string, data []byte) (err error) {
 	if co.APIClient == nil {
 		// Send to broker directly
-		co.Teonet.SendTo(broker, data)
+		_, err = co.transport.SendTo(broker, data)
 		return
 	}
 	// Send to broker using API
-	co.APIClient.SendTo("msg", data)
+	_, err = co.APIClient.SendTo("msg", data)
 	return
 }
 
@@ -187,6 +342,72 @@ func (co *Consumer) addAPI(attr ...any) (outattr []any, ok bool) {
 	return
 }
 
+// addQueues adds queues served by consumer.
+//
+// If Queues attribute is found in attributes list, it is removed from list
+// and queues are set to consumer.
+func (co *Consumer) addQueues(attr ...any) (outattr []any) {
+	for _, v := range attr {
+		switch v := v.(type) {
+		case Queues:
+			co.queues = append(co.queues, v...)
+		default:
+			outattr = append(outattr, v)
+		}
+	}
+	return
+}
+
+// addTopics adds command topics subscribed by consumer.
+//
+// If Topics attribute is found in attributes list, it is removed from list
+// and topics are set to consumer.
+func (co *Consumer) addTopics(attr ...any) (outattr []any) {
+	for _, v := range attr {
+		switch v := v.(type) {
+		case Topics:
+			co.topics = append(co.topics, v...)
+		default:
+			outattr = append(outattr, v)
+		}
+	}
+	return
+}
+
+// addPrefetch adds consumer prefetch and capacity.
+//
+// If Prefetch or Capacity attribute is found in attributes list, it is
+// removed from list and set to consumer. DefaultPrefetch is used if prefetch
+// attribute is not found.
+func (co *Consumer) addPrefetch(attr ...any) (outattr []any) {
+	co.prefetch = DefaultPrefetch
+	for _, v := range attr {
+		switch v := v.(type) {
+		case Prefetch:
+			if v > 0 {
+				co.prefetch = v
+			}
+		case Capacity:
+			co.capacity = v
+		default:
+			outattr = append(outattr, v)
+		}
+	}
+	co.sem = make(chan struct{}, co.prefetch)
+	return
+}
+
+// subscribeAll subscribes to brokers commands in command mode and to
+// command topics.
+func (co *Consumer) subscribeAll(broker string) {
+	if co.Commands != nil {
+		co.subscribeCommands(broker)
+	}
+	for _, topic := range co.topics {
+		co.subscribe(broker, topic)
+	}
+}
+
 // subscribeCommands subscribe to brokers commands.
 func (co *Consumer) subscribeCommands(broker string) (err error) {
 	for command := range co.Iter() {
@@ -195,40 +416,78 @@ func (co *Consumer) subscribeCommands(broker string) (err error) {
 	return
 }
 
-// sendAnswer send answer to message received from broker
-func (co *Consumer) sendAnswer(pac *teonet.Packet, data []byte) (err error) {
-	data, err = teomq.NewPacket(uint32(pac.ID()), data).MarshalBinary()
+// sendAnswer send answer to message received from broker. The answer header
+// contains correlation id and trace context of message header.
+func (co *Consumer) sendAnswer(pac *Packet, data []byte) error {
+	return co.sendPacket(pac, teomq.NewPacket(uint32(pac.ID()), data))
+}
+
+// sendError send error answer to message received from broker.
+func (co *Consumer) sendError(pac *Packet, e *teomq.RemoteError) error {
+	return co.sendPacket(pac, teomq.NewPacket(uint32(pac.ID()), nil).
+		SetError(e))
+}
+
+// sendPacket send answer packet to message received from broker.
+func (co *Consumer) sendPacket(pac *Packet, ans *teomq.Packet) (err error) {
+	data, err := ans.SetHeader(pac.AnswerHeader()).MarshalBinary()
 	if err != nil {
 		return
 	}
 	if co.APIClient == nil {
-		_, err = co.Teonet.SendTo(pac.From(), data)
+		_, err = co.transport.SendTo(pac.From(), data)
 		return
 	}
 	_, err = co.APIClient.SendTo("msg", data)
 	return
 }
 
-// reader is Consumer teonet main reader connected to brokers peer
-// and process incoming teonet messages
-func (co *Consumer) reader(c *teonet.Channel, p *teonet.Packet,
-	e *teonet.Event) bool {
+// sendAck send acknowledge command to message received from broker. The cmd
+// parameter is teomq.CmdAck or teomq.CmdNack.
+func (co *Consumer) sendAck(pac *Packet, cmd string) (err error) {
+	data := teomq.AckCommand(cmd, pac.ID())
+	if co.APIClient == nil {
+		_, err = co.transport.SendTo(pac.From(), data)
+	} else {
+		_, err = co.APIClient.SendTo("msg", data)
+	}
+	if err != nil {
+		log.Printf(logprefix+"send %s id %d error: %s\n", cmd, pac.ID(), err)
+	}
+	return
+}
+
+// reader is Consumer main transport reader connected to brokers peer
+// and process incoming messages
+func (co *Consumer) reader(c teomq.Channel, p teomq.Payload,
+	e teomq.Event) bool {
+
+	// Skip events of closed consumer
+	if co.ctx.Err() != nil {
+		return false
+	}
 
 	// On connected
-	if e.Event == teonet.EventConnected {
+	if e == teomq.EventConnected {
 		log.Printf(logprefix+"connected to %s\n", c)
-		c.Send(teomq.ConsumerHello)
+		c.Send(co.hello())
 		return false
 	}
 
-	// On disconnected
-	if e.Event == teonet.EventDisconnected {
+	// On disconnected fail over to standby broker
+	if e == teomq.EventDisconnected {
 		log.Printf(logprefix+"disconnected from %s\n", c)
+		co.failover.Switch(co.ctx, co.transport, c.Address(),
+			func(broker string) {
+				log.Printf(logprefix+"fail over to broker %s\n", broker)
+				co.rejoin(broker)
+			},
+		)
 		return false
 	}
 
 	// Skip not Data events
-	if e.Event != teonet.EventData {
+	if e != teomq.EventData {
 		return false
 	}
 
@@ -241,6 +500,23 @@ func (co *Consumer) reader(c *teonet.Channel, p *teonet.Packet,
 		// 	float64(c.Triptime().Microseconds())/1000.0,
 		// )
 
+		// Check broker control message
+		if teomq.IsControl(p.Data()) {
+			var ctrl teomq.Control
+			if err := ctrl.UnmarshalBinary(p.Data()); err != nil {
+				return true
+			}
+			switch ctrl.Cmd {
+			case teomq.CtrlGoingAway:
+				log.Printf(logprefix+"broker %s is going away\n", c)
+			case teomq.CtrlRedirect:
+				co.redirect(c.Address(), ctrl.Broker)
+			case teomq.CtrlLeader:
+				co.lead(c.Address(), ctrl.Queue, ctrl.Broker)
+			}
+			return true
+		}
+
 		// Check consumerHello message from new consumer
 		if len(p.Data()) == len(teomq.ConsumerAnswer) &&
 			string(p.Data()) == string(teomq.ConsumerAnswer) {
@@ -248,64 +524,63 @@ func (co *Consumer) reader(c *teonet.Channel, p *teonet.Packet,
 			return true
 		}
 
-		// Process message and Send answer
-		go func() {
-			var err error
-			var answer []byte
-
-			// Process message
-			switch {
-
-			// Execute command
-			case co.Commands != nil:
-				// Parse command
-				_, name, vars, data, err := co.ParseCommand(p.Data())
-				if err != nil {
-					log.Printf("parse message id %d, from %s, error: %s\n",
-						p.ID(), c, err)
-					return
-				}
+		// Unmarshal message envelope
+		pac, err := newPacket(c, p)
+		if err != nil {
+			log.Printf(logprefix+"unmarshal message id %d, from %s, error: %s\n",
+				p.ID(), c, err)
+			return true
+		}
 
-				// Execute command using default request
-				r, err := co.Commands.Exec(name, command.Teonet,
-					&command.DefaultRequest{Vars: vars, Data: data},
-				)
-				if err != nil {
-					log.Printf(logprefix+"execute command %s, id %d, from %s, error: %s\n",
-						name, p.ID(), c, err)
-					return
-				}
+		// Return message to broker during shutdown
+		if !co.start() {
+			co.sendAck(pac, teomq.CmdNack)
+			return true
+		}
 
-				// Read answer
-				answer, err = io.ReadAll(r)
-				if err != nil {
-					log.Printf(logprefix+"read command %s, id %d, from %s, error: %s\n",
-						name, p.ID(), c, err)
-					return
-				}
+		// Process message and Send answer. Number of concurrently processed
+		// messages is limited by prefetch, broker does not send more messages
+		// than prefetch in basic mode, so message waits free slot only in
+		// command mode or if broker does not support prefetch. The slot is
+		// waited in processing goroutine, so reader is never blocked and gets
+		// control messages while all slots are busy
+		go func() {
+			defer co.wg.Done()
+			select {
+			case co.sem <- struct{}{}:
+				defer func() { <-co.sem }()
+			case <-co.ctx.Done():
+				return
+			}
 
-			// Execute custom reader
-			case co.ProcessMessage != nil:
-				answer, err = co.ProcessMessage(p)
-				if err != nil {
-					log.Printf(logprefix+"process message in custom reader eith id %d, "+
-						"from %s, error: %s\n",
-						p.ID(), c, err)
-					return
+			// Process message and send negative acknowledge if it was not
+			// processed, so broker can redeliver it, reject it, or send
+			// remote error to producer
+			answer, err := co.process(c, pac)
+			var rerr *teomq.RemoteError
+			switch {
+			case errors.Is(err, ErrReject):
+				co.sendAck(pac, teomq.CmdReject)
+				return
+			case errors.As(err, &rerr):
+				if err = co.sendError(pac, rerr); err != nil {
+					log.Printf(logprefix+"send error id %d, to %s, "+
+						"error: %s\n", p.ID(), c, err)
 				}
-
-			// Default answer if commands and reader does not added
-			default:
-				answer = []byte("Answer to " + string(p.Data()))
+				return
+			case err != nil:
+				co.sendAck(pac, teomq.CmdNack)
+				return
 			}
 
-			// Don't send empty answer
+			// Don't send empty answer, acknowledge message instead
 			if len(answer) == 0 {
+				co.sendAck(pac, teomq.CmdAck)
 				return
 			}
 
 			// Send answer
-			err = co.sendAnswer(p, answer)
+			err = co.sendAnswer(pac, answer)
 			if err != nil {
 				log.Printf(logprefix+"send id %d, len: %d, to %s, error: %s\n",
 					p.ID(), len(answer), c, err)
@@ -320,3 +595,120 @@ func (co *Consumer) reader(c *teonet.Channel, p *teonet.Packet,
 
 	return false
 }
+
+// hello returns marshalled consumer hello message.
+func (co *Consumer) hello() []byte {
+	hello, _ := teomq.Hello{
+		Version:  teomq.HelloVersion,
+		Queues:   co.queues,
+		Prefetch: int(co.prefetch),
+		Capacity: int(co.capacity),
+	}.MarshalBinary()
+	return hello
+}
+
+// rejoin sends hello and subscribes to broker which consumer switched to.
+// Transport does not send connected event if consumer was connected to the
+// broker before, e.g. to cluster broker which redirected consumer to cluster
+// leader, so consumer joins the broker here. Broker ignores repeated hello
+// and subscriptions.
+func (co *Consumer) rejoin(broker string) {
+	if _, err := co.transport.SendTo(broker, co.hello()); err != nil {
+		log.Printf(logprefix+"send hello to %s error: %s\n", broker, err)
+		return
+	}
+	co.subscribeAll(broker)
+}
+
+// redirect switches consumer from cluster broker to cluster leader.
+func (co *Consumer) redirect(broker, leader string) {
+	switch {
+	case leader == "" || broker != co.failover.Broker():
+	case leader == broker:
+		co.rejoin(broker)
+	default:
+		log.Printf(logprefix+"broker %s redirects to leader %s\n", broker,
+			leader)
+		co.failover.Redirect(co.ctx, co.transport, broker, leader,
+			func(broker string) {
+				log.Printf(logprefix+"redirected to broker %s\n", broker)
+				co.rejoin(broker)
+			},
+		)
+	}
+}
+
+// lead connects consumer to cluster leader of queue which broker announced,
+// so consumer gets messages of the queue from its leader. Consumer stays
+// connected to the broker.
+func (co *Consumer) lead(broker, queue, leader string) {
+	if leader == "" || leader == broker {
+		return
+	}
+	log.Printf(logprefix+"broker %s announces leader %s of queue %q\n",
+		broker, leader, queue)
+	go func() {
+		if err := co.transport.ConnectTo(leader); err != nil {
+			log.Printf(logprefix+"connect to leader %s error: %s\n", leader,
+				err)
+			return
+		}
+		co.rejoin(leader)
+	}()
+}
+
+// process processes message received from broker and returns answer.
+func (co *Consumer) process(c teomq.Channel, p *Packet) (answer []byte,
+	err error) {
+
+	switch {
+
+	// Execute command
+	case co.Commands != nil:
+		// Parse command
+		_, name, vars, data, err := co.ParseCommand(p.Data())
+		if err != nil {
+			log.Printf("parse message id %d, from %s, error: %s\n",
+				p.ID(), c, err)
+			return nil, fmt.Errorf("%w: %w", ErrReject, err)
+		}
+
+		// Execute command using default request, command errors are sent
+		// to producer
+		r, err := co.Commands.Exec(name, command.Teonet,
+			&command.DefaultRequest{Vars: vars, Data: data},
+		)
+		if err != nil {
+			log.Printf(logprefix+"execute command %s, id %d, from %s, error: %s\n",
+				name, p.ID(), c, err)
+			return nil, teomq.RemoteErrorOf(err)
+		}
+
+		// Read answer, command without reader is acknowledged without answer
+		if r == nil {
+			return nil, nil
+		}
+		answer, err = io.ReadAll(r)
+		if err != nil {
+			log.Printf(logprefix+"read command %s, id %d, from %s, error: %s\n",
+				name, p.ID(), c, err)
+			return nil, teomq.RemoteErrorOf(err)
+		}
+
+	// Execute custom reader
+	case co.ProcessMessage != nil:
+		answer, err = co.ProcessMessage(p)
+		if err != nil {
+			log.Printf(logprefix+"process message in custom reader eith id %d, "+
+				"from %s, error: %s\n",
+				p.ID(), c, err)
+			return
+		}
+
+	// Default answer if commands and reader does not added
+	default:
+		answer = []byte("Answer to " + string(p.Data()))
+	}
+
+	return
+}
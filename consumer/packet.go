@@ -0,0 +1,82 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Consumer packet module.
+
+package consumer
+
+import (
+	"github.com/teonet-go/teomq"
+)
+
+// Packet is message received by consumer from broker. It contains packet id,
+// broker address and message metadata sent by broker.
+type Packet struct {
+	id     int
+	from   string
+	msg    teomq.Message
+	answer teomq.Header
+}
+
+// newPacket creates consumer packet from transport packet and unmarshals
+// message envelope if transport packet contains it.
+func newPacket(c teomq.Channel, p teomq.Payload) (pac *Packet, err error) {
+	pac = &Packet{id: p.ID(), from: c.Address()}
+	if !teomq.IsMessage(p.Data()) {
+		pac.msg = teomq.Message{Deliveries: 1, Data: p.Data()}
+		return
+	}
+	err = pac.msg.UnmarshalBinary(p.Data())
+	return
+}
+
+// ID returns packet id.
+func (p *Packet) ID() int {
+	return p.id
+}
+
+// From returns broker address.
+func (p *Packet) From() string {
+	return p.from
+}
+
+// Data returns message data.
+func (p *Packet) Data() []byte {
+	return p.msg.Data
+}
+
+// Deliveries returns number of delivery attempts of this message including
+// current one. Deliveries greater than 1 means that the message was
+// redelivered after previous consumer did not acknowledge it.
+func (p *Packet) Deliveries() int {
+	return p.msg.Deliveries
+}
+
+// Queue returns name of the broker queue the message was taken from.
+func (p *Packet) Queue() string {
+	return p.msg.Queue
+}
+
+// Header returns message header set by producer, it is nil if message has no
+// header.
+func (p *Packet) Header() teomq.Header {
+	return p.msg.Header
+}
+
+// AnswerHeader returns header of answer to this message. The answer header
+// contains correlation id and trace context of message header, the message
+// processor may add other values to it before return answer.
+func (p *Packet) AnswerHeader() teomq.Header {
+	if p.answer != nil {
+		return p.answer
+	}
+	p.answer = make(teomq.Header)
+	for _, key := range []string{teomq.HeaderCorrelationID,
+		teomq.HeaderTraceParent, teomq.HeaderTraceState} {
+		if v, ok := p.msg.Header[key]; ok {
+			p.answer[key] = v
+		}
+	}
+	return p.answer
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Control module provides broker control messages sent
+// to consumers and producers.
+
+package teomq
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// Broker control commands
+const (
+	// CtrlGoingAway is sent by draining broker to connected consumers and
+	// producers without message ids, and to producers with ids of messages
+	// which broker does not accept or will not deliver.
+	CtrlGoingAway = "going-away"
+
+	// CtrlNoAnswer is sent by broker to producer with ids of messages which
+	// will not be answered because consumer disconnected or did not answer
+	// during broker answer timeout.
+	CtrlNoAnswer = "no-answer"
+
+	// CtrlAcked is sent by broker to producer with ids of messages which
+	// consumer acknowledged without answer. Producer executes answer
+	// callback with empty answer.
+	CtrlAcked = "acked"
+
+	// CtrlFanOut is sent by broker in command mode to producer with command
+	// message id and number of consumers the command was sent to. It is sent
+	// only if the command message envelope has FanOut flag, so legacy
+	// producers don't get it.
+	CtrlFanOut = "fan-out"
+
+	// CtrlRedirect is sent by cluster broker to producers with ids of
+	// messages which broker does not accept because leader of message queue
+	// is not elected or not ready yet, the leader address is empty in this
+	// case. Consumers and producers switch to broker with leader address if
+	// it is not empty.
+	CtrlRedirect = "redirect"
+
+	// CtrlLeader is sent by cluster broker to consumer with address of
+	// cluster broker which leads queue served by consumer. Consumer connects
+	// to the leader and sends it hello, so it gets messages of the queue
+	// from the leader. Legacy consumers ignore it.
+	CtrlLeader = "leader"
+)
+
+// controlMagic starts broker control message.
+var controlMagic = []byte{0xFF, 'T', 'M', 'C'}
+
+var (
+	ErrWrongControl    = errors.New("wrong control message")
+	ErrBrokerGoingAway = errors.New("broker is going away")
+	ErrNoAnswer        = errors.New("consumer did not answer")
+	ErrNotLeader       = errors.New("broker is not cluster leader")
+)
+
+// Control is broker control message.
+//
+// Binary format: magic(4) | command | ['/' id[,id...]] | ['=' count] |
+// ['@' broker] | ['#' queue], where ids are producer message ids the command
+// relates to.
+type Control struct {
+	Cmd    string // Control command
+	IDs    []int  // Producer message ids
+	Count  int    // Command value, e.g. number of consumers
+	Broker string // Broker address without '#', e.g. cluster leader
+	Queue  string // Queue name, e.g. queue led by cluster leader
+}
+
+// IsControl returns true if data contains broker control message.
+func IsControl(data []byte) bool {
+	return bytes.HasPrefix(data, controlMagic)
+}
+
+// MarshalBinary marshals broker control message.
+func (c Control) MarshalBinary() (data []byte, err error) {
+	data = append(data, controlMagic...)
+	data = append(data, c.Cmd...)
+	for i, id := range c.IDs {
+		if i == 0 {
+			data = append(data, '/')
+		} else {
+			data = append(data, ',')
+		}
+		data = strconv.AppendInt(data, int64(id), 10)
+	}
+	if c.Count != 0 {
+		data = append(data, '=')
+		data = strconv.AppendInt(data, int64(c.Count), 10)
+	}
+	if c.Broker != "" {
+		data = append(data, '@')
+		data = append(data, c.Broker...)
+	}
+	if c.Queue != "" {
+		data = append(data, '#')
+		data = append(data, c.Queue...)
+	}
+	return
+}
+
+// UnmarshalBinary unmarshals broker control message.
+func (c *Control) UnmarshalBinary(data []byte) (err error) {
+	if !IsControl(data) {
+		return ErrWrongControl
+	}
+	data, queue, _ := bytes.Cut(data[len(controlMagic):], []byte("#"))
+	c.Queue = string(queue)
+	data, broker, _ := bytes.Cut(data, []byte("@"))
+	c.Broker = string(broker)
+	data, count, found := bytes.Cut(data, []byte("="))
+	c.Count = 0
+	if found {
+		if c.Count, err = strconv.Atoi(string(count)); err != nil {
+			return ErrWrongControl
+		}
+	}
+	cmd, ids, found := bytes.Cut(data, []byte("/"))
+	if len(cmd) == 0 {
+		return ErrWrongControl
+	}
+	c.Cmd, c.IDs = string(cmd), nil
+	if !found {
+		return
+	}
+	for _, s := range bytes.Split(ids, []byte(",")) {
+		id, err := strconv.Atoi(string(s))
+		if err != nil {
+			return ErrWrongControl
+		}
+		c.IDs = append(c.IDs, id)
+	}
+	return
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Error module provides remote error which is sent by
+// consumer in error answer and delivered to producer.
+
+package teomq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrWrongRemoteError = errors.New("wrong remote error")
+
+// RemoteError is error returned by consumer message processing and delivered
+// to producer in error answer. Consumer ProcessMessage may return it to set
+// error code, other errors are delivered with zero code.
+type RemoteError struct {
+	Code    int    // Application error code
+	Message string // Error message
+}
+
+// NewRemoteError creates new remote error.
+func NewRemoteError(code int, message string) *RemoteError {
+	return &RemoteError{Code: code, Message: message}
+}
+
+// RemoteErrorOf returns remote error of err. If err is not RemoteError and
+// does not wrap it, remote error with zero code and err message is returned.
+func RemoteErrorOf(err error) *RemoteError {
+	var e *RemoteError
+	if errors.As(err, &e) {
+		return e
+	}
+	return &RemoteError{Message: err.Error()}
+}
+
+// Error returns error message.
+func (e *RemoteError) Error() string {
+	if e.Code == 0 {
+		return "remote error: " + e.Message
+	}
+	return fmt.Sprintf("remote error %d: %s", e.Code, e.Message)
+}
+
+// MarshalBinary marshals remote error. Binary format: code (varint) and
+// message.
+func (e RemoteError) MarshalBinary() (data []byte, err error) {
+	data = binary.AppendVarint(data, int64(e.Code))
+	data = append(data, e.Message...)
+	return
+}
+
+// UnmarshalBinary unmarshals remote error.
+func (e *RemoteError) UnmarshalBinary(data []byte) (err error) {
+	code, n := binary.Varint(data)
+	if n <= 0 {
+		return ErrWrongRemoteError
+	}
+	e.Code, e.Message = int(code), string(data[n:])
+	return
+}
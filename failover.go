@@ -0,0 +1,178 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Failover module provides brokers list used by
+// producers and consumers to fail over to standby broker and to redirect to
+// cluster leader.
+
+package teomq
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrBrokerDisconnected is passed to answer callbacks of messages which wait
+// answers when producer fails over to other broker.
+var ErrBrokerDisconnected = errors.New("broker disconnected")
+
+// Brokers is producer and consumer attribute with standby brokers addresses.
+// Producer and consumer connect to the broker passed to New, and when
+// connected broker disconnects, fail over to the next broker of the list
+// which is reachable.
+type Brokers []string
+
+// failoverRetryInterval is interval between connection attempts when all
+// brokers are unreachable.
+const failoverRetryInterval = time.Second
+
+// Failover contains brokers addresses and current broker of producer or
+// consumer.
+type Failover struct {
+	addrs     []string // brokers addresses, the first is main broker
+	cur       int      // current broker index
+	switching bool     // failover is in progress
+	*sync.RWMutex
+}
+
+// NewFailover creates failover of main broker and standby brokers from
+// attributes, and returns attributes without standby brokers.
+func NewFailover(broker string, attr ...any) (f *Failover, outattr []any) {
+	f = &Failover{addrs: []string{broker}, RWMutex: new(sync.RWMutex)}
+	for _, v := range attr {
+		switch v := v.(type) {
+		case Brokers:
+			for _, addr := range v {
+				if !slices.Contains(f.addrs, addr) {
+					f.addrs = append(f.addrs, addr)
+				}
+			}
+		default:
+			outattr = append(outattr, v)
+		}
+	}
+	return
+}
+
+// Enabled returns true if there are standby brokers.
+func (f *Failover) Enabled() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.addrs) > 1
+}
+
+// Brokers returns brokers addresses.
+func (f *Failover) Brokers() []string {
+	f.RLock()
+	defer f.RUnlock()
+	return slices.Clone(f.addrs)
+}
+
+// Broker returns current broker address.
+func (f *Failover) Broker() string {
+	f.RLock()
+	defer f.RUnlock()
+	return f.addrs[f.cur]
+}
+
+// Connect connects transport to current broker. If it is unreachable, the
+// next brokers are tried in order, and the last error is returned if all
+// brokers are unreachable.
+func (f *Failover) Connect(t Transport) (err error) {
+	for range f.Brokers() {
+		if err = t.ConnectTo(f.Broker()); err == nil || !f.Enabled() {
+			return
+		}
+		f.next()
+	}
+	return
+}
+
+// Switch switches transport from disconnected broker to the next reachable
+// broker. It does nothing if failover is not enabled, broker is not current
+// broker or failover is in progress. Brokers are tried in order until one of
+// them connected or context done, then function f is called with connected
+// broker address.
+func (f *Failover) Switch(ctx context.Context, t Transport, broker string,
+	fn func(broker string)) {
+
+	f.Lock()
+	if len(f.addrs) < 2 || f.switching || f.addrs[f.cur] != broker {
+		f.Unlock()
+		return
+	}
+	f.cur = (f.cur + 1) % len(f.addrs)
+	f.switching = true
+	f.Unlock()
+
+	go f.connect(ctx, t, fn)
+}
+
+// Redirect switches transport from broker to other broker, e.g. to cluster
+// leader. The other broker address is added to brokers if it is not there.
+// It does nothing if broker is not current broker or failover is in
+// progress. If other broker is unreachable, next brokers are tried like in
+// Switch.
+func (f *Failover) Redirect(ctx context.Context, t Transport, broker,
+	to string, fn func(broker string)) {
+
+	f.Lock()
+	if f.switching || f.addrs[f.cur] != broker || broker == to {
+		f.Unlock()
+		return
+	}
+	i := slices.Index(f.addrs, to)
+	if i < 0 {
+		f.addrs = append(f.addrs, to)
+		i = len(f.addrs) - 1
+	}
+	f.cur = i
+	f.switching = true
+	f.Unlock()
+
+	go f.connect(ctx, t, fn)
+}
+
+// connect connects transport to current broker or to the next reachable
+// broker and calls function fn with connected broker address. Current
+// broker is changed before connect, so events of new broker are processed
+// as events of current broker.
+func (f *Failover) connect(ctx context.Context, t Transport,
+	fn func(broker string)) {
+
+	defer func() {
+		f.Lock()
+		f.switching = false
+		f.Unlock()
+	}()
+	n := len(f.Brokers())
+	for i := 1; ctx.Err() == nil; i++ {
+		addr := f.Broker()
+		if err := t.ConnectTo(addr); err == nil {
+			fn(addr)
+			return
+		}
+		f.next()
+
+		// Wait before next round when all brokers are unreachable
+		if i%n != 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(failoverRetryInterval):
+		}
+	}
+}
+
+// next makes next broker current and returns its address.
+func (f *Failover) next() string {
+	f.Lock()
+	defer f.Unlock()
+	f.cur = (f.cur + 1) % len(f.addrs)
+	return f.addrs[f.cur]
+}
@@ -0,0 +1,209 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue Federation package provides federation link which
+// forwards messages from queues of upstream broker to downstream broker and
+// routes answers back to producers of upstream broker.
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+	"github.com/teonet-go/teomq/consumer"
+	"github.com/teonet-go/teomq/producer"
+)
+
+const logprefix = "federation: "
+
+// ErrFiltered is wrapped in consumer.ErrReject returned for messages which
+// don't pass link filters.
+var ErrFiltered = errors.New("message filtered by federation link")
+
+// Link is federation link. It is consumer of upstream broker queues and
+// producer of downstream broker: it sends each upstream message to
+// downstream broker and returns downstream answer to upstream broker which
+// routes it to the message producer.
+//
+// Forwarding is at-least-once: upstream message is answered or acknowledged
+// only when downstream answer or acknowledgement received. If downstream
+// broker is unreachable, disconnected, rejected or lost the message, or
+// downstream consumer did not answer during link timeout, the message is returned to upstream broker
+// which redelivers it. So downstream queue may get the message more than
+// once, messages with teomq.HeaderIdempotencyKey header are deduplicated by
+// downstream broker.
+type Link struct {
+	upstream   *consumer.Consumer
+	downstream *producer.Producer
+	filters    []Filter
+	queue      string        // downstream queue, empty to keep upstream queue
+	timeout    time.Duration // downstream answer timeout
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// UpstreamAttr is link attribute with attributes of link consumer connected
+// to upstream broker, e.g. consumer.Queues with names of forwarded queues,
+// consumer.Prefetch, teomq.Brokers or teomq.Transport.
+type UpstreamAttr []any
+
+// DownstreamAttr is link attribute with attributes of link producer
+// connected to downstream broker, e.g. producer.OutboxSize, teomq.Brokers
+// or teomq.Transport.
+type DownstreamAttr []any
+
+// Filter is link attribute with function which returns true if upstream
+// message should be forwarded. Messages which don't pass all link filters
+// are rejected and move to upstream broker dead-letter queue.
+type Filter func(p *consumer.Packet) bool
+
+// Queue is link attribute with name of downstream broker queue. Messages are
+// sent to downstream queue with the same name as upstream queue by default.
+type Queue string
+
+// Timeout is link attribute with downstream answer timeout. Upstream message
+// which is not answered during timeout is redelivered. The default value is
+// 5 seconds.
+type Timeout time.Duration
+
+const defaultTimeout = 5 * time.Second
+
+// New creates a new federation link which forwards messages from upstream
+// broker to downstream broker.
+//
+// Optional link attributes can be passed in the attr parameter together
+// with teonet application attributes:
+//   - UpstreamAttr: attributes of link consumer
+//   - DownstreamAttr: attributes of link producer
+//   - Filter: function which selects forwarded messages
+//   - Queue: name of downstream queue
+//   - Timeout: downstream answer timeout, 5 seconds by default
+//
+// Other attributes are passed to both link consumer and producer. Link
+// consumer and producer are teonet applications with appShort-upstream and
+// appShort-downstream names if transport is not set.
+func New(appShort, upstream, downstream string, attr ...any) (l *Link,
+	err error) {
+	return NewContext(context.Background(), appShort, upstream, downstream,
+		attr...)
+}
+
+// NewContext creates a new federation link which is closed when context
+// done. See New for attributes description.
+func NewContext(ctx context.Context, appShort, upstream, downstream string,
+	attr ...any) (l *Link, err error) {
+
+	// Get link attributes
+	l = &Link{timeout: defaultTimeout}
+	var upAttr, downAttr []any
+	for _, v := range attr {
+		switch v := v.(type) {
+		case UpstreamAttr:
+			upAttr = append(upAttr, v...)
+		case DownstreamAttr:
+			downAttr = append(downAttr, v...)
+		case Filter:
+			l.filters = append(l.filters, v)
+		case Queue:
+			l.queue = string(v)
+		case Timeout:
+			if v > 0 {
+				l.timeout = time.Duration(v)
+			}
+		default:
+			upAttr = append(upAttr, v)
+			downAttr = append(downAttr, v)
+		}
+	}
+
+	// Create downstream producer first, it is used by upstream consumer
+	l.downstream, err = producer.NewContext(ctx, appShort+"-downstream",
+		downstream, downAttr...)
+	if err != nil {
+		return
+	}
+	l.upstream, err = consumer.NewContext(ctx, appShort+"-upstream",
+		upstream, l.forward, upAttr...)
+	if err != nil {
+		l.downstream.Close()
+		return
+	}
+	log.Printf(logprefix+"link %s -> %s started\n", upstream, downstream)
+
+	return
+}
+
+// Close closes link consumer and producer. Messages which are forwarded now
+// are redelivered by upstream broker.
+func (l *Link) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = errors.Join(l.upstream.Close(), l.downstream.Close())
+	})
+	return l.closeErr
+}
+
+// Shutdown gracefully shuts down link. It waits until messages which are
+// forwarded now are answered and closes link. If context done before, link
+// is closed and context error is returned.
+func (l *Link) Shutdown(ctx context.Context) error {
+	if err := l.upstream.Shutdown(ctx); err != nil {
+		l.Close()
+		return err
+	}
+	return l.Close()
+}
+
+// forward is link consumer message processor. It sends upstream message to
+// downstream broker and returns downstream answer, empty answer if
+// downstream consumer acknowledged message without answer.
+func (l *Link) forward(p *consumer.Packet) (answer []byte, err error) {
+
+	// Check filters
+	for _, f := range l.filters {
+		if !f(p) {
+			return nil, fmt.Errorf("%w: %w", consumer.ErrReject, ErrFiltered)
+		}
+	}
+
+	// Send message to downstream queue with message header
+	queue := l.queue
+	if queue == "" {
+		queue = p.Queue()
+	}
+	attr := []any{producer.Queue(queue)}
+	if h := p.Header(); h != nil {
+		attr = append(attr, h)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	c, err := l.downstream.SendAsync(ctx, p.Data(), attr...)
+	if err != nil {
+		log.Printf(logprefix+"forward id %d error: %s\n", p.ID(), err)
+		return
+	}
+	<-c.Done()
+	ans, err := c.Answer()
+
+	// Return answer with its header, remote error is returned to producer,
+	// other messages are redelivered because timeout does not prove that
+	// downstream broker got the message
+	var rerr *teomq.RemoteError
+	switch {
+	case err == nil:
+		maps.Copy(p.AnswerHeader(), ans.Header())
+		return ans.Data(), nil
+	case errors.As(err, &rerr):
+		return nil, rerr
+	default:
+		log.Printf(logprefix+"forward id %d error: %s, redeliver\n", p.ID(),
+			err)
+		return nil, err
+	}
+}
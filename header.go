@@ -0,0 +1,159 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Header module provides message and packet headers
+// which carry messages metadata as key value pairs.
+
+package teomq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"time"
+)
+
+// Well known header keys
+const (
+	HeaderContentType   = "content-type"   // message data content type
+	HeaderCorrelationID = "correlation-id" // correlation id of request
+	HeaderTimestamp     = "timestamp"      // message creation time
+	HeaderTraceParent   = "traceparent"    // W3C trace context traceparent
+	HeaderTraceState    = "tracestate"     // W3C trace context tracestate
+	HeaderSource        = "source"         // address of answer consumer
+
+	// idempotency key of message, see IdempotencyKey
+	HeaderIdempotencyKey = "idempotency-key"
+)
+
+// Header contains message metadata as key value pairs. Keys are case
+// sensitive, well known keys are HeaderContentType, HeaderCorrelationID,
+// HeaderTimestamp, HeaderTraceParent and HeaderTraceState, other keys may be
+// used by applications.
+type Header map[string]string
+
+// Get returns header value by key or empty string if key does not exist.
+func (h Header) Get(key string) string {
+	return h[key]
+}
+
+// Set sets header value by key.
+func (h Header) Set(key, value string) {
+	h[key] = value
+}
+
+// Clone returns copy of header.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	c := make(Header, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+// ContentType returns message data content type.
+func (h Header) ContentType() string {
+	return h[HeaderContentType]
+}
+
+// CorrelationID returns correlation id.
+func (h Header) CorrelationID() string {
+	return h[HeaderCorrelationID]
+}
+
+// Timestamp returns message creation time or zero time if it does not set.
+func (h Header) Timestamp() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, h[HeaderTimestamp])
+	return t
+}
+
+// SetTimestamp sets message creation time.
+func (h Header) SetTimestamp(t time.Time) {
+	h[HeaderTimestamp] = t.UTC().Format(time.RFC3339Nano)
+}
+
+// TraceParent returns W3C trace context traceparent value.
+func (h Header) TraceParent() string {
+	return h[HeaderTraceParent]
+}
+
+// TraceState returns W3C trace context tracestate value.
+func (h Header) TraceState() string {
+	return h[HeaderTraceState]
+}
+
+// Source returns address of consumer which sent answer. Broker sets it in
+// answers to commands in command mode.
+func (h Header) Source() string {
+	return h[HeaderSource]
+}
+
+// IdempotencyKey returns message idempotency key. Broker drops messages with
+// the same idempotency key in the same queue during dedup window, their
+// producers get answer of the first message.
+func (h Header) IdempotencyKey() string {
+	return h[HeaderIdempotencyKey]
+}
+
+// MarshalBinary marshals header. Binary format: number of pairs (uvarint)
+// and key value pairs sorted by key, each key and value is encoded as
+// length (uvarint) and bytes.
+func (h Header) MarshalBinary() (data []byte, err error) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	data = binary.AppendUvarint(data, uint64(len(keys)))
+	for _, k := range keys {
+		data = binary.AppendUvarint(data, uint64(len(k)))
+		data = append(data, k...)
+		data = binary.AppendUvarint(data, uint64(len(h[k])))
+		data = append(data, h[k]...)
+	}
+	return
+}
+
+// UnmarshalBinary unmarshals header.
+func (h *Header) UnmarshalBinary(data []byte) (err error) {
+	return h.read(bytes.NewBuffer(data))
+}
+
+// read reads header from buffer.
+func (h *Header) read(buf *bytes.Buffer) (err error) {
+	count, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	if count > uint64(buf.Len()) {
+		return ErrWrongMessage
+	}
+	*h = make(Header, count)
+	readString := func() (s string, err error) {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return
+		}
+		if n > uint64(buf.Len()) {
+			return "", ErrWrongMessage
+		}
+		return string(buf.Next(int(n))), nil
+	}
+	for range count {
+		k, err := readString()
+		if err != nil {
+			return err
+		}
+		v, err := readString()
+		if err != nil {
+			return err
+		}
+		(*h)[k] = v
+	}
+	return
+}
@@ -0,0 +1,126 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Hello module provides consumer hello message with
+// consumer options.
+
+package teomq
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// HelloVersion is current consumer hello protocol version. Consumers with
+// version 1 and above receive messages in Message envelope and acknowledge
+// processed messages.
+const HelloVersion = 1
+
+var ErrWrongHello = errors.New("wrong consumer hello message")
+
+// Hello is consumer hello message sent to broker when consumer connected. The
+// hello message without options is equal to ConsumerHello and used by legacy
+// consumers. The hello message with options looks like:
+// Consumer?v=1&q=queue1&q=queue2&p=64&c=4.
+type Hello struct {
+	Version  int      // Protocol version
+	Queues   []string // Names of queues served by consumer
+	Prefetch int      // Max number of unanswered messages, 0 - unlimited
+	Capacity int      // Consumer capacity relative to other consumers
+}
+
+// IsHello returns true if data is consumer hello message.
+func IsHello(data []byte) bool {
+	if !bytes.HasPrefix(data, ConsumerHello) {
+		return false
+	}
+	return len(data) == len(ConsumerHello) || data[len(ConsumerHello)] == '?'
+}
+
+// MarshalBinary marshals consumer hello message.
+func (h Hello) MarshalBinary() (data []byte, err error) {
+	data = append(data, ConsumerHello...)
+
+	v := url.Values{}
+	if h.Version > 0 {
+		v.Set("v", strconv.Itoa(h.Version))
+	}
+	for _, q := range h.Queues {
+		v.Add("q", q)
+	}
+	if h.Prefetch > 0 {
+		v.Set("p", strconv.Itoa(h.Prefetch))
+	}
+	if h.Capacity > 0 {
+		v.Set("c", strconv.Itoa(h.Capacity))
+	}
+	if len(v) == 0 {
+		return
+	}
+
+	data = append(data, '?')
+	data = append(data, v.Encode()...)
+	return
+}
+
+// UnmarshalBinary unmarshals consumer hello message.
+func (h *Hello) UnmarshalBinary(data []byte) (err error) {
+	if !IsHello(data) {
+		return ErrWrongHello
+	}
+	*h = Hello{}
+	if len(data) == len(ConsumerHello) {
+		return
+	}
+
+	v, err := url.ParseQuery(string(data[len(ConsumerHello)+1:]))
+	if err != nil {
+		return
+	}
+	if s := v.Get("v"); s != "" {
+		if h.Version, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	h.Queues = v["q"]
+	if s := v.Get("p"); s != "" {
+		if h.Prefetch, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	if s := v.Get("c"); s != "" {
+		if h.Capacity, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Acks returns true if consumer acknowledges processed messages.
+func (h Hello) Acks() bool {
+	return h.Version >= 1
+}
+
+// QueuesOrDefault returns names of queues served by consumer or default queue
+// name if queues does not set in hello.
+func (h Hello) QueuesOrDefault() []string {
+	if len(h.Queues) == 0 {
+		return []string{DefaultQueue}
+	}
+	return h.Queues
+}
+
+// CapacityOrDefault returns consumer capacity. If capacity does not set in
+// hello, it is equal to prefetch or 1 if prefetch does not set too.
+func (h Hello) CapacityOrDefault() int {
+	switch {
+	case h.Capacity > 0:
+		return h.Capacity
+	case h.Prefetch > 0:
+		return h.Prefetch
+	}
+	return 1
+}
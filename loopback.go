@@ -0,0 +1,359 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Loopback module provides in-process transport which
+// connects broker, producers and consumers running in one process, e.g. in
+// tests.
+
+package teomq
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrPeerNotFound     = errors.New("peer not found")
+	ErrPeerNotConnected = errors.New("peer not connected")
+	ErrTransportClosed  = errors.New("transport closed")
+)
+
+// Loopback is in-process network of loopback transports.
+type Loopback struct {
+	m map[string]*LoopbackTransport
+	*sync.Mutex
+}
+
+// NewLoopback creates new in-process network.
+func NewLoopback() *Loopback {
+	return &Loopback{
+		m:     make(map[string]*LoopbackTransport),
+		Mutex: new(sync.Mutex),
+	}
+}
+
+// Transport returns loopback transport with address, it creates new transport
+// if network has no transport with this address or it was closed.
+func (l *Loopback) Transport(addr string) *LoopbackTransport {
+	l.Lock()
+	defer l.Unlock()
+
+	if t, ok := l.m[addr]; ok {
+		return t
+	}
+	t := &LoopbackTransport{
+		net:   l,
+		addr:  addr,
+		peers: make(map[string]*loopbackChannel),
+		when:  make(map[string][]func()),
+		Mutex: new(sync.Mutex),
+	}
+	t.inbox.init()
+	l.m[addr] = t
+	go t.run()
+	return t
+}
+
+// get returns transport by address.
+func (l *Loopback) get(addr string) (t *LoopbackTransport, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	t, ok = l.m[addr]
+	return
+}
+
+// del removes transport from network.
+func (l *Loopback) del(t *LoopbackTransport) {
+	l.Lock()
+	defer l.Unlock()
+	if l.m[t.addr] == t {
+		delete(l.m, t.addr)
+	}
+}
+
+// LoopbackTransport is in-process Transport. Packets and events are delivered
+// to transport readers asynchronously in one goroutine in order they were
+// sent.
+type LoopbackTransport struct {
+	net     *Loopback
+	addr    string
+	readers []Reader
+	peers   map[string]*loopbackChannel // channels by peer address
+	when    map[string][]func()         // WhenConnectedTo functions
+	closed  bool
+	inbox   loopbackInbox
+	*sync.Mutex
+}
+
+// Address returns transport address.
+func (t *LoopbackTransport) Address() string {
+	return t.addr
+}
+
+// SendTo sends data to connected peer.
+func (t *LoopbackTransport) SendTo(addr string, data []byte) (int, error) {
+	t.Lock()
+	ch, ok := t.peers[addr]
+	t.Unlock()
+	if !ok {
+		return 0, ErrPeerNotConnected
+	}
+	return ch.Send(data)
+}
+
+// AddReader adds transport reader.
+func (t *LoopbackTransport) AddReader(reader Reader) {
+	t.Lock()
+	defer t.Unlock()
+	t.readers = append(t.readers, reader)
+}
+
+// ConnectTo connects to transport with address in the same network. Both
+// sides get EventConnected.
+func (t *LoopbackTransport) ConnectTo(addr string) error {
+	peer, ok := t.net.get(addr)
+	if !ok || peer == t {
+		return ErrPeerNotFound
+	}
+
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return ErrTransportClosed
+	}
+	if _, ok := t.peers[addr]; ok {
+		t.Unlock()
+		return nil
+	}
+	client := &loopbackChannel{t: t, addr: addr}
+	server := &loopbackChannel{t: peer, addr: t.addr, server: true}
+	client.peer, server.peer = server, client
+	t.peers[addr] = client
+	when := t.when[addr]
+	t.Unlock()
+
+	peer.Lock()
+	if peer.closed {
+		peer.Unlock()
+		t.Lock()
+		delete(t.peers, addr)
+		t.Unlock()
+		return ErrPeerNotFound
+	}
+	peer.peers[t.addr] = server
+	peer.Unlock()
+
+	peer.inbox.push(loopbackEvent{c: server, e: EventConnected})
+	t.inbox.push(loopbackEvent{c: client, e: EventConnected})
+	for _, f := range when {
+		t.inbox.push(loopbackEvent{f: f})
+	}
+	return nil
+}
+
+// WhenConnectedTo calls function f each time when connected to peer.
+func (t *LoopbackTransport) WhenConnectedTo(addr string, f func()) {
+	t.Lock()
+	defer t.Unlock()
+	t.when[addr] = append(t.when[addr], f)
+}
+
+// Disconnect disconnects peer by address. Both sides get
+// EventDisconnected.
+func (t *LoopbackTransport) Disconnect(addr string) error {
+	t.Lock()
+	ch, ok := t.peers[addr]
+	if ok {
+		delete(t.peers, addr)
+	}
+	t.Unlock()
+	if !ok {
+		return ErrPeerNotConnected
+	}
+
+	peer := ch.peer.t
+	peer.Lock()
+	if peer.peers[t.addr] == ch.peer {
+		delete(peer.peers, t.addr)
+	}
+	peer.Unlock()
+
+	peer.inbox.push(loopbackEvent{c: ch.peer, e: EventDisconnected})
+	t.inbox.push(loopbackEvent{c: ch, e: EventDisconnected})
+	return nil
+}
+
+// Close disconnects all peers and removes transport from network. Readers
+// of closed transport get all events sent before close.
+func (t *LoopbackTransport) Close() error {
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return nil
+	}
+	t.closed = true
+	var addrs []string
+	for addr := range t.peers {
+		addrs = append(addrs, addr)
+	}
+	t.Unlock()
+
+	for _, addr := range addrs {
+		t.Disconnect(addr)
+	}
+	t.net.del(t)
+	t.inbox.close()
+	return nil
+}
+
+// run delivers inbox events to transport readers.
+func (t *LoopbackTransport) run() {
+	for {
+		ev, ok := t.inbox.pop()
+		if !ok {
+			return
+		}
+		if ev.f != nil {
+			ev.f()
+			continue
+		}
+		t.Lock()
+		readers := t.readers
+		t.Unlock()
+		var p Payload
+		if ev.e == EventData {
+			p = ev.p
+		}
+		for _, reader := range readers {
+			if reader(ev.c, p, ev.e) {
+				break
+			}
+		}
+	}
+}
+
+// loopbackChannel is loopback transport channel. It is compared by pointer.
+type loopbackChannel struct {
+	t      *LoopbackTransport // channel owner
+	peer   *loopbackChannel   // channel of other side
+	addr   string             // peer address
+	server bool               // peer connected to this side
+	id     atomic.Uint32      // last sent packet id
+}
+
+// Address returns peer address.
+func (c *loopbackChannel) Address() string {
+	return c.addr
+}
+
+// Send sends data to peer. The peer gets packet with the same id.
+func (c *loopbackChannel) Send(data []byte) (id int, err error) {
+	peer := c.peer.t
+	peer.Lock()
+	connected := peer.peers[c.t.addr] == c.peer
+	peer.Unlock()
+	if !connected {
+		return 0, ErrPeerNotConnected
+	}
+
+	id = int(c.id.Add(1))
+	p := loopbackPacket{id, append([]byte(nil), data...)}
+	peer.inbox.push(loopbackEvent{c: c.peer, p: p, e: EventData})
+	return
+}
+
+// ServerMode returns true if peer connected to this side.
+func (c *loopbackChannel) ServerMode() bool {
+	return c.server
+}
+
+// ClientMode returns true if this side connected to peer.
+func (c *loopbackChannel) ClientMode() bool {
+	return !c.server
+}
+
+// Triptime returns zero round-trip time.
+func (c *loopbackChannel) Triptime() time.Duration {
+	return 0
+}
+
+// String returns peer address.
+func (c *loopbackChannel) String() string {
+	return c.addr
+}
+
+// loopbackPacket is packet received from loopback channel.
+type loopbackPacket struct {
+	id   int
+	data []byte
+}
+
+// ID returns packet id.
+func (p loopbackPacket) ID() int {
+	return p.id
+}
+
+// Data returns packet data.
+func (p loopbackPacket) Data() []byte {
+	return p.data
+}
+
+// loopbackEvent is loopback transport inbox event. Event with function calls
+// the function instead of readers.
+type loopbackEvent struct {
+	c Channel
+	p loopbackPacket
+	e Event
+	f func()
+}
+
+// loopbackInbox is unbounded FIFO queue of loopback transport events.
+type loopbackInbox struct {
+	events []loopbackEvent
+	closed bool
+	*sync.Cond
+}
+
+// init initializes inbox.
+func (in *loopbackInbox) init() {
+	in.Cond = sync.NewCond(new(sync.Mutex))
+}
+
+// push adds event to inbox.
+func (in *loopbackInbox) push(ev loopbackEvent) {
+	in.L.Lock()
+	defer in.L.Unlock()
+	if in.closed {
+		return
+	}
+	in.events = append(in.events, ev)
+	in.Signal()
+}
+
+// pop waits and returns next event, it returns false when inbox is closed and
+// empty.
+func (in *loopbackInbox) pop() (ev loopbackEvent, ok bool) {
+	in.L.Lock()
+	defer in.L.Unlock()
+	for len(in.events) == 0 {
+		if in.closed {
+			return
+		}
+		in.Wait()
+	}
+	ev = in.events[0]
+	in.events[0] = loopbackEvent{}
+	in.events = in.events[1:]
+	return ev, true
+}
+
+// close closes inbox, events pushed after close are dropped.
+func (in *loopbackInbox) close() {
+	in.L.Lock()
+	defer in.L.Unlock()
+	in.closed = true
+	in.Signal()
+}
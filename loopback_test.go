@@ -0,0 +1,1418 @@
+package teomq_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teomq"
+	"github.com/teonet-go/teomq/broker"
+	"github.com/teonet-go/teomq/consumer"
+	"github.com/teonet-go/teomq/federation"
+	"github.com/teonet-go/teomq/producer"
+)
+
+// loopbackEvent is event received by loopback test reader.
+type loopbackEvent struct {
+	c    teomq.Channel
+	e    teomq.Event
+	id   int
+	data string
+}
+
+// loopbackReader returns reader which sends events to channel.
+func loopbackReader(events chan loopbackEvent) teomq.Reader {
+	return func(c teomq.Channel, p teomq.Payload, e teomq.Event) bool {
+		ev := loopbackEvent{c: c, e: e}
+		if p != nil {
+			ev.id, ev.data = p.ID(), string(p.Data())
+		}
+		events <- ev
+		return true
+	}
+}
+
+// wait waits next event.
+func wait(events chan loopbackEvent) (ev loopbackEvent, ok bool) {
+	select {
+	case ev = <-events:
+		return ev, true
+	case <-time.After(time.Second):
+		return
+	}
+}
+
+func TestLoopback(t *testing.T) {
+
+	// Create network and connect client to server
+	net := teomq.NewLoopback()
+	server, client := net.Transport("server"), net.Transport("client")
+	serverEvents, clientEvents := make(chan loopbackEvent, 8),
+		make(chan loopbackEvent, 8)
+	server.AddReader(loopbackReader(serverEvents))
+	client.AddReader(loopbackReader(clientEvents))
+	if err := client.ConnectTo("unknown"); err != teomq.ErrPeerNotFound {
+		t.Errorf("wrong connect to unknown peer error: %v", err)
+		return
+	}
+	if err := client.ConnectTo("server"); err != nil {
+		t.Error("can't connect to server:", err)
+		return
+	}
+
+	// Both sides should get connected event
+	ev, ok := wait(serverEvents)
+	if !ok || ev.e != teomq.EventConnected || !ev.c.ServerMode() ||
+		ev.c.Address() != "client" {
+		t.Errorf("wrong server connected event %v", ev)
+		return
+	}
+	serverCh := ev.c
+	ev, ok = wait(clientEvents)
+	if !ok || ev.e != teomq.EventConnected || !ev.c.ClientMode() ||
+		ev.c.Address() != "server" {
+		t.Errorf("wrong client connected event %v", ev)
+		return
+	}
+
+	// Peer should get packets in order with sent id
+	for i := 1; i <= 3; i++ {
+		id, err := client.SendTo("server", fmt.Appendf(nil, "data %d", i))
+		if err != nil || id != i {
+			t.Errorf("wrong send id %d, error: %v", id, err)
+			return
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		ev, ok = wait(serverEvents)
+		if !ok || ev.e != teomq.EventData || ev.c != serverCh ||
+			ev.id != i || ev.data != fmt.Sprintf("data %d", i) {
+			t.Errorf("wrong data event %v", ev)
+			return
+		}
+	}
+
+	// Both sides should get disconnected event when client closed
+	client.Close()
+	ev, ok = wait(serverEvents)
+	if !ok || ev.e != teomq.EventDisconnected || ev.c != serverCh {
+		t.Errorf("wrong server disconnected event %v", ev)
+		return
+	}
+	if _, err := serverCh.Send([]byte("data")); err == nil {
+		t.Error("send to closed peer should fail")
+		return
+	}
+}
+
+func TestLoopbackBroker(t *testing.T) {
+
+	// Run broker, consumer and producer in loopback network
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Send messages and wait answers
+	const num = 10
+	answers := make(chan string, num)
+	for i := range num {
+		_, err = pro.Send(fmt.Appendf(nil, "message %d", i),
+			func(id int, data []byte, err error) bool {
+				if err != nil {
+					answers <- err.Error()
+					return true
+				}
+				answers <- string(data)
+				return true
+			},
+		)
+		if err != nil {
+			t.Error("can't send message:", err)
+			return
+		}
+	}
+	got := make(map[string]bool)
+	for range num {
+		select {
+		case ans := <-answers:
+			got[ans] = true
+		case <-time.After(5 * time.Second):
+			t.Errorf("got %d answers, expected %d", len(got), num)
+			return
+		}
+	}
+	for i := range num {
+		if ans := fmt.Sprintf("answer to message %d", i); !got[ans] {
+			t.Errorf("answer %q not received", ans)
+			return
+		}
+	}
+}
+
+func TestLoopbackClose(t *testing.T) {
+
+	// Run broker and producer which are closed when context done
+	net := teomq.NewLoopback()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	br, err := broker.NewContext(ctx, "broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	pro, err := producer.NewContext(ctx, "producer", "broker",
+		net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+
+	// Send message which is not answered because there is no consumers
+	answer := make(chan error, 1)
+	_, err = pro.Send([]byte("message"),
+		func(id int, data []byte, err error) bool {
+			answer <- err
+			return true
+		},
+	)
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+
+	// Waiting answer callback should get ErrClosed when context done
+	cancel()
+	select {
+	case err = <-answer:
+		if err != producer.ErrClosed {
+			t.Errorf("wrong answer error %v, expected %v", err,
+				producer.ErrClosed)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Error("producer was not closed")
+		return
+	}
+	if _, err = pro.Send([]byte("message")); err != producer.ErrClosed {
+		t.Errorf("wrong send error %v, expected %v", err, producer.ErrClosed)
+		return
+	}
+	if err = br.Close(); err != nil {
+		t.Error("can't close broker:", err)
+		return
+	}
+}
+
+func TestLoopbackDrain(t *testing.T) {
+
+	// Run broker without consumers and producer
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Send message which waits consumer in broker queue
+	answer := make(chan error, 1)
+	_, err = pro.Send([]byte("message"),
+		func(id int, data []byte, err error) bool {
+			answer <- err
+			return true
+		},
+	)
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+	for br.QueueLen(teomq.DefaultQueue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Producer should get going away error of queued message when broker
+	// drained without storage
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = br.Drain(ctx); err != nil {
+		t.Error("can't drain broker:", err)
+		return
+	}
+	select {
+	case err = <-answer:
+		if err != teomq.ErrBrokerGoingAway {
+			t.Errorf("wrong answer error %v, expected %v", err,
+				teomq.ErrBrokerGoingAway)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Error("going away answer was not received")
+		return
+	}
+	if _, err = pro.Send([]byte("message")); err != teomq.ErrBrokerGoingAway {
+		t.Errorf("wrong send error %v, expected %v", err,
+			teomq.ErrBrokerGoingAway)
+		return
+	}
+}
+
+func TestLoopbackHandoff(t *testing.T) {
+
+	// Run broker without consumers and send messages to it
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+	const num = 3
+	for i := range num {
+		if _, err = pro.Send(fmt.Appendf(nil, "message %d", i)); err != nil {
+			t.Error("can't send message:", err)
+			return
+		}
+	}
+	for br.QueueLen(teomq.DefaultQueue) < num {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Drain broker and hand off its queue to storage
+	dir := t.TempDir()
+	storage, err := broker.NewFileStorage(dir, broker.SyncNever)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+	if err = br.Shutdown(context.Background(), storage); err != nil {
+		t.Error("can't shutdown broker:", err)
+		return
+	}
+	storage.Close()
+
+	// Broker started with handoff storage should restore messages
+	storage, err = broker.NewFileStorage(dir, broker.SyncNever)
+	if err != nil {
+		t.Error("can't open storage:", err)
+		return
+	}
+	br, err = broker.New("broker", storage,
+		teomq.NewLoopback().Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	if l := br.QueueLen(teomq.DefaultQueue); l != num {
+		t.Errorf("wrong restored queue length %d, expected %d", l, num)
+		return
+	}
+}
+
+func TestLoopbackNoAnswer(t *testing.T) {
+
+	// Run broker, legacy consumer which does not answer and producer
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	co := net.Transport("consumer")
+	events := make(chan loopbackEvent, 8)
+	co.AddReader(loopbackReader(events))
+	if err = co.ConnectTo("broker"); err != nil {
+		t.Error("can't connect consumer:", err)
+		return
+	}
+	co.SendTo("broker", teomq.ConsumerHello)
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Send message and wait until consumer gets it
+	answer := make(chan error, 1)
+	_, err = pro.Send([]byte("message"),
+		func(id int, data []byte, err error) bool {
+			answer <- err
+			return true
+		},
+	)
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+	for {
+		ev, ok := wait(events)
+		if !ok {
+			t.Error("consumer did not get message")
+			return
+		}
+		if ev.data == "message" {
+			break
+		}
+	}
+
+	// Producer should get no answer error when consumer disconnected
+	co.Close()
+	select {
+	case err = <-answer:
+		if err != teomq.ErrNoAnswer {
+			t.Errorf("wrong answer error %v, expected %v", err,
+				teomq.ErrNoAnswer)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Error("no answer error was not received")
+		return
+	}
+}
+
+func TestLoopbackErrorAnswer(t *testing.T) {
+
+	// Run broker, consumer which returns remote error and producer
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			return nil, teomq.NewRemoteError(404, "user not found")
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Producer should get remote error returned by consumer
+	answer := make(chan error, 1)
+	_, err = pro.Send([]byte("get user"),
+		func(id int, data []byte, err error) bool {
+			answer <- err
+			return true
+		},
+	)
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+	select {
+	case err = <-answer:
+		rerr, ok := err.(*teomq.RemoteError)
+		if !ok || rerr.Code != 404 || rerr.Message != "user not found" {
+			t.Errorf("wrong answer error %v", err)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Error("error answer was not received")
+		return
+	}
+}
+
+func TestLoopbackRequest(t *testing.T) {
+
+	// Run broker, consumer and producer in loopback network
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Request should return answer
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := pro.Request(ctx, []byte("request"))
+	if err != nil || string(data) != "answer to request" {
+		t.Errorf("wrong answer %q, error: %v", data, err)
+		return
+	}
+
+	// Request to queue without consumers should return context error
+	reqCtx, reqCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer reqCancel()
+	_, err = pro.Request(reqCtx, []byte("request"), producer.Queue("none"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("wrong request error %v, expected %v", err,
+			context.DeadlineExceeded)
+		return
+	}
+
+	// Canceled call should be done and removed from waiting messages
+	call, err := pro.SendAsync(ctx, []byte("request"), producer.Queue("none"))
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+	call.Cancel()
+	<-call.Done()
+	if _, err = call.Answer(); err != context.Canceled {
+		t.Errorf("wrong call error %v, expected %v", err, context.Canceled)
+		return
+	}
+	if err = pro.Shutdown(ctx); err != nil {
+		t.Error("messages were not removed:", err)
+		return
+	}
+}
+
+func TestLoopbackGather(t *testing.T) {
+
+	// Run broker, consumer and producer in loopback network
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Gather in normal mode should return one answer
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	replies, err := pro.Gather(ctx, []byte("request"))
+	if err != nil || len(replies) != 1 ||
+		string(replies[0].Data) != "answer to request" {
+		t.Errorf("wrong replies %v, error: %v", replies, err)
+		return
+	}
+}
+
+func TestLoopbackOutbox(t *testing.T) {
+
+	// Run broker, consumer and producer with outbox which drops oldest
+	// messages
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	gotCancelled := make(chan struct{}, 1)
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			if string(p.Data()) == "cancelled" {
+				gotCancelled <- struct{}{}
+			}
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	transport := net.Transport("producer")
+	pro, err := producer.New("producer", "broker", transport,
+		producer.OutboxSize(2), producer.OutboxPolicy(producer.OutboxDropOldest))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = pro.Request(ctx, []byte("request")); err != nil {
+		t.Error("can't get answer:", err)
+		return
+	}
+
+	// Messages sent while broker is unreachable should be queued in outbox
+	transport.Disconnect("broker")
+	answers := make(chan string, 3)
+	for i := range 3 {
+		id, err := pro.Send(fmt.Appendf(nil, "message %d", i),
+			func(id int, data []byte, err error) bool {
+				if err != nil {
+					answers <- err.Error()
+					return true
+				}
+				answers <- string(data)
+				return true
+			},
+		)
+		if err != nil || id != 0 {
+			t.Errorf("wrong send id %d, error: %v", id, err)
+			return
+		}
+	}
+
+	// Oldest message should be dropped and other sent when producer
+	// connected to broker again
+	if err = transport.ConnectTo("broker"); err != nil {
+		t.Error("can't connect to broker:", err)
+		return
+	}
+	got := make(map[string]bool)
+	for range 3 {
+		select {
+		case ans := <-answers:
+			got[ans] = true
+		case <-time.After(time.Second):
+			t.Errorf("got answers %v", got)
+			return
+		}
+	}
+	for _, ans := range []string{producer.ErrOutboxOverflow.Error(),
+		"answer to message 1", "answer to message 2"} {
+		if !got[ans] {
+			t.Errorf("answer %q not received", ans)
+			return
+		}
+	}
+
+	// Cancelled call should be removed from outbox and not delivered
+	transport.Disconnect("broker")
+	c, err := pro.SendAsync(ctx, []byte("cancelled"))
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+	c.Cancel()
+	if err = transport.ConnectTo("broker"); err != nil {
+		t.Error("can't connect to broker:", err)
+		return
+	}
+	if _, err = pro.Request(ctx, []byte("request")); err != nil {
+		t.Error("can't get answer:", err)
+		return
+	}
+	select {
+	case <-gotCancelled:
+		t.Error("cancelled message was delivered")
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLoopbackFailover(t *testing.T) {
+
+	// Run main and standby brokers, consumer and producer which fail over
+	// to standby broker
+	net := teomq.NewLoopback()
+	main, err := broker.New("main", net.Transport("main"))
+	if err != nil {
+		t.Error("can't create main broker:", err)
+		return
+	}
+	defer main.Close()
+	standby, err := broker.New("standby", net.Transport("standby"))
+	if err != nil {
+		t.Error("can't create standby broker:", err)
+		return
+	}
+	defer standby.Close()
+	co, err := consumer.New("consumer", "main",
+		func(p *consumer.Packet) ([]byte, error) {
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer"), teomq.Brokers{"standby"},
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	pro, err := producer.New("producer", "main", net.Transport("producer"),
+		teomq.Brokers{"standby"})
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// request sends request until it answered or timeout expired
+	request := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for {
+			reqCtx, reqCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			data, err := pro.Request(reqCtx, []byte("request"))
+			reqCancel()
+			if err == nil && string(data) == "answer to request" {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Request should be answered by main broker consumer, and by standby
+	// broker consumer when main broker closed
+	if err = request(); err != nil {
+		t.Error("main broker request error:", err)
+		return
+	}
+	main.Close()
+	if err = request(); err != nil {
+		t.Error("standby broker request error:", err)
+		return
+	}
+}
+
+func TestLoopbackCluster(t *testing.T) {
+
+	// Run cluster of three brokers
+	net := teomq.NewLoopback()
+	addrs := broker.Cluster{"b1", "b2", "b3"}
+	brokers := make(map[string]*broker.Broker)
+	for _, addr := range addrs {
+		br, err := broker.New(addr, net.Transport(addr), addrs,
+			broker.ElectionTimeout(100*time.Millisecond))
+		if err != nil {
+			t.Error("can't create broker:", err)
+			return
+		}
+		defer br.Close()
+		brokers[addr] = br
+	}
+
+	// eventually waits until function f returns true or timeout expired
+	eventually := func(f func() bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); !f(); {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return true
+	}
+
+	// leader returns leader of queue when brokers know the same leader which
+	// is one of them
+	leader := func(queue string, addrs ...string) (leader string) {
+		eventually(func() bool {
+			leader = brokers[addrs[0]].Leader(queue)
+			if !slices.Contains(addrs, leader) {
+				return false
+			}
+			for _, addr := range addrs {
+				if l := brokers[addr].Leader(queue); l == "" || l != leader {
+					return false
+				}
+			}
+			return true
+		})
+		return
+	}
+
+	// Send message to queue which has no consumers, the message is sent
+	// again with the same idempotency key until its leader queues it
+	pro, err := producer.New("producer", "b1", net.Transport("producer"),
+		teomq.Brokers{"b2", "b3"})
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+	if !eventually(func() bool {
+		l := brokers["b1"].Leader("jobs")
+		if l != "" && brokers[l].QueueLen("jobs") == 1 {
+			return true
+		}
+		pro.Send([]byte("job"), producer.Queue("jobs"),
+			producer.IdempotencyKey("job"))
+		time.Sleep(10 * time.Millisecond)
+		return false
+	}) {
+		t.Error("message was not queued by leader")
+		return
+	}
+
+	// Other broker should become leader and restore replicated message when
+	// leader closed
+	closed := leader("jobs", "b1", "b2", "b3")
+	brokers[closed].Close()
+	var alive []string
+	for _, addr := range addrs {
+		if addr != closed {
+			alive = append(alive, addr)
+		}
+	}
+	l := leader("jobs", alive...)
+	if l == "" || l == closed {
+		t.Error("new leader of queue jobs was not elected")
+		return
+	}
+	if !eventually(func() bool { return brokers[l].QueueLen("jobs") == 1 }) {
+		t.Errorf("wrong replicated queue length %d, expected 1",
+			brokers[l].QueueLen("jobs"))
+		return
+	}
+
+	// Consumer connected to one broker should connect to leaders of its
+	// queues and get replicated message
+	queues := []string{teomq.DefaultQueue, "jobs", "logs", "audit"}
+	messages := make(chan string, 16)
+	co, err := consumer.New("consumer", alive[1],
+		func(p *consumer.Packet) ([]byte, error) {
+			messages <- string(p.Data())
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer"), consumer.Queues(queues),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	select {
+	case data := <-messages:
+		if data != "job" {
+			t.Errorf("wrong message %q, expected %q", data, "job")
+			return
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("replicated message was not received")
+		return
+	}
+
+	// Producer should get answers of all queues which leaders are spread
+	// over cluster brokers
+	leaders := make(map[string]bool)
+	for _, queue := range queues {
+		if !eventually(func() bool {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				50*time.Millisecond)
+			defer cancel()
+			data, err := pro.Request(ctx, []byte("request"),
+				producer.Queue(queue))
+			return err == nil && string(data) == "answer to request"
+		}) {
+			t.Errorf("queue %q request was not answered", queue)
+			return
+		}
+		l := leader(queue, alive...)
+		if l == "" {
+			t.Errorf("brokers know different leaders of queue %q", queue)
+			return
+		}
+		leaders[l] = true
+	}
+	if len(leaders) < 2 {
+		t.Errorf("queues have one leader %v, expected spread leaders",
+			leaders)
+		return
+	}
+}
+
+func TestLoopbackFederation(t *testing.T) {
+
+	// Run upstream and downstream brokers, downstream consumer, link and
+	// upstream producer
+	net := teomq.NewLoopback()
+	for _, addr := range []string{"upstream", "downstream"} {
+		br, err := broker.New(addr, net.Transport(addr))
+		if err != nil {
+			t.Error("can't create broker:", err)
+			return
+		}
+		defer br.Close()
+	}
+	co, err := consumer.New("consumer", "downstream",
+		func(p *consumer.Packet) ([]byte, error) {
+			switch string(p.Data()) {
+			case "fail":
+				return nil, teomq.NewRemoteError(7, "failed")
+			case "ack":
+				return nil, nil
+			}
+			p.AnswerHeader().Set("queue", p.Queue())
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer"), consumer.Queues{"jobs"},
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	link, err := federation.New("link", "upstream", "downstream",
+		federation.UpstreamAttr{net.Transport("link-upstream")},
+		federation.DownstreamAttr{net.Transport("link-downstream")},
+		federation.Queue("jobs"),
+		federation.Filter(func(p *consumer.Packet) bool {
+			return string(p.Data()) != "skip"
+		}),
+	)
+	if err != nil {
+		t.Error("can't create link:", err)
+		return
+	}
+	defer link.Close()
+	pro, err := producer.New("producer", "upstream", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Upstream producer should get answer of downstream consumer
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := pro.SendAsync(ctx, []byte("request"))
+	if err != nil {
+		t.Error("can't send request:", err)
+		return
+	}
+	<-c.Done()
+	ans, err := c.Answer()
+	if err != nil {
+		t.Error("request error:", err)
+		return
+	}
+	if string(ans.Data()) != "answer to request" {
+		t.Errorf("wrong answer %q", ans.Data())
+		return
+	}
+	if q := ans.Header().Get("queue"); q != "jobs" {
+		t.Errorf("wrong answer header queue %q, expected %q", q, "jobs")
+		return
+	}
+
+	// Upstream producer should get remote error of downstream consumer
+	_, err = pro.Request(ctx, []byte("fail"))
+	var rerr *teomq.RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != 7 {
+		t.Errorf("wrong request error %v, expected remote error", err)
+		return
+	}
+
+	// Upstream producer should get empty answer of downstream consumer which
+	// acknowledged message without answer
+	data, err := pro.Request(ctx, []byte("ack"))
+	if err != nil || len(data) != 0 {
+		t.Errorf("wrong acknowledged request answer %q, error %v", data, err)
+		return
+	}
+
+	// Filtered message should not be forwarded and answered
+	ctx, cancel = context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	if _, err = pro.Request(ctx, []byte("skip")); err == nil {
+		t.Error("filtered message was answered")
+		return
+	}
+}
+
+func TestLoopbackDedup(t *testing.T) {
+
+	// Run broker, consumer which counts processed messages and producer
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	var processed atomic.Int32
+	got, release := make(chan struct{}, 4), make(chan struct{})
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			n := processed.Add(1)
+			got <- struct{}{}
+			<-release
+			if string(p.Data()) == "ack" {
+				return nil, nil
+			}
+			return fmt.Appendf(nil, "answer %d", n), nil
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Send message and its retry while the message is processed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	key := producer.IdempotencyKey("bill-1")
+	c1, err := pro.SendAsync(ctx, []byte("bill"), key)
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Error("consumer did not get message")
+		return
+	}
+	c2, err := pro.SendAsync(ctx, []byte("bill"), key)
+	if err != nil {
+		t.Error("can't send retry:", err)
+		return
+	}
+	close(release)
+
+	// Both messages should get answer of the first message
+	for _, c := range []*producer.Call{c1, c2} {
+		<-c.Done()
+		ans, err := c.Answer()
+		if err != nil {
+			t.Error("answer error:", err)
+			return
+		}
+		if string(ans.Data()) != "answer 1" {
+			t.Errorf("wrong answer %q", ans.Data())
+			return
+		}
+	}
+
+	// Retry after answer should get cached answer, message with other key
+	// should be processed
+	data, err := pro.Request(ctx, []byte("bill"), key)
+	if err != nil || string(data) != "answer 1" {
+		t.Errorf("wrong retry answer %q, error %v", data, err)
+		return
+	}
+	data, err = pro.Request(ctx, []byte("bill"),
+		producer.IdempotencyKey("bill-2"))
+	if err != nil || string(data) != "answer 2" {
+		t.Errorf("wrong answer %q, error %v", data, err)
+		return
+	}
+
+	// Retry of message acknowledged without answer should get empty answer
+	key = producer.IdempotencyKey("ack-1")
+	for range 2 {
+		data, err = pro.Request(ctx, []byte("ack"), key)
+		if err != nil || len(data) != 0 {
+			t.Errorf("wrong acknowledged answer %q, error %v", data, err)
+			return
+		}
+	}
+	if n := processed.Load(); n != 3 {
+		t.Errorf("wrong number of processed messages %d, expected 3", n)
+		return
+	}
+}
+
+func TestLoopbackConsumerBusy(t *testing.T) {
+
+	// Run fake broker and leader, and consumer which processes one message
+	// at a time and blocks
+	net := teomq.NewLoopback()
+	br, leader := net.Transport("broker"), net.Transport("leader")
+	events, leaderEvents := make(chan loopbackEvent, 8),
+		make(chan loopbackEvent, 8)
+	br.AddReader(loopbackReader(events))
+	leader.AddReader(loopbackReader(leaderEvents))
+	release := make(chan struct{})
+	defer close(release)
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			<-release
+			return nil, nil
+		},
+		net.Transport("consumer"), consumer.Prefetch(1),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+
+	// Send more messages than prefetch and redirect control message
+	var ch teomq.Channel
+	for ch == nil {
+		ev, ok := wait(events)
+		if !ok {
+			t.Error("consumer did not send hello")
+			return
+		}
+		if teomq.IsHello([]byte(ev.data)) {
+			ch = ev.c
+		}
+	}
+	ch.Send([]byte("m1"))
+	ch.Send([]byte("m2"))
+	data, _ := teomq.Control{Cmd: teomq.CtrlRedirect, Broker: "leader"}.
+		MarshalBinary()
+	ch.Send(data)
+
+	// Busy consumer should get redirect and send hello to leader
+	for {
+		ev, ok := wait(leaderEvents)
+		if !ok {
+			t.Error("busy consumer was not redirected")
+			return
+		}
+		if teomq.IsHello([]byte(ev.data)) {
+			break
+		}
+	}
+}
+
+func TestLoopbackReject(t *testing.T) {
+
+	// Run broker, consumer which rejects messages and producer
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			return nil, consumer.ErrReject
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Producer of rejected message should get no answer error before
+	// answer timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = pro.Request(ctx, []byte("message"))
+	if !errors.Is(err, teomq.ErrNoAnswer) {
+		t.Errorf("wrong request error %v, expected %v", err,
+			teomq.ErrNoAnswer)
+		return
+	}
+	if n := len(br.DeadLetters()); n != 1 {
+		t.Errorf("wrong number of dead letters %d, expected 1", n)
+		return
+	}
+}
+
+func TestLoopbackRedelivery(t *testing.T) {
+
+	// Run broker with short visibility timeout, consumer which ignores the
+	// first delivery of messages and all deliveries of "ignore" message, and
+	// producer
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"),
+		broker.VisibilityTimeout(100*time.Millisecond), broker.MaxDeliveries(3))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	release := make(chan struct{})
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			if p.Deliveries() == 1 || string(p.Data()) == "ignore" {
+				<-release
+				return nil, errors.New("ignored")
+			}
+			return fmt.Appendf(nil, "delivery %d", p.Deliveries()), nil
+		},
+		net.Transport("consumer"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	defer close(release)
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Message ignored by consumer should be redelivered after visibility
+	// timeout and answered on the second delivery
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := pro.Request(ctx, []byte("message"))
+	if err != nil || string(data) != "delivery 2" {
+		t.Errorf("wrong answer %q, error %v", data, err)
+		return
+	}
+
+	// Message ignored on every delivery should move to dead-letter queue
+	// after maximum number of deliveries
+	_, err = pro.Request(ctx, []byte("ignore"))
+	if !errors.Is(err, teomq.ErrNoAnswer) {
+		t.Errorf("wrong request error %v, expected %v", err,
+			teomq.ErrNoAnswer)
+		return
+	}
+	dls := br.DeadLetters()
+	if len(dls) != 1 || dls[0].Reason != broker.DeadMaxDeliveries ||
+		dls[0].Deliveries != 3 {
+		t.Errorf("wrong dead letters %v", dls)
+		return
+	}
+}
+
+func TestLoopbackNamedQueues(t *testing.T) {
+
+	// Run broker, consumers of "a" and "b" queues, consumer of default queue
+	// and producer
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	for _, name := range []string{"a", "b", ""} {
+		attr := []any{net.Transport("consumer-" + name)}
+		if name != "" {
+			attr = append(attr, consumer.Queues{name})
+		}
+		co, err := consumer.New("consumer", "broker",
+			func(p *consumer.Packet) ([]byte, error) {
+				return fmt.Appendf(nil, "%s:%s", name, p.Queue()), nil
+			},
+			attr...,
+		)
+		if err != nil {
+			t.Error("can't create consumer:", err)
+			return
+		}
+		defer co.Close()
+	}
+	pro, err := producer.New("producer", "broker", net.Transport("producer"))
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+
+	// Each consumer should get messages of its own queue only, messages of
+	// default queue should go to default queue consumer
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for range 3 {
+		for _, queue := range []string{"a", "b", ""} {
+			var attr []any
+			if queue != "" {
+				attr = append(attr, producer.Queue(queue))
+			}
+			data, err := pro.Request(ctx, []byte("message"), attr...)
+			if err != nil {
+				t.Error("request error:", err)
+				return
+			}
+			expected := queue + ":" + queue
+			if queue == "" {
+				expected = ":" + broker.DefaultQueue
+			}
+			if string(data) != expected {
+				t.Errorf("wrong answer %q, expected %q", data, expected)
+				return
+			}
+		}
+	}
+	for _, queue := range []string{"a", "b", broker.DefaultQueue} {
+		if n := br.QueueLen(queue); n != 0 {
+			t.Errorf("wrong queue %q length %d, expected 0", queue, n)
+			return
+		}
+	}
+}
+
+func TestLoopbackRestartInflight(t *testing.T) {
+
+	// Run broker with persistent storage, consumer which holds message
+	// in-flight and producer
+	dir := t.TempDir()
+	st, err := broker.NewFileStorage(dir, broker.SyncNever)
+	if err != nil {
+		t.Error("can't create storage:", err)
+		return
+	}
+	net := teomq.NewLoopback()
+	br, err := broker.New("broker", st, net.Transport("broker"))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	got, release := make(chan struct{}, 1), make(chan struct{})
+	co, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			got <- struct{}{}
+			<-release
+			return nil, errors.New("broker restarted")
+		},
+		net.Transport("consumer-1"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co.Close()
+	defer close(release)
+	pt := net.Transport("producer")
+	pro, err := producer.New("producer", "broker", pt)
+	if err != nil {
+		t.Error("can't create producer:", err)
+		return
+	}
+	defer pro.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	c, err := pro.SendAsync(ctx, []byte("message"))
+	if err != nil {
+		t.Error("can't send message:", err)
+		return
+	}
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Error("consumer did not get message")
+		return
+	}
+
+	// Restart broker with short answer timeout while message is in-flight
+	br.Close()
+	if st, err = broker.NewFileStorage(dir, broker.SyncNever); err != nil {
+		t.Error("can't open storage:", err)
+		return
+	}
+	br, err = broker.New("broker", st, net.Transport("broker"),
+		broker.AnswerTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Error("can't create broker:", err)
+		return
+	}
+	defer br.Close()
+	if err = pt.ConnectTo("broker"); err != nil {
+		t.Error("can't connect producer:", err)
+		return
+	}
+
+	// Redelivered message answered after answer timeout of previous delivery
+	// should be answered to producer
+	co2, err := consumer.New("consumer", "broker",
+		func(p *consumer.Packet) ([]byte, error) {
+			time.Sleep(200 * time.Millisecond)
+			return append([]byte("answer to "), p.Data()...), nil
+		},
+		net.Transport("consumer-2"),
+	)
+	if err != nil {
+		t.Error("can't create consumer:", err)
+		return
+	}
+	defer co2.Close()
+	<-c.Done()
+	ans, err := c.Answer()
+	if err != nil {
+		t.Error("answer error:", err)
+		return
+	}
+	if string(ans.Data()) != "answer to message" {
+		t.Errorf("wrong answer %q", ans.Data())
+		return
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2023-24 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Message module provides message envelope which
+// carries message metadata together with message data.
+
+package teomq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Acknowledge commands sent by consumer to broker
+const (
+	CmdAck    = "ack"    // message processed
+	CmdNack   = "nack"   // message not processed and should be redelivered
+	CmdReject = "reject" // message rejected and should not be redelivered
+)
+
+// messageMagic starts message envelope.
+var messageMagic = []byte{0xFF, 'T', 'M', 'Q'}
+
+// Message fields tags
+const (
+	tagDeliveries byte = iota + 1
+	tagQueue
+	tagTTL
+	tagPriority
+	tagDelay
+	tagDeliverAt
+	tagKey
+	tagHeader
+	tagFanOut
+)
+
+// MaxPriority is the highest message priority. Messages with higher priority
+// are sent by broker to consumers before messages with lower priority. The
+// default message priority is 0.
+const MaxPriority = 9
+
+var ErrWrongMessage = errors.New("wrong message envelope")
+
+// Message is message envelope sent by producers to broker and by broker to
+// consumers. Envelope contains message metadata and message data.
+//
+// Binary format: magic(4) | fields | data, where fields are encoded as
+// tag(1) | length(uvarint) | value and finished by zero tag. Unknown fields
+// are skipped by receiver.
+type Message struct {
+	Deliveries int           // Number of delivery attempts including this one
+	Queue      string        // Queue name
+	TTL        time.Duration // Message time-to-live in broker queue
+	Priority   int           // Message priority 0..MaxPriority
+	Delay      time.Duration // Delay before message delivery
+	DeliverAt  time.Time     // Time before which message is not delivered
+	Key        string        // Routing key of message
+	Header     Header        // Message header
+	FanOut     bool          // Producer waits fan-out control message
+	Data       []byte        // Message data
+}
+
+// IsMessage returns true if data contains message envelope.
+func IsMessage(data []byte) bool {
+	return bytes.HasPrefix(data, messageMagic)
+}
+
+// HasMetadata returns true if any message metadata field is set. Message
+// without metadata may be sent without envelope.
+func (m Message) HasMetadata() bool {
+	return m.Deliveries > 0 || len(m.Queue) > 0 || m.TTL > 0 ||
+		m.Priority > 0 || m.Delay > 0 || !m.DeliverAt.IsZero() ||
+		len(m.Key) > 0 || len(m.Header) > 0 || m.FanOut
+}
+
+// MarshalBinary marshals message envelope.
+func (m Message) MarshalBinary() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	buf.Write(messageMagic)
+
+	if m.Deliveries > 0 {
+		writeField(buf, tagDeliveries,
+			binary.AppendUvarint(nil, uint64(m.Deliveries)))
+	}
+	if len(m.Queue) > 0 {
+		writeField(buf, tagQueue, []byte(m.Queue))
+	}
+	if m.TTL > 0 {
+		writeField(buf, tagTTL,
+			binary.AppendUvarint(nil, uint64(max(1, m.TTL.Milliseconds()))))
+	}
+	if m.Priority > 0 {
+		writeField(buf, tagPriority, []byte{byte(min(m.Priority, MaxPriority))})
+	}
+	if m.Delay > 0 {
+		writeField(buf, tagDelay,
+			binary.AppendUvarint(nil, uint64(max(1, m.Delay.Milliseconds()))))
+	}
+	if !m.DeliverAt.IsZero() {
+		writeField(buf, tagDeliverAt,
+			binary.AppendUvarint(nil, uint64(max(0, m.DeliverAt.UnixMilli()))))
+	}
+	if len(m.Key) > 0 {
+		writeField(buf, tagKey, []byte(m.Key))
+	}
+	if len(m.Header) > 0 {
+		header, _ := m.Header.MarshalBinary()
+		writeField(buf, tagHeader, header)
+	}
+	if m.FanOut {
+		writeField(buf, tagFanOut, nil)
+	}
+	buf.WriteByte(0)
+	buf.Write(m.Data)
+
+	data = buf.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshals message envelope.
+func (m *Message) UnmarshalBinary(data []byte) (err error) {
+	if !IsMessage(data) {
+		return ErrWrongMessage
+	}
+	*m = Message{}
+	buf := bytes.NewBuffer(data[len(messageMagic):])
+
+	for {
+		tag, value, err := readField(buf)
+		if err != nil {
+			return err
+		}
+		if tag == 0 {
+			break
+		}
+		switch tag {
+		case tagDeliveries:
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return ErrWrongMessage
+			}
+			m.Deliveries = int(v)
+		case tagQueue:
+			m.Queue = string(value)
+		case tagTTL:
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return ErrWrongMessage
+			}
+			m.TTL = time.Duration(v) * time.Millisecond
+		case tagPriority:
+			if len(value) != 1 {
+				return ErrWrongMessage
+			}
+			m.Priority = min(int(value[0]), MaxPriority)
+		case tagDelay:
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return ErrWrongMessage
+			}
+			m.Delay = time.Duration(v) * time.Millisecond
+		case tagDeliverAt:
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return ErrWrongMessage
+			}
+			m.DeliverAt = time.UnixMilli(int64(v))
+		case tagKey:
+			m.Key = string(value)
+		case tagHeader:
+			if err := m.Header.UnmarshalBinary(value); err != nil {
+				return err
+			}
+		case tagFanOut:
+			m.FanOut = true
+		}
+	}
+	m.Data = buf.Bytes()
+
+	return
+}
+
+// writeField writes tagged field to buffer.
+func writeField(buf *bytes.Buffer, tag byte, value []byte) {
+	buf.WriteByte(tag)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(value))))
+	buf.Write(value)
+}
+
+// readField reads tagged field from buffer. Zero tag ends fields.
+func readField(buf *bytes.Buffer) (tag byte, value []byte, err error) {
+	if tag, err = buf.ReadByte(); err != nil || tag == 0 {
+		return
+	}
+	l, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return
+	}
+	if l > uint64(buf.Len()) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	value = buf.Next(int(l))
+	return
+}
+
+// AckCommand makes acknowledge command for message with id. The cmd
+// parameter is CmdAck, CmdNack or CmdReject.
+func AckCommand(cmd string, id int) []byte {
+	return fmt.Appendf(nil, "%s/%d", cmd, id)
+}
+
+// ParseAck parses acknowledge command. It returns command name, message id
+// and true if data contains acknowledge command.
+func ParseAck(data []byte) (cmd string, id int, ok bool) {
+	name, idstr, found := bytes.Cut(data, []byte("/"))
+	if !found {
+		return
+	}
+	switch string(name) {
+	case CmdAck, CmdNack, CmdReject:
+	default:
+		return
+	}
+	id, err := strconv.Atoi(string(idstr))
+	if err != nil {
+		return
+	}
+	return string(name), id, true
+}
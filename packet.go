@@ -9,17 +9,42 @@ package teomq
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 )
 
+// PacketVersion is current packet format version. Packets without header
+// are marshalled in version 0 format: id(4) | data, which is understood by
+// all peers. Packets with header are marshalled in version 1 format:
+// magic(4) | version(1) | id(4) | header | data. Packets with flags are
+// marshalled in version 2 format:
+// magic(4) | version(1) | flags(1) | id(4) | header | data.
+const PacketVersion = 2
+
+// PacketFlags are packet flags.
+type PacketFlags byte
+
+// Packet flags
+const (
+	// FlagError marks error answer, its data contains marshalled RemoteError.
+	FlagError PacketFlags = 1 << iota
+)
+
+// packetMagic starts packet in version 1 and above format.
+var packetMagic = []byte{0xFF, 'T', 'M', 'P'}
+
+var ErrWrongPacketVersion = errors.New("wrong packet version")
+
 // Packet defines answer message
 type Packet struct {
-	id   uint32
-	data []byte
+	id     uint32
+	data   []byte
+	header Header
+	flags  PacketFlags
 }
 
 // NewPacket creates new packet.
 func NewPacket(id uint32, data []byte) *Packet {
-	return &Packet{id, data}
+	return &Packet{id: id, data: data}
 }
 
 // ID returns message ID.
@@ -32,11 +57,77 @@ func (p Packet) Data() []byte {
 	return p.data
 }
 
+// Header returns packet header, it is nil if packet has no header.
+func (p Packet) Header() Header {
+	return p.header
+}
+
+// SetHeader sets packet header and returns packet.
+func (p *Packet) SetHeader(h Header) *Packet {
+	p.header = h
+	return p
+}
+
+// Flags returns packet flags.
+func (p Packet) Flags() PacketFlags {
+	return p.flags
+}
+
+// SetFlags sets packet flags and returns packet.
+func (p *Packet) SetFlags(f PacketFlags) *Packet {
+	p.flags = f
+	return p
+}
+
+// SetError makes packet error answer with remote error of err, see
+// RemoteErrorOf, and returns packet.
+func (p *Packet) SetError(err error) *Packet {
+	p.data, _ = RemoteErrorOf(err).MarshalBinary()
+	p.flags |= FlagError
+	return p
+}
+
+// IsError returns true if packet is error answer.
+func (p Packet) IsError() bool {
+	return p.flags&FlagError != 0
+}
+
+// Err returns remote error of error answer, or nil if packet is not error
+// answer.
+func (p Packet) Err() error {
+	if !p.IsError() {
+		return nil
+	}
+	e := new(RemoteError)
+	if err := e.UnmarshalBinary(p.data); err != nil {
+		return err
+	}
+	return e
+}
+
 // MarshalBinary marshals binary packet
 func (p Packet) MarshalBinary() (data []byte, err error) {
 	buf := new(bytes.Buffer)
 
+	var version byte
+	switch {
+	case p.flags != 0:
+		version = 2
+	case len(p.header) > 0:
+		version = 1
+	}
+	if version > 0 {
+		buf.Write(packetMagic)
+		buf.WriteByte(version)
+	}
+	if version >= 2 {
+		buf.WriteByte(byte(p.flags))
+	}
 	binary.Write(buf, binary.LittleEndian, p.id)
+	if version >= 1 {
+		header, _ := p.header.MarshalBinary()
+		buf.Write(header)
+	}
 	binary.Write(buf, binary.LittleEndian, p.data)
 
 	data = buf.Bytes()
@@ -47,9 +138,39 @@ func (p Packet) MarshalBinary() (data []byte, err error) {
 func (p *Packet) UnmarshalBinary(data []byte) (err error) {
 	var buf = bytes.NewBuffer(data)
 
+	// Check packet version
+	var version byte
+	if bytes.HasPrefix(data, packetMagic) && len(data) > len(packetMagic) {
+		buf.Next(len(packetMagic))
+		if version, err = buf.ReadByte(); err != nil {
+			return
+		}
+		if version > PacketVersion {
+			return ErrWrongPacketVersion
+		}
+	}
+
+	p.flags = 0
+	if version >= 2 {
+		var flags byte
+		if flags, err = buf.ReadByte(); err != nil {
+			return
+		}
+		p.flags = PacketFlags(flags)
+	}
+
 	if err = binary.Read(buf, binary.LittleEndian, &p.id); err != nil {
 		return
 	}
+	p.header = nil
+	if version >= 1 {
+		if err = p.header.read(buf); err != nil {
+			return
+		}
+		if len(p.header) == 0 {
+			p.header = nil
+		}
+	}
 	d := make([]byte, buf.Len())
 	if err = binary.Read(buf, binary.LittleEndian, d); err != nil {
 		return
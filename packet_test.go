@@ -0,0 +1,159 @@
+package teomq
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPacket(t *testing.T) {
+
+	// Packet without header should be marshalled in version 0 format
+	data, err := NewPacket(7, []byte("answer")).MarshalBinary()
+	if err != nil {
+		t.Error("can't marshal packet:", err)
+		return
+	}
+	if !bytes.Equal(data, append([]byte{7, 0, 0, 0}, "answer"...)) {
+		t.Errorf("wrong version 0 packet %v", data)
+		return
+	}
+
+	// Packet with header should be unmarshalled with header
+	h := Header{HeaderCorrelationID: "req-1", "x-custom": "value"}
+	now := time.Now()
+	h.SetTimestamp(now)
+	data, err = NewPacket(8, []byte("answer")).SetHeader(h).MarshalBinary()
+	if err != nil {
+		t.Error("can't marshal packet:", err)
+		return
+	}
+	var p Packet
+	if err = p.UnmarshalBinary(data); err != nil {
+		t.Error("can't unmarshal packet:", err)
+		return
+	}
+	if p.ID() != 8 || string(p.Data()) != "answer" {
+		t.Errorf("wrong packet id %d or data %s", p.ID(), p.Data())
+		return
+	}
+	if p.Header().CorrelationID() != "req-1" || p.Header().Get("x-custom") != "value" ||
+		!p.Header().Timestamp().Equal(now) {
+		t.Errorf("wrong packet header %v", p.Header())
+		return
+	}
+
+	// Packet of newer version should not be unmarshalled
+	data[len(packetMagic)] = PacketVersion + 1
+	if err = p.UnmarshalBinary(data); err != ErrWrongPacketVersion {
+		t.Errorf("wrong error %v, expected %v", err, ErrWrongPacketVersion)
+		return
+	}
+}
+
+func TestMessageHeader(t *testing.T) {
+
+	// Message envelope should carry header
+	data, err := Message{Queue: "q1", Header: Header{
+		HeaderContentType: "application/json",
+		HeaderTraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}, Data: []byte("{}")}.MarshalBinary()
+	if err != nil {
+		t.Error("can't marshal message:", err)
+		return
+	}
+	var m Message
+	if err = m.UnmarshalBinary(data); err != nil {
+		t.Error("can't unmarshal message:", err)
+		return
+	}
+	if m.Header.ContentType() != "application/json" || m.Queue != "q1" ||
+		m.Header.TraceParent() == "" || string(m.Data) != "{}" {
+		t.Errorf("wrong message %+v", m)
+		return
+	}
+
+	// Message envelope should carry fan-out flag
+	data, _ = Message{FanOut: true, Data: []byte("cmd")}.MarshalBinary()
+	if err = m.UnmarshalBinary(data); err != nil || !m.FanOut ||
+		string(m.Data) != "cmd" {
+		t.Errorf("wrong fan-out message %+v, error %v", m, err)
+		return
+	}
+}
+
+func TestControl(t *testing.T) {
+
+	// Control message should be unmarshalled with ids
+	for _, c := range []Control{
+		{Cmd: CtrlGoingAway},
+		{Cmd: CtrlGoingAway, IDs: []int{1, 22, 333}},
+		{Cmd: CtrlFanOut, IDs: []int{4}, Count: 3},
+		{Cmd: CtrlRedirect, Broker: "leader"},
+		{Cmd: CtrlRedirect, IDs: []int{5, 6}, Broker: "leader@a=b/c"},
+		{Cmd: CtrlLeader, Broker: "leader", Queue: "jobs@a#b=c/d"},
+		{Cmd: CtrlLeader, Broker: "leader"},
+	} {
+		data, err := c.MarshalBinary()
+		if err != nil {
+			t.Error("can't marshal control message:", err)
+			return
+		}
+		if !IsControl(data) {
+			t.Errorf("control message %q is not detected", data)
+			return
+		}
+		var got Control
+		if err = got.UnmarshalBinary(data); err != nil {
+			t.Error("can't unmarshal control message:", err)
+			return
+		}
+		if got.Cmd != c.Cmd || len(got.IDs) != len(c.IDs) ||
+			got.Count != c.Count || got.Broker != c.Broker ||
+			got.Queue != c.Queue {
+			t.Errorf("wrong control message %+v, expected %+v", got, c)
+			return
+		}
+	}
+
+	// Wrong control message should not be unmarshalled
+	var c Control
+	if err := c.UnmarshalBinary([]byte("going-away/1")); err != ErrWrongControl {
+		t.Errorf("wrong error %v, expected %v", err, ErrWrongControl)
+		return
+	}
+}
+
+func TestErrorAnswer(t *testing.T) {
+
+	// Error answer should be unmarshalled with remote error
+	data, err := NewPacket(9, nil).SetError(NewRemoteError(404, "not found")).
+		SetHeader(Header{HeaderCorrelationID: "req-1"}).MarshalBinary()
+	if err != nil {
+		t.Error("can't marshal packet:", err)
+		return
+	}
+	var p Packet
+	if err = p.UnmarshalBinary(data); err != nil {
+		t.Error("can't unmarshal packet:", err)
+		return
+	}
+	rerr, ok := p.Err().(*RemoteError)
+	if !p.IsError() || !ok || rerr.Code != 404 || rerr.Message != "not found" {
+		t.Errorf("wrong error answer error %v", p.Err())
+		return
+	}
+	if p.ID() != 9 || p.Header().CorrelationID() != "req-1" {
+		t.Errorf("wrong error answer id %d or header %v", p.ID(), p.Header())
+		return
+	}
+
+	// Error of other type should be sent with zero code
+	p.SetError(fmt.Errorf("wrapped: %w", ErrWrongMessage))
+	if rerr, ok = p.Err().(*RemoteError); !ok || rerr.Code != 0 ||
+		rerr.Message != "wrapped: "+ErrWrongMessage.Error() {
+		t.Errorf("wrong error answer error %v", p.Err())
+		return
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Producer request/reply module provides synchronous Request and SendAsync
+// which returns handle of sent message.
+
+package producer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// Call is handle of message sent by SendAsync. It is done when the answer is
+// received, the answer timeout expired, or the call canceled.
+type Call struct {
+	p       *Producer
+	id      int
+	done    chan struct{}
+	once    sync.Once
+	mut     sync.Mutex  // protects id, stop and unqueue
+	stop    func() bool // stops context cancel function
+	unqueue func() bool // removes message from outbox
+	answer  *teomq.Packet
+	err     error
+}
+
+// SendAsync sends message to broker and returns handle of the sent message.
+// The attr are Send attributes, answer callbacks are not used. When context
+// done before answer received, the message is removed from waiting messages
+// or from producer outbox if it was not sent to broker yet, and the call is
+// done with context error. Message which was sent to broker before context
+// done may still be delivered to consumer. If context has deadline and the
+// timeout attribute is not set, the answer timeout is equal to time until
+// deadline.
+func (p *Producer) SendAsync(ctx context.Context, data []byte,
+	attr ...any) (c *Call, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	// Answer timeout from context deadline, timeout attribute overrides it
+	if deadline, ok := ctx.Deadline(); ok {
+		attr = append([]any{time.Until(deadline)}, attr...)
+	}
+
+	// Send message with callback which completes call
+	c = &Call{p: p, done: make(chan struct{})}
+	attr = append(attr, AnswerCallback(func(ans *teomq.Packet, err error) bool {
+		c.complete(ans, err)
+		return true
+	}), sentFunc(c.sent), queuedFunc(c.queued))
+	if _, err = p.Send(data, attr...); err != nil {
+		return nil, err
+	}
+
+	// Cancel call when context done, the answer may be already received
+	stop := context.AfterFunc(ctx, func() { c.cancel(ctx.Err()) })
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	select {
+	case <-c.done:
+		stop()
+	default:
+		c.stop = stop
+	}
+	return
+}
+
+// Request sends message to broker and waits answer. It returns answer data,
+// or error if answer timeout expired, context done or consumer returned
+// error, see SendAsync. In command mode it returns first answer.
+func (p *Producer) Request(ctx context.Context, data []byte,
+	attr ...any) ([]byte, error) {
+
+	c, err := p.SendAsync(ctx, data, attr...)
+	if err != nil {
+		return nil, err
+	}
+	<-c.Done()
+	ans, err := c.Answer()
+	if err != nil {
+		return nil, err
+	}
+	return ans.Data(), nil
+}
+
+// ID returns sent message id. It returns zero if message is queued in
+// producer outbox and not sent to broker yet.
+func (c *Call) ID() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.id
+}
+
+// Done returns channel which is closed when call is done.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Answer returns answer packet and error of done call. Error answer packet
+// is returned with *teomq.RemoteError. It returns nil packet and nil error
+// if call is not done yet.
+func (c *Call) Answer() (*teomq.Packet, error) {
+	select {
+	case <-c.done:
+		return c.answer, c.err
+	default:
+		return nil, nil
+	}
+}
+
+// Cancel removes message from waiting messages and completes call with
+// context.Canceled error if call is not done yet.
+func (c *Call) Cancel() {
+	c.cancel(context.Canceled)
+}
+
+// cancel removes message from waiting messages or from outbox and completes
+// call with err. Message sent from outbox after call completed is removed
+// from waiting messages by sent.
+func (c *Call) cancel(err error) {
+	c.complete(nil, err)
+	c.mut.Lock()
+	id, unqueue := c.id, c.unqueue
+	c.mut.Unlock()
+	switch {
+	case id != 0:
+		c.p.Messages.del(id)
+	case unqueue != nil:
+		unqueue()
+	}
+}
+
+// queued sets function which removes message added to outbox from outbox.
+func (c *Call) queued(cancel func() bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.unqueue = cancel
+}
+
+// sent sets id of message sent to broker. Message of done call is removed
+// from waiting messages.
+func (c *Call) sent(id int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.id = id
+	select {
+	case <-c.done:
+		c.p.Messages.del(id)
+	default:
+	}
+}
+
+// complete sets call answer and error and closes done channel once.
+func (c *Call) complete(ans *teomq.Packet, err error) {
+	c.once.Do(func() {
+		c.answer, c.err = ans, err
+		if err != nil && (ans == nil || !ans.IsError()) {
+			c.answer = nil
+		}
+		close(c.done)
+		c.mut.Lock()
+		defer c.mut.Unlock()
+		if c.stop != nil {
+			c.stop()
+		}
+	})
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Producer scatter-gather module provides Gather which collects answers of
+// all consumers the command was sent to in command mode.
+
+package producer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+// Reply is consumer answer collected by Gather.
+type Reply struct {
+	From string // Consumer address, empty if consumer did not answer
+	Data []byte // Answer data
+	Err  error  // *teomq.RemoteError of error answer or teomq.ErrNoAnswer
+}
+
+// First is Gather attribute with number of answers after which Gather
+// returns without waiting other answers.
+type First int
+
+// fanOut is internal Send attribute which asks broker to send fan-out control
+// message with number of consumers the command was sent to.
+type fanOut bool
+
+// gather collects answers of one message.
+type gather struct {
+	mut      sync.Mutex
+	replies  []Reply
+	expected int // number of expected answers, -1 if not known yet
+	first    int // number of answers to return after, 0 if not set
+	id       int // message id, 0 if message is not sent to broker yet
+	err      error
+	done     chan struct{}
+	finished bool
+}
+
+// gathers contains gathers by message id.
+type gathers struct {
+	m map[int]*gather
+	*sync.RWMutex
+}
+
+// newGathers creates a new gathers object.
+func newGathers() *gathers {
+	return &gathers{
+		m:       make(map[int]*gather),
+		RWMutex: new(sync.RWMutex),
+	}
+}
+
+// add adds gather of message.
+func (g *gathers) add(id int, ga *gather) {
+	g.Lock()
+	defer g.Unlock()
+	g.m[id] = ga
+}
+
+// del removes gather of message.
+func (g *gathers) del(id int) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.m, id)
+}
+
+// get returns gather of message.
+func (g *gathers) get(id int) (ga *gather, ok bool) {
+	g.RLock()
+	defer g.RUnlock()
+	ga, ok = g.m[id]
+	return
+}
+
+// Gather sends command to broker and collects answers of consumers. In
+// command mode broker tells producer number of consumers the command was
+// sent to and Gather returns when all of them answered, in normal mode it
+// returns when one answer received. The First attribute sets number of
+// answers after which Gather returns earlier. Other attr are Send
+// attributes, answer callbacks are not used.
+//
+// If consumer did not answer, e.g. disconnected, its reply contains
+// teomq.ErrNoAnswer error. If answer timeout expired or context done before
+// all answers received, Gather returns received answers and error. If
+// context has deadline and the timeout attribute is not set, the answer
+// timeout is equal to time until deadline.
+func (p *Producer) Gather(ctx context.Context, data []byte, attr ...any) (
+	replies []Reply, err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	// Create gather and get Send attributes
+	g := &gather{expected: -1, done: make(chan struct{})}
+	if !p.commandMode {
+		g.expected = 1
+	}
+	var sendAttr []any
+	if deadline, ok := ctx.Deadline(); ok {
+		sendAttr = append(sendAttr, time.Until(deadline))
+	}
+	for _, v := range attr {
+		switch v := v.(type) {
+		case First:
+			g.first = int(v)
+		default:
+			sendAttr = append(sendAttr, v)
+		}
+	}
+	sendAttr = append(sendAttr, AnswerCallback(g.answer),
+		sentFunc(func(id int) { g.sent(p, id) }), fanOut(p.commandMode))
+
+	// Send command and wait answers
+	if _, err = p.Send(data, sendAttr...); err != nil {
+		return
+	}
+	select {
+	case <-g.done:
+	case <-ctx.Done():
+		g.finish(ctx.Err())
+	}
+	g.mut.Lock()
+	if g.id != 0 {
+		p.gathers.del(g.id)
+		p.Messages.del(g.id)
+	}
+	g.mut.Unlock()
+
+	return g.result()
+}
+
+// sent adds gather of message sent to broker to producer gathers. Message of
+// finished gather is removed from waiting messages.
+func (g *gather) sent(p *Producer, id int) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.finished {
+		p.Messages.del(id)
+		return
+	}
+	g.id = id
+	p.gathers.add(id, g)
+}
+
+// answer is gather answer callback.
+func (g *gather) answer(ans *teomq.Packet, err error) bool {
+	var rerr *teomq.RemoteError
+	switch {
+	case err == nil:
+		g.add(Reply{From: ans.Header().Source(), Data: ans.Data()})
+	case errors.As(err, &rerr):
+		g.add(Reply{From: ans.Header().Source(), Err: err})
+	case errors.Is(err, teomq.ErrNoAnswer):
+		g.add(Reply{Err: err})
+	default:
+		g.finish(err)
+	}
+	return true
+}
+
+// add adds reply and finishes gather if all answers received.
+func (g *gather) add(r Reply) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.finished {
+		return
+	}
+	g.replies = append(g.replies, r)
+	g.check()
+}
+
+// expect sets number of expected answers and finishes gather if all answers
+// received.
+func (g *gather) expect(n int) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.finished {
+		return
+	}
+	g.expected = n
+	g.check()
+}
+
+// check finishes gather if all expected or first answers received. It
+// should be called under lock.
+func (g *gather) check() {
+	n := len(g.replies)
+	if (g.expected >= 0 && n >= g.expected) || (g.first > 0 && n >= g.first) {
+		g.finished = true
+		close(g.done)
+	}
+}
+
+// finish finishes gather with error.
+func (g *gather) finish(err error) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.finished {
+		return
+	}
+	g.finished, g.err = true, err
+	close(g.done)
+}
+
+// result returns gathered replies and error.
+func (g *gather) result() ([]Reply, error) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return g.replies, g.err
+}
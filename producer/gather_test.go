@@ -0,0 +1,54 @@
+package producer
+
+import (
+	"testing"
+
+	"github.com/teonet-go/teomq"
+)
+
+func TestGather(t *testing.T) {
+
+	// Answer received before fan-out should be counted
+	g := &gather{expected: -1, done: make(chan struct{})}
+	h := teomq.Header{teomq.HeaderSource: "consumer-1"}
+	g.answer(teomq.NewPacket(1, []byte("answer 1")).SetHeader(h), nil)
+	g.expect(3)
+	g.answer(teomq.NewPacket(1, nil), teomq.ErrNoAnswer)
+	select {
+	case <-g.done:
+		t.Error("gather finished before all answers received")
+		return
+	default:
+	}
+
+	// Gather should finish when all expected answers received
+	rerr := teomq.NewRemoteError(500, "failed")
+	h = teomq.Header{teomq.HeaderSource: "consumer-3"}
+	g.answer(teomq.NewPacket(1, nil).SetError(rerr).SetHeader(h), rerr)
+	select {
+	case <-g.done:
+	default:
+		t.Error("gather not finished")
+		return
+	}
+	replies, err := g.result()
+	if err != nil || len(replies) != 3 {
+		t.Errorf("wrong replies %v, error: %v", replies, err)
+		return
+	}
+	if replies[0].From != "consumer-1" || string(replies[0].Data) != "answer 1" ||
+		replies[1].Err != teomq.ErrNoAnswer || replies[2].Err != rerr ||
+		replies[2].From != "consumer-3" {
+		t.Errorf("wrong replies %v", replies)
+		return
+	}
+
+	// Gather with First attribute should finish after first answers
+	g = &gather{expected: -1, first: 1, done: make(chan struct{})}
+	g.answer(teomq.NewPacket(1, []byte("answer")), nil)
+	g.answer(teomq.NewPacket(1, []byte("answer")), nil)
+	if replies, _ = g.result(); len(replies) != 1 {
+		t.Errorf("wrong number of replies %d", len(replies))
+		return
+	}
+}
@@ -20,9 +20,12 @@ var ErrMessageNotFound = errors.New("message not found")
 type Messages struct {
 	m map[int]MessagesData
 	*sync.RWMutex
+	sending int          // number of messages which are sent now
+	adding  map[int]bool // sent messages which are added now
+	added   *sync.Cond   // signaled when sent message is added
 }
 type MessagesData struct {
-	f RecvCallback
+	f AnswerCallback
 	p *teomq.Packet
 	t time.Time
 }
@@ -30,21 +33,64 @@ type MessagesData struct {
 // RecvCallback is callback function to be called when the message is received.
 type RecvCallback func(id int, data []byte, err error) bool
 
+// AnswerCallback is callback function to be called when the answer packet is
+// received. The answer packet contains answer id, data and header. If err is
+// *teomq.RemoteError the packet is error answer, if err is other error the
+// packet contains sent message id and data.
+type AnswerCallback func(p *teomq.Packet, err error) bool
+
+// answerCallback converts RecvCallback to AnswerCallback.
+func (f RecvCallback) answerCallback() AnswerCallback {
+	if f == nil {
+		return nil
+	}
+	return func(p *teomq.Packet, err error) bool {
+		if err != nil {
+			return f(p.ID(), nil, err)
+		}
+		return f(p.ID(), p.Data(), nil)
+	}
+}
+
 // NewMessages creates new messages queue.
 func NewMessages() *Messages {
-	return &Messages{
+	m := &Messages{
 		m:       make(map[int]MessagesData),
 		RWMutex: &sync.RWMutex{},
+		adding:  make(map[int]bool),
 	}
+	m.added = sync.NewCond(m.RWMutex)
+	return m
 }
 
-// add adds new message to messages queue.
-func (m *Messages) add(id int, data []byte, f RecvCallback,
-	timeout time.Duration) {
+// reserve registers message which is sent now, so answers to it are waited
+// by wait until the message is added by sent and done or unreserved.
+func (m *Messages) reserve() {
+	m.Lock()
+	defer m.Unlock()
+	m.sending++
+}
 
+// unreserve removes registration of message which was not sent.
+func (m *Messages) unreserve() {
 	m.Lock()
 	defer m.Unlock()
+	m.sending--
+	m.added.Broadcast()
+}
 
+// sent adds reserved message which was sent with id to messages queue.
+// Message without answer callback is not added. Answers to the message are
+// waited by wait until done called.
+func (m *Messages) sent(id int, data []byte, f AnswerCallback,
+	timeout time.Duration) {
+
+	m.Lock()
+	defer m.Unlock()
+	m.adding[id] = true
+	if f == nil {
+		return
+	}
 	var ttl time.Time
 	if timeout != 0 {
 		ttl = time.Now().Add(timeout)
@@ -52,8 +98,40 @@ func (m *Messages) add(id int, data []byte, f RecvCallback,
 	m.m[id] = MessagesData{f, teomq.NewPacket(uint32(id), data), ttl}
 }
 
+// done removes registration of sent message added by sent.
+func (m *Messages) done(id int) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.adding, id)
+	m.sending--
+	m.added.Broadcast()
+}
+
+// wait waits until messages with ids are added to messages queue or there
+// is no messages which are sent now.
+func (m *Messages) wait(ids ...int) {
+	m.Lock()
+	defer m.Unlock()
+	for m.sending > 0 && !m.has(ids) {
+		m.added.Wait()
+	}
+}
+
+// has returns true if all messages with ids are added to messages queue. It
+// should be called under lock.
+func (m *Messages) has(ids []int) bool {
+	for _, id := range ids {
+		if _, ok := m.m[id]; !ok || m.adding[id] {
+			return false
+		}
+	}
+	return true
+}
+
 // get returns message from messages queue.
-func (m *Messages) get(id int) (p *teomq.Packet, f RecvCallback, err error) {
+func (m *Messages) get(id int) (p *teomq.Packet, f AnswerCallback,
+	err error) {
+
 	m.RLock()
 	defer m.RUnlock()
 
@@ -73,6 +151,25 @@ func (m *Messages) del(id int) {
 	delete(m.m, id)
 }
 
+// delAll deletes all messages from messages queue and returns them.
+func (m *Messages) delAll() (l []MessagesData) {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, msg := range m.m {
+		l = append(l, msg)
+		delete(m.m, id)
+	}
+	return
+}
+
+// len returns number of messages in messages queue.
+func (m *Messages) len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.m)
+}
+
 // check returns true if message exists in messages queue and timeout expired.
 func (m *Messages) check() (msg MessagesData, ok bool) {
 	m.RLock()
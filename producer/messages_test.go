@@ -0,0 +1,45 @@
+package producer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+func TestMessagesWait(t *testing.T) {
+
+	// Answer to message which is sent now should wait until the message is
+	// added
+	m := NewMessages()
+	m.reserve()
+	waited := make(chan struct{})
+	go func() {
+		m.wait(1)
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Error("answer did not wait message which is sent now")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+	f := func(p *teomq.Packet, err error) bool { return true }
+	m.sent(1, []byte("message"), f, 0)
+	m.done(1)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Error("answer still waits added message")
+		return
+	}
+
+	// Answer should not wait message which was not sent
+	m.reserve()
+	m.unreserve()
+	m.wait(2)
+	if _, _, err := m.get(1); err != nil {
+		t.Error("sent message not found:", err)
+		return
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Producer outbox module provides bounded local queue of messages which are
+// sent while broker is unreachable.
+
+package producer
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teomq"
+)
+
+var (
+	ErrOutboxFull     = errors.New("producer outbox is full")
+	ErrOutboxOverflow = errors.New("message dropped from full producer outbox")
+)
+
+// OutboxSize is producer attribute which turns on producer outbox with
+// maximum number of messages. Messages sent while producer is not connected
+// to broker or broker is going away are queued in outbox and sent to broker
+// in order when producer connected to broker again.
+type OutboxSize int
+
+// OutboxPolicy is producer attribute which sets what Send does when outbox
+// is full. The default policy is OutboxBlock.
+type OutboxPolicy byte
+
+// Outbox policies
+const (
+	// OutboxBlock waits until outbox has free space.
+	OutboxBlock OutboxPolicy = iota
+
+	// OutboxDropOldest drops the oldest outbox message, its answer callback
+	// is executed with ErrOutboxOverflow.
+	OutboxDropOldest
+
+	// OutboxError returns ErrOutboxFull.
+	OutboxError
+)
+
+// OutboxStorage is producer attribute with persistent storage of outbox
+// messages, e.g. broker.FileStorage created by broker.NewFileStorage.
+// Messages stored in the storage are sent to broker when producer created,
+// answers to them are not waited. The storage is closed when producer
+// closed.
+type OutboxStorage interface {
+	// Set adds or replaces record by key.
+	Set(key string, data []byte) error
+	// Del removes record by key.
+	Del(key string) error
+	// Range calls f for each record in keys order until f returns false.
+	Range(f func(key string, data []byte) bool) error
+	// Close flushes and closes storage.
+	Close() error
+}
+
+// outboxPrefix is outbox messages keys prefix in outbox storage.
+const outboxPrefix = "o/"
+
+// outbox contains messages waiting until broker is reachable.
+type outbox struct {
+	list.List       // list of *outboxMessage
+	*sync.Mutex     // mutex
+	*sync.Cond      // signals free space and close
+	size        int // maximum number of messages
+	policy      OutboxPolicy
+	storage     OutboxStorage
+	seq         uint64 // last message sequence number
+	closed      bool
+}
+
+// outboxMessage is message sent by Send.
+type outboxMessage struct {
+	seq      uint64         // outbox sequence number
+	data     []byte         // message data
+	envelope []byte         // data sent to broker
+	f        AnswerCallback // answer callback
+	timeout  time.Duration  // answer timeout
+	sent     sentFunc       // called when message sent to broker
+	queued   queuedFunc     // called when message added to outbox
+}
+
+// sentFunc is internal Send attribute, the function is called with message
+// id when message sent to broker.
+type sentFunc func(id int)
+
+// queuedFunc is internal Send attribute, the function is called when message
+// added to outbox with function which removes the message from outbox and
+// returns false if message is not in outbox already.
+type queuedFunc func(cancel func() bool)
+
+// newOutbox creates a new outbox and loads messages from storage.
+func newOutbox(size int, policy OutboxPolicy, storage OutboxStorage) (
+	o *outbox, err error) {
+
+	o = &outbox{size: size, policy: policy, storage: storage}
+	o.Mutex = new(sync.Mutex)
+	o.Cond = sync.NewCond(o.Mutex)
+	if storage == nil {
+		return
+	}
+	var perr error
+	err = storage.Range(func(key string, data []byte) bool {
+		s, ok := strings.CutPrefix(key, outboxPrefix)
+		if !ok {
+			return true
+		}
+		var seq uint64
+		if seq, perr = strconv.ParseUint(s, 10, 64); perr != nil {
+			return false
+		}
+		o.seq = seq
+		o.PushBack(&outboxMessage{seq: seq, envelope: data})
+		return true
+	})
+	if err == nil {
+		err = perr
+	}
+	if err == nil && o.Len() > 0 {
+		log.Printf(logprefix+"restored %d outbox messages\n", o.Len())
+	}
+	return
+}
+
+// push adds message to the back of outbox according to outbox policy and
+// returns messages dropped from outbox. It should be called under lock.
+func (o *outbox) push(m *outboxMessage) (dropped []*outboxMessage,
+	err error) {
+
+	// Check free space
+	for !o.closed && o.Len() >= o.size {
+		switch o.policy {
+		case OutboxDropOldest:
+			d := o.pop()
+			log.Printf(logprefix+"outbox is full, drop message %d\n", d.seq)
+			dropped = append(dropped, d)
+		case OutboxError:
+			return dropped, ErrOutboxFull
+		default:
+			o.Wait()
+		}
+	}
+	if o.closed {
+		return dropped, ErrClosed
+	}
+
+	// Add message
+	o.seq++
+	m.seq = o.seq
+	if o.storage != nil {
+		if err = o.storage.Set(m.key(), m.envelope); err != nil {
+			return
+		}
+	}
+	o.PushBack(m)
+	return
+}
+
+// pop removes and returns message from the front of outbox. It should be
+// called under lock.
+func (o *outbox) pop() *outboxMessage {
+	return o.del(o.Front())
+}
+
+// cancel removes message from outbox. It returns false if message is not in
+// outbox, e.g. it is sent to broker already.
+func (o *outbox) cancel(m *outboxMessage) bool {
+	o.Lock()
+	defer o.Unlock()
+	for e := o.Front(); e != nil; e = e.Next() {
+		if e.Value == m {
+			o.del(e)
+			return true
+		}
+	}
+	return false
+}
+
+// del removes and returns message of list element from outbox. It should be
+// called under lock.
+func (o *outbox) del(e *list.Element) *outboxMessage {
+	m := o.Remove(e).(*outboxMessage)
+	if o.storage != nil {
+		if err := o.storage.Del(m.key()); err != nil {
+			log.Printf(logprefix+"remove outbox message error: %s\n", err)
+		}
+	}
+	o.Broadcast()
+	return m
+}
+
+// len returns number of messages in outbox.
+func (o *outbox) len() int {
+	if o == nil {
+		return 0
+	}
+	o.Lock()
+	defer o.Unlock()
+	return o.Len()
+}
+
+// close closes outbox and its storage and returns messages left in outbox.
+// Messages remain in storage and are sent when producer created next time.
+func (o *outbox) close() (l []*outboxMessage, err error) {
+	o.Lock()
+	defer o.Unlock()
+	o.closed = true
+	o.Broadcast()
+	for e := o.Front(); e != nil; e = e.Next() {
+		l = append(l, e.Value.(*outboxMessage))
+	}
+	o.Init()
+	if o.storage != nil {
+		err = o.storage.Close()
+	}
+	return
+}
+
+// key returns message key in outbox storage.
+func (m *outboxMessage) key() string {
+	return fmt.Sprintf("%s%020d", outboxPrefix, m.seq)
+}
+
+// ready returns true if messages may be sent to broker.
+func (p *Producer) ready() bool {
+	return p.connected.Load() && !p.goingAway.Load()
+}
+
+// send sends message to broker, or adds it to outbox if outbox is on and
+// broker is not reachable or outbox has messages. It returns zero id if
+// message added to outbox.
+func (p *Producer) send(m *outboxMessage) (id int, err error) {
+
+	// Send message directly if outbox is off
+	if p.outbox == nil {
+		if p.goingAway.Load() {
+			return 0, teomq.ErrBrokerGoingAway
+		}
+		return p.sendTo(m)
+	}
+
+	// Send message directly if outbox is empty and broker is reachable
+	p.outbox.Lock()
+	if p.outbox.Len() == 0 && p.ready() {
+		if id, err = p.sendTo(m); err == nil {
+			p.outbox.Unlock()
+			return
+		}
+	}
+
+	// Add message to outbox and execute answer callbacks of dropped messages
+	dropped, err := p.outbox.push(m)
+	p.outbox.Unlock()
+	for _, d := range dropped {
+		if d.f != nil {
+			d.f(teomq.NewPacket(0, d.data), ErrOutboxOverflow)
+		}
+	}
+	if err == nil && m.queued != nil {
+		m.queued(func() bool { return p.outbox.cancel(m) })
+	}
+	return 0, err
+}
+
+// sendTo sends message to current broker and adds it to messages waiting
+// answers. The message is registered before it is sent, so reader waits
+// until it is added and its answer received before SendTo returned is not
+// lost. Registration is removed if the message was not sent.
+func (p *Producer) sendTo(m *outboxMessage) (id int, err error) {
+	p.Messages.reserve()
+	if id, err = p.transport.SendTo(p.failover.Broker(), m.envelope); err != nil {
+		p.Messages.unreserve()
+		return
+	}
+	p.sent(id, m)
+	return
+}
+
+// sent adds message sent to broker to messages waiting answers. Reader
+// waits answers to the message until sent function called too.
+func (p *Producer) sent(id int, m *outboxMessage) {
+	p.Messages.sent(id, m.data, m.f, m.timeout)
+	if m.sent != nil {
+		m.sent(id)
+	}
+	p.Messages.done(id)
+}
+
+// flush sends outbox messages to broker in order while broker is reachable.
+func (p *Producer) flush() {
+	if p.outbox == nil {
+		return
+	}
+	for p.ready() {
+		p.outbox.Lock()
+		if p.outbox.Len() == 0 {
+			p.outbox.Unlock()
+			return
+		}
+		m := p.outbox.Front().Value.(*outboxMessage)
+		if _, err := p.sendTo(m); err != nil {
+			p.outbox.Unlock()
+			log.Printf(logprefix+"send outbox message error: %s\n", err)
+			return
+		}
+		p.outbox.pop()
+		p.outbox.Unlock()
+	}
+}
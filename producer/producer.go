@@ -6,8 +6,12 @@
 package producer
 
 import (
+	"context"
+	"errors"
 	"log"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teonet-go/teomq"
@@ -16,12 +20,29 @@ import (
 
 const logprefix = "producer: "
 
+// ErrClosed is returned by Send of closed producer and passed to answer
+// callbacks of messages which were waiting answers when producer closed.
+var ErrClosed = errors.New("producer closed")
+
+// shutdownPollInterval is interval of checking waiting messages in Shutdown.
+const shutdownPollInterval = 100 * time.Millisecond
+
 // Producer is Teonet messages queue producers type.
 type Producer struct {
-	broker string
+	failover *teomq.Failover // brokers addresses and current broker
 	*teonet.Teonet
+	transport teomq.Transport
 	*Messages
+	gathers     *gathers
 	commandMode CommandMode
+	ctx         context.Context    // producer context, done when closed
+	cancel      context.CancelFunc // cancels producer context
+	wg          sync.WaitGroup     // producer goroutines
+	closeOnce   sync.Once
+	closeErr    error
+	goingAway   atomic.Bool // broker is going away
+	connected   atomic.Bool // producer is connected to broker
+	outbox      *outbox     // messages waiting until broker is reachable
 }
 
 // CommandMode is true if producer is in command mode. It used in New method to
@@ -30,21 +51,133 @@ type Producer struct {
 // and waits only one answer.
 type CommandMode bool
 
+// Queue is queue name attribute of Send method. Messages sent with Queue
+// attribute go to the named broker queue, messages without it go to the
+// default queue.
+type Queue string
+
+// TTL is message time-to-live attribute of Send method. The broker removes
+// message from queue if it was not sent to consumer during TTL.
+type TTL time.Duration
+
+// Priority is message priority attribute of Send method. The broker sends
+// messages with higher priority to consumers first. Priority value is from 0
+// (default) to teomq.MaxPriority.
+type Priority int
+
+// Delay is message delay attribute of Send method. The broker holds message
+// and does not send it to consumers until delay passed.
+type Delay time.Duration
+
+// DeliverAt is message delivery time attribute of Send method. The broker
+// holds message and does not send it to consumers before this time.
+type DeliverAt time.Time
+
+// Key is message routing key attribute of Send method. The broker sends all
+// messages with the same key to the same consumer one by one, so messages
+// with the same key are processed in order and never concurrently. Legacy
+// consumers which don't acknowledge messages don't get messages with key.
+type Key string
+
+// IdempotencyKey is message idempotency key attribute of Send method. The
+// broker drops messages with the same idempotency key in the same queue
+// during its dedup window and sends them answer of the first message, so
+// retried message is processed once.
+type IdempotencyKey string
+
 // New creates a new Teonet Message Queue Producer object.
+//
+// Optional producer attributes can be passed in the attr parameter together
+// with teonet application attributes:
+//   - CommandMode: starts producer in command mode
+//   - teomq.Brokers: standby brokers addresses, producer fails over to them
+//     when connected broker disconnects
+//   - OutboxSize: turns on outbox which queues messages while broker is
+//     unreachable
+//   - OutboxPolicy: what Send does when outbox is full, OutboxBlock by
+//     default
+//   - OutboxStorage: persistent storage of outbox messages
+//   - teomq.Transport: transport used instead of teonet, e.g. loopback
+//     transport created by teomq.NewLoopback; teonet application
+//     attributes are not used and embedded Teonet is nil in this case
 func New(appShort, broker string, attr ...any) (p *Producer, err error) {
+	return NewContext(context.Background(), appShort, broker, attr...)
+}
+
+// NewContext creates a new Teonet Message Queue Producer object which is
+// closed when context done. See New for attributes description.
+func NewContext(ctx context.Context, appShort, broker string, attr ...any) (
+	p *Producer, err error) {
+
 	p = new(Producer)
-	p.broker = broker
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.failover, attr = teomq.NewFailover(broker, attr...)
+	p.Messages = NewMessages()
+	p.gathers = newGathers()
 	attr = p.setCommands(attr...)
-	p.Teonet, err = teomq.NewTeonet(appShort, attr...)
+	if attr, err = p.addOutbox(attr...); err != nil {
+		p.cancel()
+		return
+	}
+	p.transport, p.Teonet, err = teomq.NewTransport(p.ctx, appShort,
+		p.reader, attr...)
 	if err != nil {
+		p.cancel()
 		return
 	}
-	p.Messages = NewMessages()
 	p.process()
-	teomq.ConnectToBroker(p.Teonet, broker)
+	p.failover.Connect(p.transport)
+	context.AfterFunc(p.ctx, func() { p.Close() })
 	return
 }
 
+// Close stops producer and closes its transport and outbox. Answer callbacks
+// of messages which wait answers or are queued in outbox are executed with
+// ErrClosed.
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		var queued []*outboxMessage
+		if p.outbox != nil {
+			queued, p.closeErr = p.outbox.close()
+		}
+		p.wg.Wait()
+		p.closeErr = errors.Join(p.transport.Close(), p.closeErr)
+		p.failAll(ErrClosed)
+		for _, m := range queued {
+			if m.f != nil {
+				m.f(teomq.NewPacket(0, m.data), ErrClosed)
+			}
+		}
+	})
+	return p.closeErr
+}
+
+// Shutdown gracefully shuts down producer. It waits until outbox messages
+// are sent and all sent messages get answers or timeouts and closes
+// producer. If context done before, producer is closed and context error is
+// returned.
+func (p *Producer) Shutdown(ctx context.Context) error {
+	tick := time.NewTicker(shutdownPollInterval)
+	defer tick.Stop()
+	for p.Messages.len() > 0 || p.outbox.len() > 0 {
+		select {
+		case <-ctx.Done():
+			p.Close()
+			return ctx.Err()
+		case <-p.ctx.Done():
+			return p.Close()
+		case <-tick.C:
+		}
+	}
+	return p.Close()
+}
+
+// Address returns producer address.
+func (p *Producer) Address() string {
+	return p.transport.Address()
+}
+
 // setCommands sets command schema.
 func (p *Producer) setCommands(attr ...any) (outattr []any) {
 
@@ -61,54 +194,171 @@ func (p *Producer) setCommands(attr ...any) (outattr []any) {
 	return
 }
 
+// addOutbox creates producer outbox if outbox size is found in attributes
+// and returns attributes without outbox attributes.
+func (p *Producer) addOutbox(attr ...any) (outattr []any, err error) {
+	var size OutboxSize
+	var policy OutboxPolicy
+	var storage OutboxStorage
+	for _, v := range attr {
+		switch v := v.(type) {
+		case OutboxSize:
+			size = v
+		case OutboxPolicy:
+			policy = v
+		case OutboxStorage:
+			storage = v
+		default:
+			outattr = append(outattr, v)
+		}
+	}
+	if size <= 0 {
+		return
+	}
+	p.outbox, err = newOutbox(int(size), policy, storage)
+	return
+}
+
 // Send sends message to broker.
 //
 // The message is sent to the broker specified in the Producer object.
 // The message data is passed in the data parameter.
 // The function returns the message ID and any error that occurred during
-// sending.
+// sending. If producer outbox is on and broker is unreachable, the message
+// is queued in outbox and zero ID is returned, answer callback gets the
+// message ID when the answer received. Answer timeout of queued message is
+// counted from the time it is sent to broker.
 //
 // Optional parameters can be passed in the attr parameter.
 // The function looks for the following types:
 //   - func(id int, data []byte, err error) bool: callback function to be called
 //     when the message is received.
 //   - RecvCallback: callback function to be called when the message is received.
+//   - func(p *teomq.Packet, err error) bool or AnswerCallback: callback
+//     function to be called when the answer is received, it gets answer
+//     packet with answer header.
+//   - teomq.Header: message header, e.g. content type, correlation id,
+//     timestamp or trace context. It is available to consumer and
+//     correlation id and trace context are returned in answer header.
 //   - time.Duration: timeout value for the message. The default value is 5
 //     seconds.
+//   - Queue: name of the broker queue to send message to.
+//   - TTL: message time-to-live in broker queue. Message without TTL does
+//     not expire unless broker queue has default time-to-live.
+//   - Priority: message priority from 0 (default) to teomq.MaxPriority.
+//   - Delay: delay before the broker sends message to consumers.
+//   - DeliverAt: time before which the broker does not send message to
+//     consumers. Message time-to-live and answer timeout of delayed
+//     message are counted from its delivery time.
+//   - Key: message routing key, messages with the same key are processed by
+//     one consumer in order.
+//   - IdempotencyKey: message idempotency key, broker drops retried messages
+//     with the same key and sends them answer of the first message.
+//
+// Callbacks of error answers get *teomq.RemoteError with error code and
+// message returned by consumer.
 func (p *Producer) Send(data []byte, attr ...any) (id int, err error) {
 
 	// Parse attributes
 	// callback function to be called when the message is received
-	var f RecvCallback
+	var f AnswerCallback
+	// function to be called when the message is sent to broker
+	var sent sentFunc
+	// function to be called when the message is added to outbox
+	var queued queuedFunc
 	// timeout value for the message
 	var timeout time.Duration = 5 * time.Second
+	// message envelope
+	var msg teomq.Message
+	// message idempotency key
+	var key string
 
 	// Look for optional parameters
 	for _, i := range attr {
 		switch v := i.(type) {
 		// Callback function to be called when the message is received
 		case func(id int, data []byte, err error) bool:
-			f = v
+			f = RecvCallback(v).answerCallback()
 		case RecvCallback:
+			f = v.answerCallback()
+		case func(p *teomq.Packet, err error) bool:
+			f = v
+		case AnswerCallback:
 			f = v
+		case sentFunc:
+			sent = v
+		case queuedFunc:
+			queued = v
+		case fanOut:
+			msg.FanOut = bool(v)
+		// Message header
+		case teomq.Header:
+			msg.Header = v
 		// Timeout value for the message
 		case time.Duration:
 			timeout = v
+		// Queue name
+		case Queue:
+			msg.Queue = string(v)
+		// Message time-to-live
+		case TTL:
+			msg.TTL = time.Duration(v)
+		// Message priority
+		case Priority:
+			msg.Priority = int(v)
+		// Message delivery delay
+		case Delay:
+			msg.Delay = time.Duration(v)
+		// Message delivery time
+		case DeliverAt:
+			msg.DeliverAt = time.Time(v)
+		// Message routing key
+		case Key:
+			msg.Key = string(v)
+		// Message idempotency key
+		case IdempotencyKey:
+			key = string(v)
 		}
 	}
+	if key != "" {
+		msg.Header = msg.Header.Clone()
+		if msg.Header == nil {
+			msg.Header = make(teomq.Header)
+		}
+		msg.Header.Set(teomq.HeaderIdempotencyKey, key)
+	}
 
-	// Send message
-	id, err = p.SendTo(p.broker, data)
-	if err != nil {
+	// Check producer closed
+	if p.ctx.Err() != nil {
+		err = ErrClosed
 		return
 	}
 
-	// Add message to messages queue
-	if f != nil {
-		p.Messages.add(id, data, f, timeout)
-	}
+	// Send message or add it to outbox, answer of delayed message is waited
+	// after delay
+	delay := max(msg.Delay, time.Until(msg.DeliverAt), 0)
+	return p.send(&outboxMessage{
+		data:     data,
+		envelope: p.envelope(msg, data),
+		f:        f,
+		timeout:  timeout + delay,
+		sent:     sent,
+		queued:   queued,
+	})
+}
 
-	return
+// envelope returns message data in message envelope if message metadata is
+// set, or message data if it is not.
+func (p *Producer) envelope(msg teomq.Message, data []byte) []byte {
+	if !msg.HasMetadata() {
+		return data
+	}
+	msg.Data = data
+	out, err := msg.MarshalBinary()
+	if err != nil {
+		return data
+	}
+	return out
 }
 
 // Answer unmarshals answer packet from broker.
@@ -118,60 +368,216 @@ func Answer(data []byte) (ans *teomq.Packet, err error) {
 	return
 }
 
-// Process answers from broker.
-func (p *Producer) process() {
+// reader is producer transport reader, it process answers from broker.
+func (p *Producer) reader(c teomq.Channel, pac teomq.Payload,
+	e teomq.Event) bool {
 
-	// Add teonet reader
-	p.AddReader(func(c *teonet.Channel, pac *teonet.Packet, e *teonet.Event) bool {
+	// Skip events of closed producer and not from broker
+	if p.ctx.Err() != nil || c.Address() != p.failover.Broker() {
+		return false
+	}
 
-		// Skip not Data events
-		if e.Event != teonet.EventData {
-			return false
-		}
+	// Reset broker going away flag and send outbox messages when connected
+	// to broker
+	if e == teomq.EventConnected {
+		p.online()
+		return false
+	}
 
-		// Skip not from broker
-		if c.Address() != p.broker {
-			return false
+	// Fail over to standby broker when disconnected, answers to messages
+	// sent to disconnected broker will not be received
+	if e == teomq.EventDisconnected {
+		p.connected.Store(false)
+		if p.failover.Enabled() {
+			p.failAll(teomq.ErrBrokerDisconnected)
+			p.failover.Switch(p.ctx, p.transport, c.Address(),
+				func(broker string) {
+					log.Printf(logprefix+"fail over to broker %s\n", broker)
+					p.online()
+				},
+			)
 		}
+		return false
+	}
 
-		// Unmarshal answer
-		ans, err := Answer(pac.Data())
-		if err != nil {
-			log.Printf(logprefix+"answer unmarshal error: %s\n", err)
-			return false
+	// Skip not Data events
+	if e != teomq.EventData {
+		return false
+	}
+
+	// Process broker control message
+	if teomq.IsControl(pac.Data()) {
+		p.control(c, pac.Data())
+		return true
+	}
+
+	// Unmarshal answer and wait until message which is sent now is added to
+	// waiting messages, so its answer is not lost
+	ans, err := Answer(pac.Data())
+	if err != nil {
+		log.Printf(logprefix+"answer unmarshal error: %s\n", err)
+		return false
+	}
+	p.Messages.wait(ans.ID())
+
+	// Find message in messages queue
+	_, f, err := p.Messages.get(ans.ID())
+	if err != nil {
+		log.Printf(logprefix+"answer id %d error: %s\n", ans.ID(), err)
+		return false
+	}
+
+	// Execute callback, error answer is passed with remote error
+	if f != nil {
+		f(ans, ans.Err())
+	}
+
+	// Delete message
+	if !p.commandMode {
+		p.Messages.del(ans.ID())
+	}
+
+	return true
+}
+
+// online sets producer connected to current broker, resets broker going away
+// flag and sends outbox messages. It is called when producer connected to
+// broker, and when it switched to broker which it was connected to before,
+// because transport does not send connected event in this case.
+func (p *Producer) online() {
+	p.connected.Store(true)
+	p.goingAway.Store(false)
+	go p.flush()
+}
+
+// control processes broker control message. When broker is going away Send
+// returns teomq.ErrBrokerGoingAway until producer connected to broker again,
+// and answer callbacks of messages rejected or lost by broker are executed
+// with this error. Answer callbacks of messages which consumers did not
+// answer are executed with teomq.ErrNoAnswer. When cluster broker rejects
+// messages because leader of their queue is not ready, answer callbacks of
+// rejected messages are executed with teomq.ErrNotLeader; producer switches
+// to broker which redirect control message contains.
+func (p *Producer) control(c teomq.Channel, data []byte) {
+	var ctrl teomq.Control
+	if err := ctrl.UnmarshalBinary(data); err != nil {
+		log.Printf(logprefix+"control message unmarshal error: %s\n", err)
+		return
+	}
+
+	// Wait until messages which are sent now are added to waiting messages,
+	// so their control message is not lost
+	p.Messages.wait(ctrl.IDs...)
+
+	switch ctrl.Cmd {
+	case teomq.CtrlGoingAway:
+		log.Printf(logprefix+"broker %s is going away\n",
+			p.failover.Broker())
+		p.goingAway.Store(true)
+		p.fail(ctrl.IDs, teomq.ErrBrokerGoingAway, true)
+	case teomq.CtrlNoAnswer:
+		// In command mode other consumers may still answer the command
+		p.fail(ctrl.IDs, teomq.ErrNoAnswer, !bool(p.commandMode))
+	case teomq.CtrlAcked:
+		p.acked(ctrl.IDs)
+	case teomq.CtrlFanOut:
+		for _, id := range ctrl.IDs {
+			if g, ok := p.gathers.get(id); ok {
+				g.expect(ctrl.Count)
+			}
 		}
+	case teomq.CtrlRedirect:
+		p.fail(ctrl.IDs, teomq.ErrNotLeader, true)
+		p.redirect(c.Address(), ctrl.Broker)
+	}
+}
 
-		// Find message in messages queue
-		_, f, err := p.Messages.get(ans.ID())
+// redirect switches producer from cluster broker to cluster leader. Messages
+// are queued in outbox, if it is on, until producer connected to the leader.
+func (p *Producer) redirect(broker, leader string) {
+	switch {
+	case leader == "":
+	case leader == broker:
+		p.online()
+	default:
+		log.Printf(logprefix+"broker %s redirects to leader %s\n", broker,
+			leader)
+		p.connected.Store(false)
+		p.failover.Redirect(p.ctx, p.transport, broker, leader,
+			func(broker string) {
+				log.Printf(logprefix+"redirected to broker %s\n", broker)
+				p.online()
+			},
+		)
+	}
+}
+
+// acked executes answer callbacks of messages acknowledged by consumer
+// without answer with empty answer and deletes messages if producer is not
+// in command mode.
+func (p *Producer) acked(ids []int) {
+	for _, id := range ids {
+		_, f, err := p.Messages.get(id)
 		if err != nil {
-			log.Printf(logprefix+"answer id %d error: %s\n", ans.ID(), err)
-			return false
+			continue
 		}
-
-		// Execute callback
 		if f != nil {
-			f(ans.ID(), ans.Data(), nil)
+			f(teomq.NewPacket(uint32(id), nil), nil)
 		}
-
-		// Delete message
 		if !p.commandMode {
-			p.Messages.del(ans.ID())
+			p.Messages.del(id)
 		}
+	}
+}
 
-		return true
-	})
+// failAll executes answer callbacks of all messages which wait answers with
+// error and deletes messages.
+func (p *Producer) failAll(err error) {
+	for _, msg := range p.Messages.delAll() {
+		if msg.f != nil {
+			msg.f(msg.p, err)
+		}
+	}
+}
+
+// fail executes answer callbacks of messages with error and deletes messages
+// if del is true.
+func (p *Producer) fail(ids []int, err error, del bool) {
+	for _, id := range ids {
+		msg, f, e := p.Messages.get(id)
+		if e != nil {
+			continue
+		}
+		if del {
+			p.Messages.del(id)
+		}
+		if f != nil {
+			f(msg, err)
+		}
+	}
+}
+
+// Process answers timeouts until producer closed.
+func (p *Producer) process() {
 
 	// Check timeouts in messages queue, execute callback with error and delete
 	// message
+	p.wg.Add(1)
 	go func() {
+		defer p.wg.Done()
 		for {
 			msg, ok := p.Messages.check()
 			if !ok {
-				time.Sleep(1 * time.Second)
+				p.flush()
+				select {
+				case <-p.ctx.Done():
+					return
+				case <-time.After(1 * time.Second):
+				}
 				continue
 			}
 			if msg.f != nil {
-				msg.f(msg.p.ID(), nil, teonet.ErrTimeout)
+				msg.f(msg.p, teonet.ErrTimeout)
 			}
 			p.Messages.del(msg.p.ID())
 		}
@@ -7,12 +7,11 @@
 package subscribers
 
 import (
-	"fmt"
 	"sync"
 
 	"slices"
 
-	"github.com/teonet-go/teonet"
+	"github.com/teonet-go/teomq"
 )
 
 const (
@@ -20,61 +19,90 @@ const (
 	CmdUnsubscribe = "unsubscribe"
 )
 
-// Subscribers map and mutex to store commands by tru channel
+// Subscribers map and mutex to store commands by tru channel. The commands
+// index contains channels subscribed to each command and topics trie
+// contains channels subscribed to wildcard topics.
 type Subscribers struct {
-	m   SubscribersMap
-	mut *sync.RWMutex
+	m      SubscribersMap
+	index  CommandsIndex
+	topics trie
+	mut    *sync.RWMutex
 }
-type SubscribersMap map[*teonet.Channel][]string
+type SubscribersMap map[teomq.Channel][]string
+type CommandsIndex map[string]map[teomq.Channel]struct{}
 
 // init PlayersOnlineSubscribersMap
 func (s *Subscribers) Init() {
 	s.m = make(SubscribersMap)
+	s.index = make(CommandsIndex)
+	s.topics = trie{}
 	s.mut = new(sync.RWMutex)
 }
 
-// CheckCommand returns true if command exists in subscribers map.
-func (s *Subscribers) CheckCommand(ch *teonet.Channel, command string) bool {
+// CheckCommand returns true if channel subscribed to command or to wildcard
+// topic which matches command.
+func (s *Subscribers) CheckCommand(ch teomq.Channel, command string) bool {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
 
-	// Check channel exists in subscribers
-	if _, ok := s.m[ch]; !ok {
-		fmt.Print("!!! channel does not exists in subscribers map")
-		return false
+	if _, ok := s.index[command][ch]; ok {
+		return true
 	}
+	var ok bool
+	s.topics.match(command, func(c teomq.Channel) { ok = ok || c == ch })
+	return ok
+}
 
-	// Check command exists in commands slice
-	// if !slices.Contains(s.m[ch], command) {
-	// 	fmt.Printf("!!! command %s does not exists in subscribers map/n", command)
-	// 	return true
-	// }
+// Channels returns channels subscribed to command or to wildcard topics which
+// match command.
+func (s *Subscribers) Channels(command string) (l []teomq.Channel) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
 
-	return true
+	for ch := range s.index[command] {
+		l = append(l, ch)
+	}
+	if len(s.topics.children) == 0 {
+		return
+	}
+	seen := make(map[teomq.Channel]struct{})
+	s.topics.match(command, func(ch teomq.Channel) {
+		if _, ok := s.index[command][ch]; ok {
+			return
+		}
+		if _, ok := seen[ch]; !ok {
+			seen[ch] = struct{}{}
+			l = append(l, ch)
+		}
+	})
+	return
 }
 
-// Add teonet channel to subscribers map
-func (s *Subscribers) Add(ch *teonet.Channel, command string) {
+// Add transport channel to subscribers map. The command may be wildcard topic,
+// see WildcardOne and WildcardAny.
+func (s *Subscribers) Add(ch teomq.Channel, command string) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
-	// Create new slice if channel does not exists
-	if _, ok := s.m[ch]; !ok {
-		s.m[ch] = []string{command}
-		return
-	}
-
 	// Check command already exists in commands slice
 	if slices.Contains(s.m[ch], command) {
 		return
 	}
 
-	// Insert new command to commands slice
+	// Insert new command to commands slice and commands index or topics trie
 	s.m[ch] = append(s.m[ch], command)
+	if IsWildcard(command) {
+		s.topics.add(command, ch)
+		return
+	}
+	if _, ok := s.index[command]; !ok {
+		s.index[command] = make(map[teomq.Channel]struct{})
+	}
+	s.index[command][ch] = struct{}{}
 }
 
 // DelCmd deletes command from subscribers map
-func (s *Subscribers) DelCmd(ch *teonet.Channel, command string) {
+func (s *Subscribers) DelCmd(ch teomq.Channel, command string) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
@@ -82,6 +110,7 @@ func (s *Subscribers) DelCmd(ch *teonet.Channel, command string) {
 		for i, v := range s.m[ch] {
 			if v == command {
 				s.m[ch] = slices.Delete(s.m[ch], i, i+1)
+				s.delIndex(ch, command)
 				break
 			}
 		}
@@ -89,9 +118,25 @@ func (s *Subscribers) DelCmd(ch *teonet.Channel, command string) {
 }
 
 // Del deletes tru ch from subscribers map
-func (s *Subscribers) Del(ch *teonet.Channel) {
+func (s *Subscribers) Del(ch teomq.Channel) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
+	for _, command := range s.m[ch] {
+		s.delIndex(ch, command)
+	}
 	delete(s.m, ch)
 }
+
+// delIndex deletes channel from commands index or topics trie. It should be
+// called under lock.
+func (s *Subscribers) delIndex(ch teomq.Channel, command string) {
+	if IsWildcard(command) {
+		s.topics.del(command, ch)
+		return
+	}
+	delete(s.index[command], ch)
+	if len(s.index[command]) == 0 {
+		delete(s.index, command)
+	}
+}
@@ -0,0 +1,100 @@
+package subscribers
+
+import (
+	"testing"
+
+	"github.com/teonet-go/teomq"
+	"github.com/teonet-go/teonet"
+)
+
+func TestSubscribers(t *testing.T) {
+
+	// Create subscribers and subscribe channels to commands
+	var s Subscribers
+	s.Init()
+	c1, c2 := newChannel(), newChannel()
+	s.Add(c1, "num_players")
+	s.Add(c1, "num_servers")
+	s.Add(c2, "num_players")
+	s.Add(c2, "num_players")
+
+	// Check subscribed channels
+	if !s.CheckCommand(c1, "num_servers") || s.CheckCommand(c2, "num_servers") {
+		t.Error("wrong num_servers subscription")
+		return
+	}
+	if l := s.Channels("num_players"); len(l) != 2 {
+		t.Errorf("wrong number of num_players subscribers %d, expected 2",
+			len(l))
+		return
+	}
+
+	// Unsubscribe command and delete channel
+	s.DelCmd(c2, "num_players")
+	if s.CheckCommand(c2, "num_players") {
+		t.Error("c2 should be unsubscribed from num_players")
+		return
+	}
+	s.Del(c1)
+	if len(s.Channels("num_players")) != 0 || len(s.Channels("num_servers")) != 0 ||
+		len(s.index) != 0 {
+		t.Error("commands index should be empty")
+		return
+	}
+}
+
+func TestSubscribersTopics(t *testing.T) {
+
+	// Create subscribers and subscribe channels to wildcard topics
+	var s Subscribers
+	s.Init()
+	c1, c2, c3 := newChannel(), newChannel(), newChannel()
+	s.Add(c1, "game.*.num_players")
+	s.Add(c2, "game.#")
+	s.Add(c3, "game.eu.num_players")
+
+	// Check channels subscribed to commands
+	tests := []struct {
+		command  string
+		channels []teomq.Channel
+	}{
+		{"game.eu.num_players", []teomq.Channel{c1, c2, c3}},
+		{"game.us.num_players", []teomq.Channel{c1, c2}},
+		{"game.us.num_servers", []teomq.Channel{c2}},
+		{"game", []teomq.Channel{c2}},
+		{"game.eu.west.num_players", []teomq.Channel{c2}},
+		{"stats.num_players", nil},
+	}
+	for _, test := range tests {
+		l := s.Channels(test.command)
+		if len(l) != len(test.channels) {
+			t.Errorf("wrong number of %s subscribers %d, expected %d",
+				test.command, len(l), len(test.channels))
+			return
+		}
+		for _, ch := range test.channels {
+			if !s.CheckCommand(ch, test.command) {
+				t.Errorf("channel %p should be subscribed to %s", ch,
+					test.command)
+				return
+			}
+		}
+	}
+
+	// Unsubscribe wildcard topics
+	s.DelCmd(c2, "game.#")
+	s.Del(c1)
+	if l := s.Channels("game.eu.num_players"); len(l) != 1 || l[0] != c3 {
+		t.Error("wrong game.eu.num_players subscribers")
+		return
+	}
+	if len(s.topics.children) != 0 {
+		t.Error("topics trie should be empty")
+		return
+	}
+}
+
+// newChannel returns new transport channel.
+func newChannel() teomq.Channel {
+	return teomq.TeonetChannel(new(teonet.Channel))
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Topics trie module provides wildcard topic
+// subscriptions types and methods.
+
+package subscribers
+
+import (
+	"strings"
+
+	"github.com/teonet-go/teomq"
+)
+
+// Topic wildcards and segments separator. Topic names are hierarchical,
+// e.g. game.eu.num_players. The '*' segment matches exactly one topic segment
+// and the '#' segment matches zero or more topic segments, e.g. game.*.stats
+// or game.#.
+const (
+	TopicSeparator = "."
+	WildcardOne    = "*"
+	WildcardAny    = "#"
+)
+
+// trie is topics trie which contains channels subscribed to wildcard topics.
+type trie struct {
+	children map[string]*trie           // child nodes by topic segment
+	channels map[teomq.Channel]struct{} // channels subscribed to node topic
+}
+
+// IsWildcard returns true if topic contains wildcard segments.
+func IsWildcard(topic string) bool {
+	for _, seg := range strings.Split(topic, TopicSeparator) {
+		if seg == WildcardOne || seg == WildcardAny {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds channel subscribed to topic.
+func (t *trie) add(topic string, ch teomq.Channel) {
+	n := t
+	for _, seg := range strings.Split(topic, TopicSeparator) {
+		if n.children == nil {
+			n.children = make(map[string]*trie)
+		}
+		child, ok := n.children[seg]
+		if !ok {
+			child = new(trie)
+			n.children[seg] = child
+		}
+		n = child
+	}
+	if n.channels == nil {
+		n.channels = make(map[teomq.Channel]struct{})
+	}
+	n.channels[ch] = struct{}{}
+}
+
+// del deletes channel subscribed to topic and removes empty nodes.
+func (t *trie) del(topic string, ch teomq.Channel) {
+	t.delSegments(strings.Split(topic, TopicSeparator), ch)
+}
+
+// delSegments deletes channel subscribed to topic segments. It returns true
+// if node becomes empty.
+func (t *trie) delSegments(segs []string, ch teomq.Channel) bool {
+	if len(segs) == 0 {
+		delete(t.channels, ch)
+	} else if child, ok := t.children[segs[0]]; ok {
+		if child.delSegments(segs[1:], ch) {
+			delete(t.children, segs[0])
+		}
+	}
+	return len(t.channels) == 0 && len(t.children) == 0
+}
+
+// match calls f for each channel subscribed to topic which matches command.
+// The f may be called more than once for one channel.
+func (t *trie) match(command string, f func(ch teomq.Channel)) {
+	t.matchSegments(strings.Split(command, TopicSeparator), f)
+}
+
+// matchSegments matches command segments in node.
+func (t *trie) matchSegments(segs []string, f func(ch teomq.Channel)) {
+
+	// The '#' matches zero or more segments
+	if child, ok := t.children[WildcardAny]; ok {
+		for i := 0; i <= len(segs); i++ {
+			child.matchSegments(segs[i:], f)
+		}
+	}
+
+	// All segments matched
+	if len(segs) == 0 {
+		for ch := range t.channels {
+			f(ch)
+		}
+		return
+	}
+
+	// The segment and '*' match one segment
+	if child, ok := t.children[segs[0]]; ok {
+		child.matchSegments(segs[1:], f)
+	}
+	if child, ok := t.children[WildcardOne]; ok {
+		child.matchSegments(segs[1:], f)
+	}
+}
@@ -7,9 +7,10 @@
 package teomq
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/teonet-go/teonet"
@@ -20,8 +21,21 @@ var (
 	ConsumerAnswer = []byte("Connected to broker")
 )
 
-// NewTeonet creates new teonet connection and connect to teonet.
+// DefaultQueue is name of the broker queue used by producers and consumers
+// which don't set queue name.
+const DefaultQueue = ""
+
+// NewTeonet creates new teonet connection and connect to teonet. It waits
+// until connected.
 func NewTeonet(appShort string, attr ...interface{}) (teo *teonet.Teonet, err error) {
+	return NewTeonetContext(context.Background(), appShort, attr...)
+}
+
+// NewTeonetContext creates new teonet connection and connect to teonet. It
+// waits until connected or context done, and returns context error if
+// context done before connected.
+func NewTeonetContext(ctx context.Context, appShort string,
+	attr ...interface{}) (teo *teonet.Teonet, err error) {
 
 	// Create teonet connection
 	teo, err = teonet.New(appShort, attr...)
@@ -31,22 +45,27 @@ func NewTeonet(appShort string, attr ...interface{}) (teo *teonet.Teonet, err er
 
 	// Connect to teonet
 	for teo.Connect() != nil {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			teo.Close()
+			return nil, ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
 	}
 
-	// Process Ctrl+C signal
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	go func() {
-		<-quit
-		fmt.Println("\nCtrl+C signal received. Exiting...")
-		teo.Close()
-		os.Exit(0)
-	}()
-
 	return
 }
 
+// SignalContext returns copy of parent context which is done when Ctrl+C
+// or SIGTERM signal received. Signals are not handled by broker, producers and
+// consumers, applications may use this context to close them. The stop
+// function stops signals handling.
+func SignalContext(parent context.Context) (ctx context.Context,
+	stop context.CancelFunc) {
+
+	return signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+}
+
 // connectToBroker connects producer or consumer to brokers peer
 func ConnectToBroker(teo *teonet.Teonet, addr string) (err error) {
 	if err = teo.ConnectTo(addr); err != nil {
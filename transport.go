@@ -0,0 +1,199 @@
+// Copyright 2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet messages queue. Transport module provides transport abstraction used
+// by broker, producers and consumers, and teonet transport which is used by
+// default.
+
+package teomq
+
+import (
+	"context"
+	"time"
+
+	"github.com/teonet-go/teonet"
+)
+
+// Event is transport event type.
+type Event byte
+
+// Transport events
+const (
+	EventNone         Event = iota // unknown event
+	EventConnected                 // peer connected
+	EventDisconnected              // peer disconnected
+	EventData                      // data received from peer
+)
+
+// String returns event name.
+func (e Event) String() string {
+	switch e {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventData:
+		return "data"
+	}
+	return "none"
+}
+
+// Channel is transport channel connected to peer. Channels are compared by
+// value, so the same peer connection always has equal channels, and may be
+// used as map keys.
+type Channel interface {
+	// Address returns peer address.
+	Address() string
+	// Send sends data to peer and returns sent packet id.
+	Send(data []byte) (id int, err error)
+	// ServerMode returns true if peer connected to this side.
+	ServerMode() bool
+	// ClientMode returns true if this side connected to peer.
+	ClientMode() bool
+	// Triptime returns channel round-trip time.
+	Triptime() time.Duration
+	// String returns channel name.
+	String() string
+}
+
+// Payload is packet received from transport channel.
+type Payload interface {
+	ID() int
+	Data() []byte
+}
+
+// Reader is transport reader function. It gets channel, received packet and
+// event, the packet is nil if event is not EventData. Transport calls readers
+// in order they were added until one of them returns true.
+type Reader func(c Channel, p Payload, e Event) bool
+
+// Transport connects broker, producers and consumers. It is broker, producer
+// and consumer attribute, teonet transport is used if the attribute is not
+// set.
+type Transport interface {
+	// Address returns this side address.
+	Address() string
+	// SendTo sends data to connected peer and returns sent packet id.
+	SendTo(addr string, data []byte) (id int, err error)
+	// AddReader adds transport reader.
+	AddReader(reader Reader)
+	// ConnectTo connects to peer by address.
+	ConnectTo(addr string) error
+	// WhenConnectedTo calls function f each time when connected to peer.
+	WhenConnectedTo(addr string, f func())
+	// Close disconnects all peers and closes transport.
+	Close() error
+}
+
+// NewTransport returns transport from attributes, or creates teonet transport
+// with attributes if they does not contain transport. The reader is added to
+// transport before it connects. The teo is nil if transport is not teonet
+// transport. It returns context error if context done before teonet
+// connected.
+func NewTransport(ctx context.Context, appShort string, reader Reader,
+	attr ...any) (
+	t Transport, teo *teonet.Teonet, err error) {
+
+	var outattr []any
+	for _, v := range attr {
+		switch v := v.(type) {
+		case Transport:
+			t = v
+		default:
+			outattr = append(outattr, v)
+		}
+	}
+	if t != nil {
+		t.AddReader(reader)
+		return
+	}
+
+	teo, err = NewTeonetContext(ctx, appShort,
+		append(outattr, TeonetReader(reader))...)
+	if err != nil {
+		return
+	}
+	t = NewTeonetTransport(teo)
+	return
+}
+
+// TeonetTransport is Transport which uses teonet.
+type TeonetTransport struct {
+	teo *teonet.Teonet
+}
+
+// NewTeonetTransport creates teonet transport of connected teonet.
+func NewTeonetTransport(teo *teonet.Teonet) *TeonetTransport {
+	return &TeonetTransport{teo}
+}
+
+// Teonet returns teonet used by transport.
+func (t *TeonetTransport) Teonet() *teonet.Teonet {
+	return t.teo
+}
+
+// Address returns teonet address.
+func (t *TeonetTransport) Address() string {
+	return t.teo.Address()
+}
+
+// SendTo sends data to teonet peer.
+func (t *TeonetTransport) SendTo(addr string, data []byte) (int, error) {
+	return t.teo.SendTo(addr, data)
+}
+
+// AddReader adds teonet reader.
+func (t *TeonetTransport) AddReader(reader Reader) {
+	t.teo.AddReader(TeonetReader(reader))
+}
+
+// ConnectTo connects to teonet peer.
+func (t *TeonetTransport) ConnectTo(addr string) error {
+	return t.teo.ConnectTo(addr)
+}
+
+// WhenConnectedTo calls function f when connected to teonet peer.
+func (t *TeonetTransport) WhenConnectedTo(addr string, f func()) {
+	t.teo.WhenConnectedTo(addr, f)
+}
+
+// Close closes teonet.
+func (t *TeonetTransport) Close() error {
+	t.teo.Close()
+	return nil
+}
+
+// TeonetReader converts transport reader to teonet reader. Teonet events
+// other than connected, disconnected and data are skipped.
+func TeonetReader(reader Reader) func(c *teonet.Channel, p *teonet.Packet,
+	e *teonet.Event) bool {
+
+	return func(c *teonet.Channel, p *teonet.Packet, e *teonet.Event) bool {
+		switch e.Event {
+		case teonet.EventConnected:
+			return reader(TeonetChannel(c), nil, EventConnected)
+		case teonet.EventDisconnected:
+			return reader(TeonetChannel(c), nil, EventDisconnected)
+		case teonet.EventData:
+			return reader(TeonetChannel(c), p, EventData)
+		}
+		return false
+	}
+}
+
+// TeonetChannel returns transport channel of teonet channel.
+func TeonetChannel(c *teonet.Channel) Channel {
+	return teonetChannel{c}
+}
+
+// teonetChannel is transport channel of teonet channel. It is compared by
+// teonet channel pointer.
+type teonetChannel struct {
+	*teonet.Channel
+}
+
+// Send sends data to teonet channel.
+func (c teonetChannel) Send(data []byte) (int, error) {
+	return c.Channel.Send(data)
+}